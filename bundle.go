@@ -0,0 +1,233 @@
+package stemma
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// BundleVersion is the version of the bundle file format written by this
+// package.
+const BundleVersion = 1
+
+// bundleMagic begins every bundle file.
+var bundleMagic = []byte("STEMMA-BUNDLE")
+
+// bundleItemHeader precedes each item in the object section of a bundle.
+type bundleItemHeader byte
+
+const (
+	bundleItemHeaderEnd bundleItemHeader = iota
+	bundleItemHeaderObject
+)
+
+/*
+Bundle Layout:
+
+	magic            "STEMMA-BUNDLE"
+	version          uint16
+	tag descriptors  (see MarshalTagDescriptors)
+	prerequisites    uint32 count, followed by that many descriptors
+	objects          for each object: a 1-byte object header, descriptor,
+	                 and the object data (without the object type byte) in
+	                 dependency order, parents before children.
+	end              a 1-byte end header.
+
+*/
+
+// WriteBundle writes a self-describing bundle of the given tagged objects and
+// all of their dependencies to the given writer. Objects which are reachable
+// from any of the given base descriptors are not included and are recorded as
+// prerequisites which the receiver must already have.
+func (r *Repository) WriteBundle(w io.Writer, tags map[string]Descriptor, bases []Descriptor, progress *ProgressMeter) error {
+	excluded := make(digestSet, 1024)
+	for _, base := range bases {
+		if err := r.walkObjects(base, excluded, func(Descriptor) error { return nil }); err != nil {
+			return fmt.Errorf("unable to walk base object %s: %s", base.Digest(), err)
+		}
+	}
+
+	buf := bufio.NewWriter(w)
+
+	if _, err := buf.Write(bundleMagic); err != nil {
+		return fmt.Errorf("unable to write bundle magic: %s", err)
+	}
+
+	if err := binary.Write(buf, binary.LittleEndian, uint16(BundleVersion)); err != nil {
+		return fmt.Errorf("unable to encode bundle version: %s", err)
+	}
+
+	if err := MarshalTagDescriptors(buf, tags, ""); err != nil {
+		return fmt.Errorf("unable to encode bundle tags: %s", err)
+	}
+
+	if err := binary.Write(buf, binary.LittleEndian, uint32(len(bases))); err != nil {
+		return fmt.Errorf("unable to encode number of prerequisites: %s", err)
+	}
+
+	for _, base := range bases {
+		if err := MarshalDescriptor(buf, base); err != nil {
+			return fmt.Errorf("unable to encode prerequisite descriptor: %s", err)
+		}
+	}
+
+	writeObject := func(desc Descriptor) error {
+		if _, err := buf.Write([]byte{byte(bundleItemHeaderObject)}); err != nil {
+			return fmt.Errorf("unable to write object header: %s", err)
+		}
+
+		if err := MarshalDescriptor(buf, desc); err != nil {
+			return fmt.Errorf("unable to encode object descriptor: %s", err)
+		}
+
+		return r.sendObject(buf, progress, desc.Digest())
+	}
+
+	// The excluded set doubles as the set of objects which have already
+	// been written so that objects shared between tags are written once.
+	for _, desc := range tags {
+		if err := r.walkObjects(desc, excluded, writeObject); err != nil {
+			return fmt.Errorf("unable to write object %s: %s", desc.Digest(), err)
+		}
+	}
+
+	if _, err := buf.Write([]byte{byte(bundleItemHeaderEnd)}); err != nil {
+		return fmt.Errorf("unable to write end header: %s", err)
+	}
+
+	return buf.Flush()
+}
+
+// ReadBundle reads a bundle from the given reader, storing all of its objects
+// in this repository. Each object is verified against its digest and is only
+// committed once all of its dependencies have been committed. The tags
+// recorded in the bundle are returned but are not set in this repository.
+func (r *Repository) ReadBundle(rd io.Reader, progress *ProgressMeter) (tags map[string]Descriptor, err error) {
+	buf := bufio.NewReader(rd)
+
+	magic := make([]byte, len(bundleMagic))
+	if _, err := io.ReadFull(buf, magic); err != nil {
+		return nil, fmt.Errorf("unable to read bundle magic: %s", err)
+	}
+
+	if !bytes.Equal(magic, bundleMagic) {
+		return nil, fmt.Errorf("not a bundle file")
+	}
+
+	var version uint16
+	if err := binary.Read(buf, binary.LittleEndian, &version); err != nil {
+		return nil, fmt.Errorf("unable to decode bundle version: %s", err)
+	}
+
+	if version > BundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version: %d", version)
+	}
+
+	if tags, err = UnmarshalTagDescriptors(buf); err != nil {
+		return nil, fmt.Errorf("unable to decode bundle tags: %s", err)
+	}
+
+	var numPrerequisites uint32
+	if err := binary.Read(buf, binary.LittleEndian, &numPrerequisites); err != nil {
+		return nil, fmt.Errorf("unable to decode number of prerequisites: %s", err)
+	}
+
+	for i := uint32(0); i < numPrerequisites; i++ {
+		desc, err := UnmarshalDescriptor(buf)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode prerequisite descriptor: %s", err)
+		}
+
+		if !r.Contains(desc.Digest()) {
+			return nil, fmt.Errorf("missing prerequisite object %s", desc.Digest())
+		}
+	}
+
+	objectDeps := make(dependencySet, 1024)
+
+	for {
+		hdrBuf := []byte{0}
+		if _, err := io.ReadFull(buf, hdrBuf); err != nil {
+			return nil, fmt.Errorf("unable to read next object header: %s", err)
+		}
+
+		hdr := bundleItemHeader(hdrBuf[0])
+		if hdr == bundleItemHeaderEnd {
+			break
+		}
+
+		if hdr != bundleItemHeaderObject {
+			return nil, fmt.Errorf("unknown bundle item header value: %d", hdr)
+		}
+
+		desc, err := UnmarshalDescriptor(buf)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode object descriptor: %s", err)
+		}
+
+		object := newByteCountReader(io.LimitReader(buf, int64(desc.Size())), &progress.TransferredSize)
+
+		tempRef, dependencies, err := r.receiveObject(object, desc, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to copy object %s to local store: %s", desc.Digest(), err)
+		}
+
+		progress.TransferredObjects++
+
+		// Objects are written parents first, so any dependencies
+		// which are not yet committed are expected to follow.
+		depTracker := &tempRefDep{tempRef: tempRef}
+		for _, dep := range dependencies {
+			if !r.Contains(dep.Digest()) {
+				depTracker.numMissingDeps++
+				objectDeps.Add(dep.Digest(), depTracker)
+			}
+		}
+
+		if depTracker.numMissingDeps > 0 {
+			continue
+		}
+
+		if _, err := tempRef.Commit(); err != nil {
+			return nil, fmt.Errorf("unable to commit object to local store: %s", err)
+		}
+
+		if err := objectDeps.Remove(desc.Digest()); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(objectDeps) > 0 {
+		return nil, fmt.Errorf("bundle is incomplete: %d objects are missing", len(objectDeps))
+	}
+
+	for tag, desc := range tags {
+		if !r.Contains(desc.Digest()) {
+			return nil, fmt.Errorf("bundle is incomplete: missing object %s for tag %q", desc.Digest(), tag)
+		}
+	}
+
+	return tags, nil
+}
+
+// SetBundleTags sets the tags returned by ReadBundle in this repository.
+// Objects which were bundled by reference rather than by tag are named by
+// their digest and are not tagged. The tags which were set are returned.
+func (r *Repository) SetBundleTags(tags map[string]Descriptor) (set map[string]Descriptor, err error) {
+	set = make(map[string]Descriptor, len(tags))
+	for tag, desc := range tags {
+		if tag == desc.Digest().String() {
+			continue
+		}
+
+		if err := r.TagStore().Set(tag, desc); err != nil {
+			return set, fmt.Errorf("unable to set tag %q: %s", tag, err)
+		}
+
+		set[tag] = desc
+	}
+
+	return set, nil
+}
@@ -0,0 +1,119 @@
+package stemma
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// storeTestDirectory stores a directory containing files with the given
+// names and contents in the given repository.
+func storeTestDirectory(t *testing.T, repo *Repository, files map[string]string) Descriptor {
+	dir, err := ioutil.TempDir("", "stemma-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	desc, err := repo.StoreDirectory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return desc
+}
+
+// readTestFile returns the contents of the file with the given digest.
+func readTestFile(t *testing.T, repo *Repository, digest Digest) string {
+	file, err := repo.GetFile(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(contents)
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	src, cleanupSrc := newTestRepository(t)
+	defer cleanupSrc()
+
+	dst, cleanupDst := newTestRepository(t)
+	defer cleanupDst()
+
+	v1 := storeTestDirectory(t, src, map[string]string{"a": "one"})
+	v2 := storeTestDirectory(t, src, map[string]string{"a": "one", "b": "two"})
+	a := storeTestFile(t, src, "one")
+	b := storeTestFile(t, src, "two")
+
+	var full bytes.Buffer
+	if err := src.WriteBundle(&full, map[string]Descriptor{"app": v1}, nil, &ProgressMeter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second bundle excludes everything reachable from the first and
+	// includes a file by reference rather than by tag.
+	var incremental bytes.Buffer
+	progress := &ProgressMeter{}
+	bundled := map[string]Descriptor{"app2": v2, b.Digest().String(): b}
+	if err := src.WriteBundle(&incremental, bundled, []Descriptor{v1}, progress); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the second directory and the new file are bundled.
+	if progress.TransferredObjects != 2 {
+		t.Errorf("bundled %d objects, expected 2", progress.TransferredObjects)
+	}
+
+	if _, err := dst.ReadBundle(bytes.NewReader(incremental.Bytes()), &ProgressMeter{}); err == nil {
+		t.Fatal("expected an error reading a bundle with a missing prerequisite")
+	}
+
+	for _, bundle := range []*bytes.Buffer{&full, &incremental} {
+		tags, err := dst.ReadBundle(bundle, &ProgressMeter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := dst.SetBundleTags(tags); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for tag, expected := range map[string]Descriptor{"app": v1, "app2": v2} {
+		desc, err := dst.TagStore().Get(tag)
+		if err != nil {
+			t.Fatalf("unable to get tag %q: %s", tag, err)
+		}
+
+		if desc.Digest().String() != expected.Digest().String() {
+			t.Errorf("tag %q is %s, expected %s", tag, desc.Digest(), expected.Digest())
+		}
+	}
+
+	if _, err := dst.TagStore().Get(b.Digest().String()); err != ErrNoSuchTag {
+		t.Errorf("object bundled by reference was tagged: %v", err)
+	}
+
+	for _, file := range []struct {
+		desc     Descriptor
+		contents string
+	}{{a, "one"}, {b, "two"}} {
+		if got := readTestFile(t, dst, file.desc.Digest()); got != file.contents {
+			t.Errorf("file %s contains %q, expected %q", file.desc.Digest(), got, file.contents)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jlhawn/stemma"
+)
+
+const usage = `Usage:
+  stemma-bundle create REF... FILE [--since REF]...
+  stemma-bundle unbundle FILE`
+
+// refList is a flag value which may be specified multiple times.
+type refList []string
+
+func (l *refList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *refList) Set(ref string) error {
+	*l = append(*l, ref)
+	return nil
+}
+
+func main() {
+	repoPath := flag.String("repo", stemma.DefaultRepositoryPath(), "path to the repository (defaults to $STEMMA_REPO or the current directory)")
+
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	repo, err := stemma.NewRepository(*repoPath)
+	if err != nil {
+		log.Fatalf("unable to initialize repository: %s", err)
+	}
+
+	switch flag.Arg(0) {
+	case "create":
+		create(repo, flag.Args()[1:])
+	case "unbundle":
+		unbundle(repo, flag.Args()[1:])
+	default:
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+}
+
+func create(repo *stemma.Repository, args []string) {
+	var since refList
+
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	flags.Var(&since, "since", "exclude objects reachable from this ref (may be repeated)")
+
+	// Allow flags to be given before, between, or after positional
+	// arguments.
+	var positional []string
+	for {
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			break
+		}
+
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	if len(positional) < 2 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	refs, path := positional[:len(positional)-1], positional[len(positional)-1]
+
+	// Acquire a shared lock on the repository so we can freely read its
+	// contents.
+	if err := repo.SharedLock(); err != nil {
+		log.Fatalf("unable to acquire shared repo lock: %s", err)
+	}
+	defer repo.Unlock()
+
+	// Tags are bundled under their own names. Any other reference is
+	// bundled under the digest it resolves to.
+	tags := make(map[string]stemma.Descriptor, len(refs))
+	for _, ref := range refs {
+		name := ref
+		if _, err := repo.TagStore().Get(ref); err != nil {
+			if err != stemma.ErrNoSuchTag {
+				log.Fatalf("unable to get tag %q: %s", ref, err)
+			}
+
+			name = ""
+		}
+
+		desc := resolve(repo, ref)
+		if name == "" {
+			name = desc.Digest().String()
+		}
+
+		tags[name] = desc
+	}
+
+	bases := make([]stemma.Descriptor, 0, len(since))
+	for _, ref := range since {
+		bases = append(bases, resolve(repo, ref))
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("unable to create bundle file: %s", err)
+	}
+
+	progress := &stemma.ProgressMeter{}
+	if err := repo.WriteBundle(file, tags, bases, progress); err != nil {
+		file.Close()
+		os.Remove(path)
+		log.Fatalf("unable to write bundle: %s", err)
+	}
+
+	if err := file.Close(); err != nil {
+		log.Fatalf("unable to close bundle file: %s", err)
+	}
+
+	fmt.Printf("Bundled Objects: %10d %6s\n", progress.TransferredObjects, stemma.HumanSize(progress.TransferredSize))
+}
+
+// resolve returns the descriptor of the object which the given reference
+// resolves to.
+func resolve(repo *stemma.Repository, ref string) stemma.Descriptor {
+	digest, err := repo.ResolveRef(ref)
+	if err != nil {
+		log.Fatalf("unable to resolve reference %q: %s", ref, err)
+	}
+
+	desc, err := repo.GetDescriptor(digest)
+	if err != nil {
+		log.Fatalf("unable to get descriptor for %q: %s", ref, err)
+	}
+
+	return desc
+}
+
+func unbundle(repo *stemma.Repository, args []string) {
+	if len(args) < 1 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	// Acquire an exclusive lock on the repository as we will be setting
+	// tags.
+	if err := repo.ExclusiveLock(); err != nil {
+		log.Fatalf("unable to acquire exclusive repo lock: %s", err)
+	}
+	defer repo.Unlock()
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		log.Fatalf("unable to open bundle file: %s", err)
+	}
+	defer file.Close()
+
+	progress := &stemma.ProgressMeter{}
+	tags, err := repo.ReadBundle(file, progress)
+	if err != nil {
+		log.Fatalf("unable to read bundle: %s", err)
+	}
+
+	fmt.Printf("Received Objects: %10d %6s\n", progress.TransferredObjects, stemma.HumanSize(progress.TransferredSize))
+
+	set, err := repo.SetBundleTags(tags)
+	if err != nil {
+		log.Fatalf("unable to set bundled tags: %s", err)
+	}
+
+	for tag, desc := range tags {
+		if _, ok := set[tag]; !ok {
+			fmt.Printf("%s\n", tag)
+			continue
+		}
+
+		fmt.Printf("%s -> %s\n", tag, desc.Digest())
+	}
+}
@@ -11,14 +11,17 @@ import (
 )
 
 func main() {
+	repoPath := flag.String("repo", stemma.DefaultRepositoryPath(), "path to the repository (defaults to $STEMMA_REPO or the current directory)")
+	force := flag.Bool("force", false, "when fetching from a URL, replace a local tag which refers to something else")
+
 	flag.Parse()
 
 	if flag.NArg() < 2 {
-		fmt.Println("Usage: stemma-fetch REMOTE TAG")
+		fmt.Println("Usage: stemma-fetch [-force] REMOTE TAG")
 		os.Exit(1)
 	}
 
-	repo, err := stemma.NewRepository(".")
+	repo, err := stemma.NewRepository(*repoPath)
 	if err != nil {
 		log.Fatalf("unable to initialize repository: %s", err)
 	}
@@ -34,12 +37,27 @@ func main() {
 		log.Fatalf("unable to resolve remote reference: %s", err)
 	}
 
+	// Fetches from a named remote only update its remote-tracking tag.
+	// Local tags are updated from those with stemma-remote apply. A fetch
+	// from a URL sets the local tag, but will not replace one which
+	// refers to something else unless forced.
+	tags, tagName := repo.TagStore(), ref
+	if _, ok := repo.Config().Remotes[flag.Arg(0)]; ok {
+		if tags, err = repo.RemoteTagStore(flag.Arg(0)); err != nil {
+			log.Fatalf("unable to get remote-tracking tags: %s", err)
+		}
+
+		tagName = "remotes/" + flag.Arg(0) + "/" + ref
+	} else if localDesc, err := tags.Get(ref); err == nil && !*force && !localDesc.Digest().Equals(desc.Digest()) {
+		log.Fatalf("not replacing local tag %q which refers to %s - use -force", ref, localDesc.Digest())
+	}
+
 	if repo.Contains(desc.Digest()) {
-		if err := repo.TagStore().Set(ref, desc); err != nil {
-			log.Fatalf("unable to set local tag: %s", err)
+		if err := tags.Set(ref, desc); err != nil {
+			log.Fatalf("unable to set tag: %s", err)
 		}
 
-		fmt.Println("Already up to date.")
+		fmt.Printf("Already up to date: %s -> %s\n", tagName, desc.Digest())
 		os.Exit(0)
 	}
 
@@ -48,7 +66,7 @@ func main() {
 		TotalSize:    desc.Size() + desc.SubObjectsSize(),
 	}
 
-	fmt.Printf("Total Objects: %10d %6s\n", progress.TotalObjects, humanSize(progress.TotalSize))
+	fmt.Printf("Total Objects: %10d %6s\n", progress.TotalObjects, stemma.HumanSize(progress.TotalSize))
 
 	done := make(chan int)
 	go func() {
@@ -72,11 +90,12 @@ func main() {
 	done <- 1
 	<-done
 
-	if err := repo.TagStore().Set(ref, desc); err != nil {
-		log.Fatalf("unable to set local tag: %s", err)
+	if err := tags.Set(ref, desc); err != nil {
+		log.Fatalf("unable to set tag: %s", err)
 	}
 
-	fmt.Printf("\nSkipped Objects: %10d %6s\n", progress.SkippedObjects, humanSize(progress.SkippedSize))
+	fmt.Printf("\nSkipped Objects: %10d %6s\n", progress.SkippedObjects, stemma.HumanSize(progress.SkippedSize))
+	fmt.Printf("%s -> %s\n", tagName, desc.Digest())
 }
 
 func updateProgress(progress *stemma.ProgressMeter) {
@@ -85,32 +104,10 @@ func updateProgress(progress *stemma.ProgressMeter) {
 	fmt.Printf(
 		"\rTransferring Objects: %6d %6.2f%%  %10s %6.2f%%",
 		objectsProgress, percent(objectsProgress, uint64(progress.TotalObjects)),
-		humanSize(sizeProgress), percent(sizeProgress, progress.TotalSize),
+		stemma.HumanSize(sizeProgress), percent(sizeProgress, progress.TotalSize),
 	)
 }
 
 func percent(current, total uint64) float64 {
 	return float64(current) / float64(total) * 100.0
 }
-
-const (
-	kilobyte = 1024
-	megabyte = kilobyte * kilobyte
-	gigabyte = megabyte * kilobyte
-	terabyte = megabyte * kilobyte
-)
-
-func humanSize(numBytes uint64) string {
-	switch {
-	case numBytes > terabyte:
-		return fmt.Sprintf("%.3fTB", float64(numBytes)/terabyte)
-	case numBytes > gigabyte:
-		return fmt.Sprintf("%.3fGB", float64(numBytes)/gigabyte)
-	case numBytes > megabyte:
-		return fmt.Sprintf("%.3fMB", float64(numBytes)/megabyte)
-	case numBytes > kilobyte:
-		return fmt.Sprintf("%.3fKB", float64(numBytes)/kilobyte)
-	default:
-		return fmt.Sprintf("%dB", numBytes)
-	}
-}
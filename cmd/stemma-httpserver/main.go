@@ -6,29 +6,48 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/jlhawn/stemma"
 )
 
 func main() {
+	repoPath := flag.String("repo", stemma.DefaultRepositoryPath(), "path to the repository (defaults to $STEMMA_REPO or the current directory)")
+	upstreamURL := flag.String("upstream", "", "URL of a remote to proxy objects and tags from")
+	tagTTL := flag.Duration("tag-ttl", time.Minute, "how long to serve a tag before refreshing it from the upstream")
+
 	flag.Parse()
 
 	if flag.NArg() < 1 {
-		fmt.Println("Usage: stemma-httpserver PORT")
+		fmt.Println("Usage: stemma-httpserver [-upstream URL [-tag-ttl DURATION]] PORT")
 		os.Exit(1)
 	}
 
-	repo, err := stemma.NewRepository(".")
+	repo, err := stemma.NewRepository(*repoPath)
 	if err != nil {
 		log.Fatalf("unable to initialize repository: %s", err)
 	}
 
+	if *upstreamURL != "" {
+		upstream, err := repo.RemoteObjectStore(*upstreamURL)
+		if err != nil {
+			log.Fatalf("unable to initialize upstream: %s", err)
+		}
+
+		repo.SetUpstream(upstream, *tagTTL)
+	}
+
 	r := mux.NewRouter()
 	r.Queries("service", "get-tag").HandlerFunc(repo.HandleGetTag)
 	r.Queries("service", "list-tags").HandlerFunc(repo.HandleListTags)
 	r.Queries("service", "serve-objects").HandlerFunc(repo.HandleServeObjects)
 	r.Queries("service", "receive-objects").HandlerFunc(repo.HandleReceiveObjects)
 
+	// Plain HTTP endpoints usable by standard clients and caches.
+	r.Methods("GET", "HEAD").Path("/objects/{digest:[0-9a-fA-F]+}").HandlerFunc(repo.HandleGetObject)
+	r.Methods("GET", "HEAD").Path("/tags").HandlerFunc(repo.HandleListTagsJSON)
+	r.Methods("GET", "HEAD").Path("/tags/{name:.+}").HandlerFunc(repo.HandleGetTagJSON)
+
 	log.Fatal(http.ListenAndServe(flag.Arg(0), r))
 }
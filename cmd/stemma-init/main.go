@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jlhawn/stemma"
+)
+
+// remoteList is a flag which may be given multiple times to configure named
+// remotes as NAME=URL.
+type remoteList map[string]string
+
+func (l remoteList) String() string {
+	remotes := make([]string, 0, len(l))
+	for name, url := range l {
+		remotes = append(remotes, name+"="+url)
+	}
+
+	return strings.Join(remotes, ",")
+}
+
+func (l remoteList) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return fmt.Errorf("invalid remote %q: must be NAME=URL", value)
+	}
+
+	l[value[:i]] = value[i+1:]
+
+	return nil
+}
+
+func main() {
+	config := stemma.DefaultConfig
+	remotes := remoteList{}
+
+	repoPath := flag.String("repo", stemma.DefaultRepositoryPath(), "path to the repository (defaults to $STEMMA_REPO or the current directory)")
+	algName := flag.String("alg", config.DigestAlg.String(), "name of the digest algorithm for new objects")
+	flag.StringVar(&config.Compression, "compression", config.Compression, "preferred compression method for object transfers: flate or none")
+	flag.StringVar(&config.Durability, "durability", config.Durability, "how much of each new object is synced before it is committed: none, file or file+dir")
+	flag.IntVar(&config.FetchSyncBatch, "fetch-sync-batch", config.FetchSyncBatch, "number of fetched objects to sync together, or 0 to sync each on its own")
+	flag.Var(remotes, "remote", "add a named remote as NAME=URL (may be repeated)")
+
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		fmt.Println("Usage: stemma-init [-alg NAME] [-compression METHOD] [-durability MODE] [-fetch-sync-batch N] [-remote NAME=URL...] [PATH]")
+		os.Exit(1)
+	}
+
+	path := *repoPath
+	if flag.NArg() == 1 {
+		path = flag.Arg(0)
+	}
+
+	var err error
+	if config.DigestAlg, err = stemma.ParseDigestAlg(*algName); err != nil {
+		log.Fatalf("unable to use digest algorithm %q: %s", *algName, err)
+	}
+
+	if len(remotes) > 0 {
+		config.Remotes = remotes
+	}
+
+	if _, err := stemma.InitRepository(path, config); err != nil {
+		log.Fatalf("unable to initialize repository: %s", err)
+	}
+
+	fmt.Printf("Initialized repository in %s\n", path)
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlhawn/stemma"
+)
+
+const usage = "Usage: stemma-mirror [OPTIONS] [REMOTE...]"
+
+// patternList is a flag value which may be specified multiple times.
+type patternList []string
+
+func (l *patternList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *patternList) Set(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %s", pattern, err)
+	}
+
+	*l = append(*l, pattern)
+	return nil
+}
+
+// matchAny returns whether the given tag matches any of the patterns.
+func (l patternList) matchAny(tag string) bool {
+	for _, pattern := range l {
+		if matched, _ := path.Match(pattern, tag); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mirror keeps the tags of a local repository in sync with one or more
+// remotes.
+type mirror struct {
+	repo     *stemma.Repository
+	remotes  []string
+	includes patternList
+	excludes patternList
+	prune    bool
+
+	statusPath string
+
+	mu     sync.Mutex
+	status mirrorStatus
+}
+
+// mirrorStatus reports the result of the most recent sync of each remote and
+// tag.
+type mirrorStatus struct {
+	LastSync time.Time               `json:"lastSync"`
+	Remotes  map[string]remoteStatus `json:"remotes"`
+	Tags     map[string]tagStatus    `json:"tags"`
+	// Mirrored maps each local tag which the mirror has set to the digest
+	// it was set to. Only these tags are pruned.
+	Mirrored map[string]string `json:"mirrored"`
+}
+
+func newMirrorStatus() mirrorStatus {
+	return mirrorStatus{
+		Remotes:  map[string]remoteStatus{},
+		Tags:     map[string]tagStatus{},
+		Mirrored: map[string]string{},
+	}
+}
+
+type remoteStatus struct {
+	LastSync time.Time `json:"lastSync"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type tagStatus struct {
+	Remote   string    `json:"remote"`
+	Digest   string    `json:"digest,omitempty"`
+	LastSync time.Time `json:"lastSync"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func main() {
+	m := &mirror{}
+
+	repoPath := flag.String("repo", stemma.DefaultRepositoryPath(), "path to the repository (defaults to $STEMMA_REPO or the current directory)")
+	interval := flag.Duration("interval", time.Minute, "time to wait between syncs")
+	once := flag.Bool("once", false, "sync once and exit")
+	listenAddr := flag.String("listen", "", "address on which to serve sync status over HTTP")
+	flag.Var(&m.includes, "include", "only mirror tags matching this glob pattern (may be repeated)")
+	flag.Var(&m.excludes, "exclude", "do not mirror tags matching this glob pattern (may be repeated)")
+	flag.BoolVar(&m.prune, "prune", false, "delete local tags set by the mirror which no remote has any longer")
+	flag.StringVar(&m.statusPath, "status", "", "path of a file to which sync status is written as JSON")
+
+	flag.Parse()
+
+	var err error
+	m.repo, err = stemma.NewRepository(*repoPath)
+	if err != nil {
+		log.Fatalf("unable to initialize repository: %s", err)
+	}
+
+	// Wait for other programs to release the repository rather than
+	// skipping a sync.
+	m.repo.SetBlocking(true)
+
+	// Each remote takes precedence over those listed after it for tags
+	// which more than one remote has. If no remotes are given, every
+	// remote in the repository config is mirrored in order of name.
+	m.remotes = flag.Args()
+	if len(m.remotes) == 0 {
+		for name := range m.repo.Config().Remotes {
+			m.remotes = append(m.remotes, name)
+		}
+
+		sort.Strings(m.remotes)
+	}
+
+	if len(m.remotes) == 0 {
+		fmt.Println(usage)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	// The status file records which tags were set by the mirror so that
+	// they may be pruned after a restart.
+	if err := m.readStatus(); err != nil {
+		log.Fatalf("unable to read status file: %s", err)
+	}
+
+	if *listenAddr != "" {
+		http.HandleFunc("/status", m.handleStatus)
+		go func() {
+			log.Fatal(http.ListenAndServe(*listenAddr, nil))
+		}()
+	}
+
+	for {
+		m.sync()
+
+		if *once {
+			return
+		}
+
+		time.Sleep(*interval)
+	}
+}
+
+// shouldMirror returns whether the given tag matches the include and exclude
+// patterns.
+func (m *mirror) shouldMirror(tag string) bool {
+	if len(m.includes) > 0 && !m.includes.matchAny(tag) {
+		return false
+	}
+
+	return !m.excludes.matchAny(tag)
+}
+
+// tagUpdate is a change to a local tag whose objects have been fetched from
+// a remote.
+type tagUpdate struct {
+	tag       string
+	remoteURL string
+	current   stemma.Descriptor
+	desc      stemma.Descriptor
+}
+
+// sync fetches every changed tag from each remote and updates the local
+// tags.
+func (m *mirror) sync() {
+	// Acquire a shared lock on the repository so that objects are not
+	// removed while we are fetching.
+	if err := m.repo.SharedLock(); err != nil {
+		log.Printf("unable to acquire shared repo lock: %s", err)
+		return
+	}
+
+	updates, remoteTags, allListed := m.fetchRemotes()
+
+	m.repo.Unlock()
+
+	// Acquire an exclusive lock on the repository as we will be changing
+	// tags.
+	if err := m.repo.ExclusiveLock(); err != nil {
+		log.Printf("unable to acquire exclusive repo lock: %s", err)
+		return
+	}
+
+	for _, update := range updates {
+		err := m.setTag(update)
+		if err != nil {
+			log.Printf("unable to mirror tag %q from %s: %s", update.tag, update.remoteURL, err)
+		}
+
+		m.setTagStatus(update.tag, update.remoteURL, update.desc, err)
+	}
+
+	// Only prune if every remote was listed, otherwise a temporarily
+	// unreachable remote would result in all of its tags being deleted.
+	if m.prune && allListed {
+		m.pruneTags(remoteTags)
+	}
+
+	m.repo.Unlock()
+
+	m.mu.Lock()
+	m.status.LastSync = time.Now()
+	m.mu.Unlock()
+
+	if err := m.writeStatus(); err != nil {
+		log.Printf("unable to write status file: %s", err)
+	}
+}
+
+// fetchRemotes lists the tags of each remote and fetches the objects of those
+// which have changed. It returns the changes to make to the local tags, the
+// tags which any remote has, mapped to the first remote which has them, and
+// whether every remote was listed.
+func (m *mirror) fetchRemotes() (updates []tagUpdate, remoteTags map[string]string, allListed bool) {
+	remoteTags = map[string]string{}
+	allListed = true
+
+	for _, remoteURL := range m.remotes {
+		remote, err := m.repo.RemoteObjectStore(remoteURL)
+		if err != nil {
+			log.Printf("unable to get remote object store %s: %s", remoteURL, err)
+			m.setRemoteStatus(remoteURL, err)
+			allListed = false
+			continue
+		}
+
+		tagDescriptors, err := remote.ListTags("")
+		m.setRemoteStatus(remoteURL, err)
+		if err != nil {
+			log.Printf("unable to list tags of remote %s: %s", remoteURL, err)
+			allListed = false
+			continue
+		}
+
+		for tag, desc := range tagDescriptors {
+			if !m.shouldMirror(tag) {
+				continue
+			}
+
+			if _, ok := remoteTags[tag]; ok {
+				continue
+			}
+
+			remoteTags[tag] = remoteURL
+
+			current, changed, err := m.fetchTag(remote, tag, desc)
+			if err != nil {
+				log.Printf("unable to mirror tag %q from %s: %s", tag, remoteURL, err)
+			}
+
+			if err != nil || !changed {
+				m.setTagStatus(tag, remoteURL, desc, err)
+				continue
+			}
+
+			updates = append(updates, tagUpdate{
+				tag:       tag,
+				remoteURL: remoteURL,
+				current:   current,
+				desc:      desc,
+			})
+		}
+	}
+
+	return updates, remoteTags, allListed
+}
+
+// fetchTag fetches the given descriptor if the local tag does not already
+// refer to it. It returns the current descriptor of the local tag, or nil if
+// there is no such tag, and whether the tag must be changed.
+func (m *mirror) fetchTag(remote stemma.RemoteObjectStore, tag string, desc stemma.Descriptor) (current stemma.Descriptor, changed bool, err error) {
+	current, err = m.repo.TagStore().Get(tag)
+	if err != nil {
+		if err != stemma.ErrNoSuchTag {
+			return nil, false, fmt.Errorf("unable to get local tag: %s", err)
+		}
+
+		current = nil
+	}
+
+	if current != nil && current.Digest().Equals(desc.Digest()) {
+		return current, false, nil
+	}
+
+	if !m.repo.Contains(desc.Digest()) {
+		if err := remote.Fetch(desc, &stemma.ProgressMeter{}); err != nil {
+			return nil, false, fmt.Errorf("unable to fetch from remote: %s", err)
+		}
+	}
+
+	return current, true, nil
+}
+
+// setTag updates the local tag. It is only updated if it has not been changed
+// by someone else since it was read. It must be called with the repository
+// exclusively locked.
+func (m *mirror) setTag(update tagUpdate) error {
+	// The objects may have been removed before the lock was acquired.
+	if !m.repo.Contains(update.desc.Digest()) {
+		return fmt.Errorf("object %s was removed before the tag was set", update.desc.Digest())
+	}
+
+	if err := m.repo.TagStore().CompareAndSet(update.tag, update.current, update.desc); err != nil {
+		return fmt.Errorf("unable to set local tag: %s", err)
+	}
+
+	log.Printf("%s -> %s", update.tag, update.desc.Digest())
+
+	m.mu.Lock()
+	m.status.Mirrored[update.tag] = update.desc.Digest().String()
+	m.mu.Unlock()
+
+	return nil
+}
+
+// pruneTags removes local tags which were set by the mirror and which are
+// not in the given set of remote tags. Tags which have been changed since the
+// mirror set them are left alone. It must be called with the repository
+// exclusively locked.
+func (m *mirror) pruneTags(remoteTags map[string]string) {
+	m.mu.Lock()
+	mirrored := make(map[string]string, len(m.status.Mirrored))
+	for tag, digest := range m.status.Mirrored {
+		mirrored[tag] = digest
+	}
+	m.mu.Unlock()
+
+	for tag, digest := range mirrored {
+		if _, ok := remoteTags[tag]; ok || !m.shouldMirror(tag) {
+			continue
+		}
+
+		current, err := m.repo.TagStore().Get(tag)
+		if err != nil && err != stemma.ErrNoSuchTag {
+			log.Printf("unable to get local tag %q: %s", tag, err)
+			continue
+		}
+
+		if err == nil && current.Digest().String() == digest {
+			if err := m.repo.TagStore().Remove(tag); err != nil {
+				log.Printf("unable to prune tag %q: %s", tag, err)
+				continue
+			}
+
+			log.Printf("pruned %s", tag)
+		}
+
+		m.mu.Lock()
+		delete(m.status.Tags, tag)
+		delete(m.status.Mirrored, tag)
+		m.mu.Unlock()
+	}
+}
+
+func (m *mirror) setRemoteStatus(remoteURL string, err error) {
+	status := remoteStatus{LastSync: time.Now()}
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	m.mu.Lock()
+	m.status.Remotes[remoteURL] = status
+	m.mu.Unlock()
+}
+
+func (m *mirror) setTagStatus(tag, remoteURL string, desc stemma.Descriptor, err error) {
+	status := tagStatus{
+		Remote:   remoteURL,
+		Digest:   desc.Digest().String(),
+		LastSync: time.Now(),
+	}
+
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	m.mu.Lock()
+	m.status.Tags[tag] = status
+	m.mu.Unlock()
+}
+
+// readStatus loads the status file, if there is one. A missing status file
+// results in an empty status.
+func (m *mirror) readStatus() error {
+	m.status = newMirrorStatus()
+
+	if m.statusPath == "" {
+		return nil
+	}
+
+	statusJSON, err := ioutil.ReadFile(m.statusPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if err := json.Unmarshal(statusJSON, &m.status); err != nil {
+		return fmt.Errorf("unable to decode status: %s", err)
+	}
+
+	// Status files written by older versions have no mirrored tags.
+	if m.status.Mirrored == nil {
+		m.status.Mirrored = map[string]string{}
+	}
+
+	return nil
+}
+
+// writeStatus atomically replaces the status file, if there is one, with the
+// current status.
+func (m *mirror) writeStatus() error {
+	if m.statusPath == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	statusJSON, err := json.MarshalIndent(m.status, "", "  ")
+	m.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("unable to encode status: %s", err)
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(m.statusPath), ".stemma-mirror-status-")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file: %s", err)
+	}
+
+	_, err = tempFile.Write(append(statusJSON, '\n'))
+	if cerr := tempFile.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tempFile.Name(), m.statusPath)
+	}
+
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+
+	return nil
+}
+
+func (m *mirror) handleStatus(rw http.ResponseWriter, req *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rw.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(rw).Encode(m.status); err != nil {
+		log.Printf("unable to encode status: %s", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jlhawn/stemma"
+)
+
+// newTestRepository returns a repository in a new temporary directory.
+func newTestRepository(t *testing.T) (*stemma.Repository, func()) {
+	root, err := ioutil.TempDir("", "stemma-mirror-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := stemma.InitRepository(root, stemma.DefaultConfig)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+
+	return repo, func() { os.RemoveAll(root) }
+}
+
+// newTestServer serves the given repository as stemma-httpserver does.
+func newTestServer(repo *stemma.Repository) *httptest.Server {
+	r := mux.NewRouter()
+	r.Queries("service", "get-tag").HandlerFunc(repo.HandleGetTag)
+	r.Queries("service", "list-tags").HandlerFunc(repo.HandleListTags)
+	r.Queries("service", "serve-objects").HandlerFunc(repo.HandleServeObjects)
+	r.Queries("service", "receive-objects").HandlerFunc(repo.HandleReceiveObjects)
+
+	return httptest.NewServer(r)
+}
+
+// setTestTag stores a file with the given contents in the given repository
+// and sets the given tag to it.
+func setTestTag(t *testing.T, repo *stemma.Repository, tag, contents string) stemma.Descriptor {
+	fileWriter, err := repo.NewFileWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fileWriter.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	}
+
+	desc, err := fileWriter.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.TagStore().Set(tag, desc); err != nil {
+		t.Fatal(err)
+	}
+
+	return desc
+}
+
+// checkTags fails the test if the tags of the given repository are not the
+// expected tags.
+func checkTags(t *testing.T, name string, repo *stemma.Repository, expected ...string) {
+	tags, err := repo.TagStore().List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(tags)
+	sort.Strings(expected)
+
+	if len(tags) != len(expected) {
+		t.Fatalf("%s: got tags %v, expected %v", name, tags, expected)
+	}
+
+	for i := range tags {
+		if tags[i] != expected[i] {
+			t.Fatalf("%s: got tags %v, expected %v", name, tags, expected)
+		}
+	}
+}
+
+func TestMirrorSync(t *testing.T) {
+	upstream, cleanupUpstream := newTestRepository(t)
+	defer cleanupUpstream()
+
+	local, cleanupLocal := newTestRepository(t)
+	defer cleanupLocal()
+
+	srv := newTestServer(upstream)
+	defer srv.Close()
+
+	statusDir, err := ioutil.TempDir("", "stemma-mirror-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(statusDir)
+
+	newMirror := func() *mirror {
+		m := &mirror{
+			repo:       local,
+			remotes:    []string{srv.URL},
+			includes:   patternList{"app*"},
+			excludes:   patternList{"app2"},
+			prune:      true,
+			statusPath: filepath.Join(statusDir, "status.json"),
+		}
+
+		if err := m.readStatus(); err != nil {
+			t.Fatal(err)
+		}
+
+		return m
+	}
+
+	app := setTestTag(t, upstream, "app", "app")
+	setTestTag(t, upstream, "app2", "app2")
+	setTestTag(t, upstream, "other", "other")
+
+	// Local tags which match the patterns but were not set by the mirror
+	// are never pruned.
+	setTestTag(t, local, "app3", "app3")
+
+	m := newMirror()
+	m.sync()
+
+	checkTags(t, "sync", local, "app", "app3")
+
+	desc, err := local.TagStore().Get("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !desc.Digest().Equals(app.Digest()) {
+		t.Errorf("local tag is %s, expected %s", desc.Digest(), app.Digest())
+	}
+
+	if !local.Contains(app.Digest()) {
+		t.Error("mirrored object is missing")
+	}
+
+	if err := upstream.TagStore().Remove("app"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tags set by the mirror are read from the status file after a
+	// restart.
+	m = newMirror()
+	m.sync()
+
+	checkTags(t, "prune", local, "app3")
+
+	// A mirrored tag which has been changed locally is not pruned.
+	setTestTag(t, upstream, "app", "app")
+	m.sync()
+
+	checkTags(t, "resync", local, "app", "app3")
+
+	setTestTag(t, local, "app", "changed")
+	if err := upstream.TagStore().Remove("app"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.sync()
+
+	checkTags(t, "changed locally", local, "app", "app3")
+
+	if _, ok := m.status.Mirrored["app"]; ok {
+		t.Error("tag changed locally is still recorded as mirrored")
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/jlhawn/stemma"
+	"golang.org/x/net/context"
+)
+
+// Inode numbers of the directories which are not backed by objects when
+// every application is mounted.
+const (
+	appsRootInode uint64 = iota
+	byTagInode
+	byDigestInode
+)
+
+// tagValidity is how long the kernel may cache the entries and attributes
+// of tag links. Unlike objects, tags may change at any time.
+const tagValidity = time.Second
+
+// mountAll makes a directory of every application in the given tag store's
+// repository the root of this filesystem. Applications are listed by tag in
+// by-tag/, as links into by-digest/ where the rootfs of any application may
+// be looked up by digest. An application's rootfs is only instantiated when
+// it is looked up and all applications share this filesystem's node, header
+// and directory caches.
+func (fs *FS) mountAll(tags stemma.TagStore) {
+	// The number of applications in by-digest/ varies so its link count
+	// is reported as 1, which tools such as find take to mean unknown.
+	byDigest := &digestsDir{
+		attr:     fs.syntheticDirAttr(byDigestInode, 1),
+		tags:     tags,
+		known:    map[string]stemma.Digest{},
+		appUsage: map[string]appUsage{},
+	}
+
+	fs.root = &appsDir{
+		attr: fs.syntheticDirAttr(appsRootInode, 4),
+		byTag: &tagsDir{
+			attr:   fs.syntheticDirAttr(byTagInode, 1),
+			tags:   tags,
+			parent: appsRootInode,
+		},
+		byDigest: byDigest,
+	}
+
+	fs.usage = byDigest.usage
+}
+
+func (fs *FS) syntheticDirAttr(inode uint64, nlink uint32) *attr {
+	return &attr{
+		fs:    fs,
+		inode: inode,
+		nlink: nlink,
+		time:  fs.time,
+		mode:  os.ModeDir | 0555,
+	}
+}
+
+// appsDir is the root directory when every application is mounted.
+type appsDir struct {
+	*attr
+	byTag    *tagsDir
+	byDigest *digestsDir
+}
+
+// ReadDirAll returns a list of entries from this directory.
+func (d *appsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return []fuse.Dirent{
+		{Inode: d.inode, Type: fuse.DT_Dir, Name: "."},
+		{Inode: d.inode, Type: fuse.DT_Dir, Name: ".."},
+		{Inode: byTagInode, Type: fuse.DT_Dir, Name: "by-tag"},
+		{Inode: byDigestInode, Type: fuse.DT_Dir, Name: "by-digest"},
+	}, nil
+}
+
+// Lookup looks up a specific entry in this directory.
+func (d *appsDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	resp.EntryValid = cacheValidity
+
+	switch req.Name {
+	case "by-tag":
+		return d.byTag, nil
+	case "by-digest":
+		return d.byDigest, nil
+	default:
+		return nil, fuse.ENOENT
+	}
+}
+
+// tagsDir is a directory of links to the applications in by-digest/ for
+// every tag in a namespace which refers to an application. Namespaces within
+// the namespace are subdirectories.
+type tagsDir struct {
+	*attr
+	tags   stemma.TagStore
+	parent uint64
+
+	// The namespace of this directory, ending in '/', or empty for
+	// by-tag/ itself.
+	prefix string
+}
+
+// ReadDirAll returns a list of entries from this directory.
+func (d *tagsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	tags, err := d.tags.List(d.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(tags)
+
+	fuseEntries := make([]fuse.Dirent, 0, len(tags)+2)
+	fuseEntries = append(fuseEntries,
+		fuse.Dirent{Inode: d.inode, Type: fuse.DT_Dir, Name: "."},
+		fuse.Dirent{Inode: d.parent, Type: fuse.DT_Dir, Name: ".."},
+	)
+
+	namespaces := map[string]bool{}
+
+	for _, tag := range tags {
+		name := strings.TrimPrefix(tag, d.prefix)
+
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[:i]
+			if namespaces[name] {
+				continue
+			}
+
+			namespaces[name] = true
+
+			fuseEntries = append(fuseEntries, fuse.Dirent{
+				Inode: d.fs.inodes.tagNamespaceInode(d.prefix + name),
+				Type:  fuse.DT_Dir,
+				Name:  name,
+			})
+
+			continue
+		}
+
+		fuseEntries = append(fuseEntries, fuse.Dirent{
+			Inode: d.fs.inodes.tagInode(tag),
+			Type:  fuse.DT_Link,
+			Name:  name,
+		})
+	}
+
+	return fuseEntries, nil
+}
+
+// Lookup looks up a specific entry in this directory.
+func (d *tagsDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	resp.EntryValid = tagValidity
+
+	tag := d.prefix + req.Name
+
+	desc, err := d.tags.Get(tag)
+	if err == stemma.ErrNoSuchTag {
+		return d.lookupNamespace(tag)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if desc.Type() != stemma.ObjectTypeApplication {
+		return nil, fuse.ENOENT
+	}
+
+	// Links are relative to this directory, which is one level below
+	// by-tag/ for each namespace.
+	target := strings.Repeat("../", strings.Count(tag, "/")+1) + "by-digest/" + desc.Digest().Hex()
+
+	return &tagLink{
+		attr: &attr{
+			fs:    d.fs,
+			inode: d.fs.inodes.tagInode(tag),
+			size:  uint64(len(target)),
+			nlink: 1,
+			time:  d.fs.time,
+			mode:  os.ModeSymlink | 0777,
+		},
+		target: target,
+	}, nil
+}
+
+// lookupNamespace returns the directory for the given namespace if it has
+// any tags.
+func (d *tagsDir) lookupNamespace(namespace string) (fs.Node, error) {
+	tags, err := d.tags.List(namespace + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tags) == 0 {
+		return nil, fuse.ENOENT
+	}
+
+	// The number of namespaces within a namespace varies so its link
+	// count is reported as unknown, as for by-digest/.
+	return &tagsDir{
+		attr:   d.fs.syntheticDirAttr(d.fs.inodes.tagNamespaceInode(namespace), 1),
+		tags:   d.tags,
+		parent: d.inode,
+		prefix: namespace + "/",
+	}, nil
+}
+
+// tagLink is a link to the application which a tag refers to.
+type tagLink struct {
+	*attr
+	target string
+}
+
+// Attr fills attr with the standard metadata for the link. The attributes
+// are only valid briefly as the tag may change.
+func (l *tagLink) Attr(ctx context.Context, attr *fuse.Attr) error {
+	if err := l.attr.Attr(ctx, attr); err != nil {
+		return err
+	}
+
+	attr.Valid = tagValidity
+
+	return nil
+}
+
+// Readlink reads a symbolic link.
+func (l *tagLink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	return l.target, nil
+}
+
+// digestsDir is a directory in which the rootfs of any application in the
+// repository may be looked up by the hex digest of the application.
+type digestsDir struct {
+	*attr
+	tags stemma.TagStore
+
+	// Applications which have been looked up, keyed by hex digest.
+	known map[string]stemma.Digest
+
+	// The usage of the listed applications as last computed. Computing it
+	// reads every tag so it is reused for as long as tags are valid.
+	usageObjects, usageSize uint64
+	usageTime               time.Time
+
+	// The usage of each application which has been computed, keyed by hex
+	// digest. An application's usage never changes.
+	appUsage map[string]appUsage
+	sync.Mutex
+}
+
+// appUsage is the total number and size of the objects in an application.
+type appUsage struct {
+	numObjects, size uint64
+}
+
+// digests returns the digests of the applications which are tagged or which
+// have already been looked up, keyed by hex digest.
+func (d *digestsDir) digests() (map[string]stemma.Digest, error) {
+	digests := map[string]stemma.Digest{}
+
+	tags, err := d.tags.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tag := range tags {
+		desc, err := d.tags.Get(tag)
+		if err != nil || desc.Type() != stemma.ObjectTypeApplication {
+			continue
+		}
+
+		digests[desc.Digest().Hex()] = desc.Digest()
+	}
+
+	d.Lock()
+	for hex, digest := range d.known {
+		digests[hex] = digest
+	}
+	d.Unlock()
+
+	return digests, nil
+}
+
+// usage returns the total number and size of the objects in the listed
+// applications. Objects shared by applications are counted once for each.
+// The result may be out of date by as long as tags are valid.
+func (d *digestsDir) usage() (numObjects, size uint64, err error) {
+	d.Lock()
+	if !d.usageTime.IsZero() && time.Since(d.usageTime) < tagValidity {
+		numObjects, size = d.usageObjects, d.usageSize
+		d.Unlock()
+		return numObjects, size, nil
+	}
+	d.Unlock()
+
+	digests, err := d.digests()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for hex, digest := range digests {
+		d.Lock()
+		app, ok := d.appUsage[hex]
+		d.Unlock()
+
+		if !ok {
+			entry, err := d.fs.appRootEntry(digest)
+			if err != nil {
+				// The application is not in the repository.
+				continue
+			}
+
+			app.numObjects, app.size = appRootUsage(entry)
+
+			d.Lock()
+			d.appUsage[hex] = app
+			d.Unlock()
+		}
+
+		numObjects += app.numObjects
+		size += app.size
+	}
+
+	d.Lock()
+	d.usageObjects, d.usageSize, d.usageTime = numObjects, size, time.Now()
+	d.Unlock()
+
+	return numObjects, size, nil
+}
+
+// ReadDirAll returns a list of entries from this directory. Only
+// applications which are tagged or which have already been looked up are
+// listed, but any application may be looked up.
+func (d *digestsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	digests, err := d.digests()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(digests))
+	for hex := range digests {
+		names = append(names, hex)
+	}
+
+	sort.Strings(names)
+
+	fuseEntries := make([]fuse.Dirent, 0, len(names)+2)
+	fuseEntries = append(fuseEntries,
+		fuse.Dirent{Inode: d.inode, Type: fuse.DT_Dir, Name: "."},
+		fuse.Dirent{Inode: appsRootInode, Type: fuse.DT_Dir, Name: ".."},
+	)
+
+	for _, name := range names {
+		entry, err := d.fs.appRootEntry(digests[name])
+		if err != nil {
+			// The application is not in the repository.
+			continue
+		}
+
+		fuseEntries = append(fuseEntries, fuse.Dirent{
+			Inode: d.fs.inodes.entryInode(entry, d.inode),
+			Type:  fuse.DT_Dir,
+			Name:  name,
+		})
+	}
+
+	return fuseEntries, nil
+}
+
+// Lookup looks up the rootfs of the application with the given hex digest.
+func (d *digestsDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	resp.EntryValid = cacheValidity
+
+	digest, err := stemma.ParseDigest(req.Name)
+	if err != nil || !d.fs.objects.Contains(digest) {
+		return nil, fuse.ENOENT
+	}
+
+	entry, err := d.fs.appRootEntry(digest)
+	if err != nil {
+		// Not an application.
+		return nil, fuse.ENOENT
+	}
+
+	node, err := d.fs.makeNode(entry, d.inode)
+	if err != nil {
+		return nil, err
+	}
+
+	d.Lock()
+	d.known[digest.Hex()] = digest
+	d.Unlock()
+
+	return node, nil
+}
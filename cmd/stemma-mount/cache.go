@@ -0,0 +1,108 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// lruCache is a least-recently-used cache of decoded objects keyed by
+// digest. The total size of the cached objects is limited, where the size of
+// an object is its encoded size as recorded in its descriptor.
+type lruCache struct {
+	maxSize uint64
+	size    uint64
+
+	order *list.List // Most recently used at the front.
+	items map[string]*list.Element
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+
+	sync.Mutex
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+	size  uint64
+}
+
+func newLRUCache(maxSize uint64) *lruCache {
+	return &lruCache{
+		maxSize: maxSize,
+		order:   list.New(),
+		items:   make(map[string]*list.Element, 1024),
+	}
+}
+
+// Get returns the cached value for the given key, if any, and marks it as
+// most recently used.
+func (c *lruCache) Get(key string) (value interface{}, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	c.hits++
+	c.order.MoveToFront(elem)
+
+	return elem.Value.(*lruEntry).value, true
+}
+
+// Add caches the given value, evicting least recently used values until the
+// cache is within its size limit. Values larger than the limit are not
+// cached.
+func (c *lruCache) Add(key string, value interface{}, size uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if size > c.maxSize {
+		return
+	}
+
+	if elem, ok := c.items[key]; ok {
+		// Added concurrently by another caller after a miss.
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	for c.size+size > c.maxSize {
+		c.removeOldest()
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry{
+		key:   key,
+		value: value,
+		size:  size,
+	})
+	c.size += size
+}
+
+func (c *lruCache) removeOldest() {
+	elem := c.order.Back()
+	if elem == nil {
+		return
+	}
+
+	entry := c.order.Remove(elem).(*lruEntry)
+	delete(c.items, entry.key)
+	c.size -= entry.size
+	c.evictions++
+}
+
+// String returns a summary of the cache usage and statistics.
+func (c *lruCache) String() string {
+	c.Lock()
+	defer c.Unlock()
+
+	return fmt.Sprintf(
+		"entries=%d size=%d/%d hits=%d misses=%d evictions=%d",
+		len(c.items), c.size, c.maxSize, c.hits, c.misses, c.evictions,
+	)
+}
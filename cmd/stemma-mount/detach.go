@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// readyFDEnv is set in the environment of a detached mount process to the
+// number of the file descriptor on which it should notify its parent once
+// the filesystem is mounted.
+const readyFDEnv = "STEMMA_MOUNT_READY_FD"
+
+// detachMount runs this command again as a background process in a new
+// session with its output going to the given log file. It returns once the
+// background process has mounted the filesystem, or exits if it fails to.
+func detachMount(logPath string) {
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, os.FileMode(0644))
+	if err != nil {
+		log.Fatalf("unable to open log file: %s", err)
+	}
+	defer logFile.Close()
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		log.Fatalf("unable to create pipe: %s", err)
+	}
+	defer readyReader.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatalf("unable to determine path of executable: %s", err)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// The first extra file is file descriptor 3 in the child.
+	cmd.ExtraFiles = []*os.File{readyWriter}
+	cmd.Env = append(os.Environ(), readyFDEnv+"=3")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("unable to start background process: %s", err)
+	}
+
+	// Close our copy of the write end so that reading gets EOF if the
+	// child exits without notifying us.
+	readyWriter.Close()
+
+	if _, err := io.ReadFull(readyReader, make([]byte, 1)); err != nil {
+		cmd.Wait()
+		log.Fatalf("background process failed to mount filesystem, see %s", logPath)
+	}
+
+	fmt.Println(cmd.Process.Pid)
+}
+
+// notifyReady notifies the parent of a detached mount process that the
+// filesystem has been mounted. It does nothing if this process was not
+// detached.
+func notifyReady() {
+	if os.Getenv(readyFDEnv) == "" {
+		return
+	}
+
+	ready := os.NewFile(3, "ready")
+	ready.Write([]byte{1})
+	ready.Close()
+
+	os.Unsetenv(readyFDEnv)
+}
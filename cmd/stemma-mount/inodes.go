@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/jlhawn/stemma"
+)
+
+// inodeMode determines which directory entries share inode numbers.
+type inodeMode string
+
+const (
+	// Entries for files with the same header, content and link target
+	// share an inode number wherever they appear, as if hard linked.
+	// This lets the kernel share a single page cache for duplicate files.
+	inodeModeContent inodeMode = "content"
+	// Every entry has its own inode number, determined by its path.
+	inodeModePath inodeMode = "path"
+)
+
+func (m *inodeMode) String() string {
+	return string(*m)
+}
+
+// Set parses the inode mode from a command line flag value.
+func (m *inodeMode) Set(value string) error {
+	switch mode := inodeMode(value); mode {
+	case inodeModeContent, inodeModePath:
+		*m = mode
+		return nil
+	default:
+		return fmt.Errorf("unknown inode mode %q: must be %q or %q", value, inodeModeContent, inodeModePath)
+	}
+}
+
+// reservedInodes is the number of inode numbers, starting from zero, which
+// are never allocated. They are used for the root and for the synthetic
+// directories when every application is mounted.
+const reservedInodes = 3
+
+// Kinds of inode keys, so that keys of different kinds never match.
+const (
+	inodeKeyEntry byte = iota
+	inodeKeyTag
+	inodeKeyTagNamespace
+)
+
+// inodeAllocator allocates a stable inode number for each distinct key for
+// the life of the mount. The candidate inode numbers for a key are derived
+// from its digest alone: the first is taken from the digest itself and each
+// following one from the digest rehashed with a counter. A key is allocated
+// its first candidate which is not reserved or already allocated to a
+// different key, so two keys never share an inode number even if their
+// truncated digests collide.
+type inodeAllocator struct {
+	mode inodeMode
+
+	inodes map[string]uint64 // Inode numbers by key digest.
+	keys   map[uint64]string // Key digests by inode number.
+
+	collisions uint64
+
+	sync.Mutex
+}
+
+func newInodeAllocator(mode inodeMode) *inodeAllocator {
+	return &inodeAllocator{
+		mode:   mode,
+		inodes: make(map[string]uint64, 1024),
+		keys:   make(map[uint64]string, 1024),
+	}
+}
+
+// entryInode returns the inode number for the given directory entry in the
+// directory with the given parent inode number.
+//
+// The inode number identifies unique (header, object, link target) triples
+// so the object digest alone is not enough. Directories always have a
+// unique inode number per path as hard links to directories are not allowed
+// (what would ".." mean?). Other entries are unique per path only when
+// allocating inode numbers by path.
+func (a *inodeAllocator) entryInode(de stemma.DirectoryEntry, parent uint64) uint64 {
+	hash := sha512.New()
+	hash.Write([]byte{inodeKeyEntry})
+
+	if de.Type == stemma.DirentTypeDirectory || a.mode == inodeModePath {
+		binary.Write(hash, binary.LittleEndian, parent)
+		writeKeyField(hash, []byte(de.Name))
+	}
+
+	writeKeyField(hash, []byte(de.HeaderDigest))
+	writeKeyField(hash, []byte(de.ObjectDigest))
+	writeKeyField(hash, []byte(de.LinkTarget))
+
+	return a.allocate(hash.Sum(nil))
+}
+
+// tagInode returns the inode number for the link for the given tag.
+func (a *inodeAllocator) tagInode(tag string) uint64 {
+	hash := sha512.New()
+	hash.Write([]byte{inodeKeyTag})
+	hash.Write([]byte(tag))
+
+	return a.allocate(hash.Sum(nil))
+}
+
+// tagNamespaceInode returns the inode number for the directory of the given
+// tag namespace.
+func (a *inodeAllocator) tagNamespaceInode(namespace string) uint64 {
+	hash := sha512.New()
+	hash.Write([]byte{inodeKeyTagNamespace})
+	hash.Write([]byte(namespace))
+
+	return a.allocate(hash.Sum(nil))
+}
+
+// allocate returns the inode number for the key with the given digest,
+// allocating one if needed.
+func (a *inodeAllocator) allocate(keyDigest []byte) uint64 {
+	key := string(keyDigest)
+
+	a.Lock()
+	defer a.Unlock()
+
+	if inode, ok := a.inodes[key]; ok {
+		return inode
+	}
+
+	var inode uint64
+	for attempt := uint64(0); ; attempt++ {
+		inode = inodeCandidate(keyDigest, attempt)
+		if inode < reservedInodes {
+			continue
+		}
+
+		if _, taken := a.keys[inode]; !taken {
+			break
+		}
+
+		a.collisions++
+	}
+
+	a.inodes[key] = inode
+	a.keys[inode] = key
+
+	return inode
+}
+
+// inodeCandidate returns the candidate inode number for the key with the
+// given digest on the given allocation attempt.
+func inodeCandidate(keyDigest []byte, attempt uint64) uint64 {
+	if attempt == 0 {
+		return binary.LittleEndian.Uint64(keyDigest)
+	}
+
+	hash := sha512.New()
+	hash.Write(keyDigest)
+	binary.Write(hash, binary.LittleEndian, attempt)
+
+	return binary.LittleEndian.Uint64(hash.Sum(nil))
+}
+
+// String returns a summary of the allocated inode numbers.
+func (a *inodeAllocator) String() string {
+	a.Lock()
+	defer a.Unlock()
+
+	return fmt.Sprintf("mode=%s allocated=%d collisions=%d", a.mode, len(a.inodes), a.collisions)
+}
+
+// writeKeyField writes the length of the given bytes followed by the bytes
+// so that adjacent fields of a key cannot run into each other.
+func writeKeyField(w io.Writer, b []byte) {
+	binary.Write(w, binary.LittleEndian, uint32(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jlhawn/stemma"
+)
+
+func TestEntryInodes(t *testing.T) {
+	header := stemma.Digest("header")
+	object := stemma.Digest("object")
+	otherObject := stemma.Digest("other object")
+
+	file := func(name string, object stemma.Digest) stemma.DirectoryEntry {
+		return stemma.DirectoryEntry{
+			Name:         name,
+			Type:         stemma.DirentTypeRegular,
+			HeaderDigest: header,
+			ObjectDigest: object,
+		}
+	}
+
+	dir := func(name string) stemma.DirectoryEntry {
+		return stemma.DirectoryEntry{
+			Name:         name,
+			Type:         stemma.DirentTypeDirectory,
+			HeaderDigest: header,
+			ObjectDigest: object,
+		}
+	}
+
+	link := func(name, target string) stemma.DirectoryEntry {
+		return stemma.DirectoryEntry{
+			Name:         name,
+			Type:         stemma.DirentTypeLink,
+			HeaderDigest: header,
+			LinkTarget:   target,
+		}
+	}
+
+	type placedEntry struct {
+		entry  stemma.DirectoryEntry
+		parent uint64
+	}
+
+	for _, test := range []struct {
+		name string
+		a, b placedEntry
+		// Whether the entries share an inode number in each mode.
+		sameContent, samePath bool
+	}{
+		{
+			name:        "same file in different directories",
+			a:           placedEntry{file("a", object), 10},
+			b:           placedEntry{file("a", object), 11},
+			sameContent: true,
+		},
+		{
+			name:        "same file with different names",
+			a:           placedEntry{file("a", object), 10},
+			b:           placedEntry{file("b", object), 10},
+			sameContent: true,
+		},
+		{
+			name:        "same entry",
+			a:           placedEntry{file("a", object), 10},
+			b:           placedEntry{file("a", object), 10},
+			sameContent: true,
+			samePath:    true,
+		},
+		{
+			name: "different file contents",
+			a:    placedEntry{file("a", object), 10},
+			b:    placedEntry{file("b", otherObject), 10},
+		},
+		{
+			name: "same directory in different directories",
+			a:    placedEntry{dir("a"), 10},
+			b:    placedEntry{dir("a"), 11},
+		},
+		{
+			name:        "same directory entry",
+			a:           placedEntry{dir("a"), 10},
+			b:           placedEntry{dir("a"), 10},
+			sameContent: true,
+			samePath:    true,
+		},
+		{
+			name:        "same link in different directories",
+			a:           placedEntry{link("a", "target"), 10},
+			b:           placedEntry{link("a", "target"), 11},
+			sameContent: true,
+		},
+		{
+			name: "different link targets",
+			a:    placedEntry{link("a", "target"), 10},
+			b:    placedEntry{link("a", "other target"), 10},
+		},
+	} {
+		for _, mode := range []inodeMode{inodeModeContent, inodeModePath} {
+			a := newInodeAllocator(mode)
+
+			inodeA := a.entryInode(test.a.entry, test.a.parent)
+			inodeB := a.entryInode(test.b.entry, test.b.parent)
+
+			expectSame := test.sameContent
+			if mode == inodeModePath {
+				expectSame = test.samePath
+			}
+
+			if (inodeA == inodeB) != expectSame {
+				t.Errorf("%s, mode %s: got inodes %d and %d, expected same=%t", test.name, mode, inodeA, inodeB, expectSame)
+			}
+
+			if inodeA < reservedInodes || inodeB < reservedInodes {
+				t.Errorf("%s, mode %s: allocated reserved inode", test.name, mode)
+			}
+
+			// Inode numbers are stable for the life of the mount.
+			if again := a.entryInode(test.a.entry, test.a.parent); again != inodeA {
+				t.Errorf("%s, mode %s: inode changed from %d to %d", test.name, mode, inodeA, again)
+			}
+		}
+	}
+}
+
+func TestTagInodes(t *testing.T) {
+	a := newInodeAllocator(inodeModeContent)
+
+	tag := a.tagInode("app")
+	if other := a.tagInode("app2"); other == tag {
+		t.Errorf("tags share inode %d", tag)
+	}
+
+	// A tag and a namespace of the same name are different keys.
+	if namespace := a.tagNamespaceInode("app"); namespace == tag {
+		t.Errorf("tag and namespace share inode %d", tag)
+	}
+
+	if again := a.tagInode("app"); again != tag {
+		t.Errorf("tag inode changed from %d to %d", tag, again)
+	}
+}
+
+// collidingKeys returns key digests which all have the given preferred inode
+// number.
+func collidingKeys(inode uint64, n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		key := make([]byte, 64)
+		for j := 0; j < 8; j++ {
+			key[j] = byte(inode >> (8 * uint(j)))
+		}
+		key[8] = byte(i + 1)
+
+		keys[i] = key
+	}
+
+	return keys
+}
+
+func TestInodeCollisions(t *testing.T) {
+	keys := collidingKeys(1000, 3)
+
+	for _, test := range []struct {
+		name  string
+		order []int
+		// The allocation attempt which succeeds for each key.
+		attempts []uint64
+	}{
+		{"in order", []int{0, 1, 2}, []uint64{0, 1, 1}},
+		{"reversed", []int{2, 1, 0}, []uint64{1, 1, 0}},
+		{"one key", []int{1}, []uint64{0, 0, 0}},
+	} {
+		a := newInodeAllocator(inodeModeContent)
+
+		for _, i := range test.order {
+			inode := a.allocate(keys[i])
+
+			// The inode number depends only on the key and on
+			// whether its preferred number was already taken, never
+			// on which numbers the other keys were allocated.
+			if expected := inodeCandidate(keys[i], test.attempts[i]); inode != expected {
+				t.Errorf("%s: key %d allocated inode %d, expected %d", test.name, i, inode, expected)
+			}
+		}
+
+		if a.collisions != uint64(len(test.order)-1) {
+			t.Errorf("%s: got %d collisions, expected %d", test.name, a.collisions, len(test.order)-1)
+		}
+	}
+
+	// Colliding keys are never allocated neighbouring inode numbers, as
+	// linear probing would.
+	a := newInodeAllocator(inodeModeContent)
+	a.allocate(keys[0])
+	if inode := a.allocate(keys[1]); inode == 1001 {
+		t.Errorf("colliding key allocated the next inode number")
+	}
+}
+
+func TestInodeCandidates(t *testing.T) {
+	key := collidingKeys(1000, 1)[0]
+
+	if inode := inodeCandidate(key, 0); inode != 1000 {
+		t.Errorf("first candidate is %d, expected 1000", inode)
+	}
+
+	// Candidates are a function of the key alone.
+	seen := map[uint64]bool{}
+	for attempt := uint64(0); attempt < 100; attempt++ {
+		inode := inodeCandidate(key, attempt)
+		if inode != inodeCandidate(append([]byte(nil), key...), attempt) {
+			t.Fatalf("candidate %d is not deterministic", attempt)
+		}
+
+		if seen[inode] {
+			t.Errorf("candidate %d repeats inode %d", attempt, inode)
+		}
+		seen[inode] = true
+	}
+
+	// A key whose preferred inode number is reserved is allocated its
+	// next candidate.
+	reserved := collidingKeys(1, 1)[0]
+	a := newInodeAllocator(inodeModeContent)
+
+	if inode, expected := a.allocate(reserved), inodeCandidate(reserved, 1); inode != expected {
+		t.Errorf("key with reserved inode allocated %d, expected %d", inode, expected)
+	}
+}
@@ -1,14 +1,16 @@
 package main
 
 import (
-	"crypto/sha512"
-	"encoding/binary"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"sync"
+	"syscall"
 	"time"
 
 	"bazil.org/fuse"
@@ -20,55 +22,210 @@ import (
 
 var errNotImplemented = errors.New("not implemented")
 
+// cacheValidity is how long the kernel may cache attributes and directory
+// entries. Objects are immutable so they never need to be revalidated.
+const cacheValidity = 365 * 24 * time.Hour
+
+// maxReadahead is the maximum number of bytes the kernel may read ahead of
+// sequential reads.
+const maxReadahead = 1 << 20
+
+// blockSize is the preferred I/O block size and the fundamental block size
+// of the filesystem as reported by Statfs.
+const blockSize = 4096
+
+// maxNameLen is the maximum length of an entry name as reported by Statfs.
+const maxNameLen = 255
+
 func main() {
 	fuse.Debug = func(msg interface{}) {
 		log.Print(msg)
 	}
 
+	repoPath := flag.String("repo", stemma.DefaultRepositoryPath(), "path to the repository (defaults to $STEMMA_REPO or the current directory)")
+	remoteURL := flag.String("remote", "", "URL of a remote from which to fetch objects as they are accessed")
+	prefetch := flag.Bool("prefetch", false, "fetch the rest of the application from the remote in the background")
+	detach := flag.Bool("detach", false, "run in the background once the filesystem is mounted")
+	logPath := flag.String("log", os.DevNull, "file to which a detached mount logs")
+	headerCacheSize := flag.Uint64("header-cache-size", 16<<20, "maximum total encoded size in bytes of cached header objects")
+	dirCacheSize := flag.Uint64("dir-cache-size", 64<<20, "maximum total encoded size in bytes of cached directory objects")
+	all := flag.Bool("all", false, "mount every application in the repository under by-tag/ and by-digest/")
+
+	inodes := inodeModeContent
+	flag.Var(&inodes, "inodes", "which entries share inode numbers: \"content\" for identical files, or \"path\" for none")
+
 	flag.Parse()
 
-	if flag.NArg() < 2 {
-		fmt.Println("Usage: stemma-mount DIGEST|TAG MOUNTPOINT")
+	numArgs := 2
+	if *all {
+		numArgs = 1
+	}
+
+	if flag.NArg() < numArgs {
+		fmt.Println("Usage: stemma-mount [-detach [-log FILE]] [-remote URL [-prefetch]] DIGEST|TAG MOUNTPOINT")
+		fmt.Println("       stemma-mount [-detach [-log FILE]] -all MOUNTPOINT")
 		os.Exit(1)
 	}
 
-	repo, err := stemma.NewRepository(".")
+	if *all && *remoteURL != "" {
+		log.Fatal("-all may not be used with -remote")
+	}
+
+	if *detach && os.Getenv(readyFDEnv) == "" {
+		detachMount(*logPath)
+		return
+	}
+
+	repo, err := stemma.NewRepository(*repoPath)
 	if err != nil {
 		log.Fatalf("unable to initialize repository: %s", err)
 	}
 
-	appDigest, err := repo.ResolveRef(flag.Arg(0))
+	var (
+		objects   stemma.ObjectStore = repo
+		appDigest stemma.Digest
+	)
+
+	switch {
+	case *all:
+		// Applications are resolved as they are looked up.
+	case *remoteURL == "":
+		appDigest, err = repo.ResolveRef(flag.Arg(0))
+		if err != nil {
+			log.Fatalf("unable to resolve reference: %s", err)
+		}
+	default:
+		lazyObjects, appDesc := newLazyObjectStore(repo, *remoteURL, flag.Arg(0))
+		defer lazyObjects.Close()
+
+		if *prefetch {
+			go func() {
+				if err := lazyObjects.Prefetch(appDesc, &stemma.ProgressMeter{}); err != nil {
+					log.Printf("unable to prefetch application: %s", err)
+					return
+				}
+
+				log.Printf("prefetched application %s", appDesc.Digest())
+			}()
+		}
+
+		objects, appDigest = lazyObjects, appDesc.Digest()
+	}
+
+	filesystem := newFS(objects, inodes, *headerCacheSize, *dirCacheSize)
+
+	if *all {
+		filesystem.mountAll(repo.TagStore())
+	} else if err := filesystem.mountApp(appDigest); err != nil {
+		log.Fatalf("unable to initialize filesystem root: %s", err)
+	}
+
+	mountpoint, err := filepath.Abs(flag.Arg(numArgs - 1))
 	if err != nil {
-		log.Fatalf("unable to resolve reference: %s", err)
+		log.Fatalf("unable to get absolute path of mountpoint: %s", err)
 	}
 
 	conn, err := fuse.Mount(
-		flag.Arg(1),
+		mountpoint,
 		fuse.AllowOther(), fuse.DefaultPermissions(),
 		fuse.FSName("stemma"), fuse.LocalVolume(),
 		fuse.Subtype("stemma"), fuse.VolumeName("stemma"),
 		fuse.AllowDev(), fuse.AllowSUID(),
+		fuse.MaxReadahead(maxReadahead),
 	)
 	if err != nil {
 		log.Fatalf("unable to mount filesytem: %s", err)
 	}
 	defer conn.Close()
-	defer fuse.Unmount(flag.Arg(1))
+	defer fuse.Unmount(mountpoint)
 
-	filesystem, err := newFS(repo, appDigest)
-	if err != nil {
-		log.Fatalf("unable to initialize filesystem root: %s", err)
-	}
-
-	if err := fs.Serve(conn, filesystem); err != nil {
-		log.Fatalf("unable to server filesystem: %s", err)
-	}
+	served := make(chan error, 1)
+	go func() {
+		served <- fs.Serve(conn, filesystem)
+	}()
 
 	// Check if the mount process has an error to report.
 	<-conn.Ready
 	if err := conn.MountError; err != nil {
 		log.Fatal(err)
 	}
+
+	// Record the mount so that other tools know that the application is
+	// in use. The digest is nil if every application is mounted.
+	mount := stemma.Mount{
+		Mountpoint: mountpoint,
+		PID:        os.Getpid(),
+		Digest:     appDigest,
+	}
+
+	if err := repo.MountSet().Add(mount); err != nil {
+		// Unmount before exiting as deferred calls are skipped.
+		fuse.Unmount(mountpoint)
+		conn.Close()
+		log.Fatalf("unable to record mount: %s", err)
+	}
+	defer repo.MountSet().Remove(mountpoint)
+
+	notifyReady()
+
+	// Unmount on interrupt. Serving continues until the unmount succeeds
+	// as it may fail if the filesystem is busy. Cache statistics are
+	// logged on SIGUSR1.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR1)
+
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGUSR1 {
+				log.Printf("header cache: %s", filesystem.headers)
+				log.Printf("directory cache: %s", filesystem.directories)
+				log.Printf("inodes: %s", filesystem.inodes)
+				continue
+			}
+
+			log.Printf("received %s, unmounting", sig)
+			if err := fuse.Unmount(mountpoint); err != nil {
+				log.Printf("unable to unmount filesystem: %s", err)
+			}
+		case err := <-served:
+			if err != nil {
+				log.Printf("unable to serve filesystem: %s", err)
+			}
+
+			return
+		}
+	}
+}
+
+// newLazyObjectStore returns an object store which fetches objects from the
+// remote with the given URL as they are accessed, along with the descriptor
+// of the application with the given reference. The reference is resolved as
+// a tag on the remote or, failing that, in the local repository.
+func newLazyObjectStore(repo *stemma.Repository, remoteURL, ref string) (*stemma.LazyObjectStore, stemma.Descriptor) {
+	remote, err := repo.RemoteObjectStore(remoteURL)
+	if err != nil {
+		log.Fatalf("unable to get remote object store: %s", err)
+	}
+
+	appDesc, err := remote.GetTag(ref)
+	if err == stemma.ErrNoSuchTag {
+		var appDigest stemma.Digest
+		if appDigest, err = repo.ResolveRef(ref); err == nil {
+			appDesc, err = repo.GetDescriptor(appDigest)
+		}
+	}
+
+	if err != nil {
+		log.Fatalf("unable to resolve reference: %s", err)
+	}
+
+	lazyObjects, err := repo.NewLazyObjectStore(remote, appDesc)
+	if err != nil {
+		log.Fatalf("unable to initialize lazy object store: %s", err)
+	}
+
+	return lazyObjects, appDesc
 }
 
 type nodeRef struct {
@@ -83,6 +240,18 @@ type FS struct {
 	root    fs.Node
 	time    time.Time
 
+	// Caches of decoded header and directory objects. Headers in
+	// particular are shared by many nodes.
+	headers     *lruCache
+	directories *lruCache
+
+	// Computes the total number and size of the objects which make up
+	// the mounted applications.
+	usage func() (numObjects, size uint64, err error)
+
+	// Allocates inode numbers for directory entries.
+	inodes *inodeAllocator
+
 	// A cache of valid nodes mapped by inode number. Nodes are reference
 	// counted. An inode number should always map to the same node due to
 	// content-addressability.
@@ -90,14 +259,29 @@ type FS struct {
 	sync.Mutex
 }
 
-func newFS(objects stemma.ObjectStore, appDigest stemma.Digest) (*FS, error) {
-	app, err := objects.GetApplication(appDigest)
+func newFS(objects stemma.ObjectStore, inodes inodeMode, headerCacheSize, dirCacheSize uint64) *FS {
+	return &FS{
+		objects:     objects,
+		inodes:      newInodeAllocator(inodes),
+		headers:     newLRUCache(headerCacheSize),
+		directories: newLRUCache(dirCacheSize),
+		nodeRefs:    make(map[uint64]nodeRef, 1024),
+		time:        time.Now(),
+	}
+}
+
+// appRootEntry returns a directory entry for the rootfs of the application
+// with the given digest.
+func (fs *FS) appRootEntry(appDigest stemma.Digest) (stemma.DirectoryEntry, error) {
+	app, err := fs.objects.GetApplication(appDigest)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get application from object store: %s", err)
+		return stemma.DirectoryEntry{}, fmt.Errorf("unable to get application from object store: %s", err)
 	}
 
-	entry := stemma.DirectoryEntry{
-		Name:           "/",
+	// The rootfs is named by the application digest so that applications
+	// with identical rootfs directories still have distinct inodes.
+	return stemma.DirectoryEntry{
+		Name:           appDigest.Hex(),
 		Type:           stemma.DirentTypeDirectory,
 		HeaderDigest:   app.Rootfs.Header.Digest,
 		HeaderSize:     app.Rootfs.Header.Size,
@@ -105,23 +289,41 @@ func newFS(objects stemma.ObjectStore, appDigest stemma.Digest) (*FS, error) {
 		ObjectSize:     app.Rootfs.Directory.Size,
 		NumSubObjects:  app.Rootfs.Directory.NumSubObjects,
 		SubObjectsSize: app.Rootfs.Directory.SubObjectsSize,
-	}
+	}, nil
+}
 
-	fs := &FS{
-		objects:  objects,
-		nodeRefs: make(map[uint64]nodeRef, 1024),
-		time:     time.Now(),
+// mountApp makes the rootfs of the application with the given digest the
+// root of this filesystem.
+func (fs *FS) mountApp(appDigest stemma.Digest) error {
+	entry, err := fs.appRootEntry(appDigest)
+	if err != nil {
+		return err
 	}
 
 	var rootInode uint64
 	if fs.root, err = fs.makeNode(entry, rootInode); err != nil {
-		return nil, fmt.Errorf("unable to make root node: %s", err)
+		return fmt.Errorf("unable to make root node: %s", err)
 	}
 
 	// Hack to make the root dir have the same inode and parent inode.
 	fs.root.(*Dir).inode = rootInode
 
-	return fs, nil
+	fs.usage = func() (numObjects, size uint64, err error) {
+		numObjects, size = appRootUsage(entry)
+		return numObjects, size, nil
+	}
+
+	return nil
+}
+
+// appRootUsage returns the total number and size of the objects in an
+// application's rootfs, including the root header and directory, given its
+// root directory entry.
+func appRootUsage(entry stemma.DirectoryEntry) (numObjects, size uint64) {
+	numObjects = 2 + uint64(entry.NumSubObjects)
+	size = entry.HeaderSize + entry.ObjectSize + entry.SubObjectsSize
+
+	return numObjects, size
 }
 
 // Root is called to obtain the Node for the file system root.
@@ -129,6 +331,26 @@ func (fs *FS) Root() (fs.Node, error) {
 	return fs.root, nil
 }
 
+// Statfs reports the total number of objects and blocks used by the mounted
+// applications. The filesystem is read-only so there is never any space or
+// files available.
+func (fs *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	numObjects, size, err := fs.usage()
+	if err != nil {
+		return err
+	}
+
+	*resp = fuse.StatfsResponse{
+		Blocks:  (size + blockSize - 1) / blockSize,
+		Files:   numObjects,
+		Bsize:   blockSize,
+		Namelen: maxNameLen,
+		Frsize:  blockSize,
+	}
+
+	return nil
+}
+
 func (fs *FS) refNode(inode uint64) fs.Node {
 	fs.Lock()
 	defer fs.Unlock()
@@ -164,22 +386,23 @@ func (fs *FS) derefNode(inode uint64) {
 }
 
 func (fs *FS) makeNode(entry stemma.DirectoryEntry, parent uint64) (node fs.Node, err error) {
-	inodeNum := inode(entry, parent)
+	inodeNum := fs.inodes.entryInode(entry, parent)
 
 	// Reuse a cached node if possible.
 	if node = fs.refNode(inodeNum); node != nil {
 		return node, nil
 	}
 
-	header, err := fs.objects.GetHeader(entry.HeaderDigest)
+	header, err := fs.getHeader(entry.HeaderDigest, entry.HeaderSize)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get header from object store: %s", err)
+		return nil, err
 	}
 
 	attrBase := &attr{
 		fs:          fs,
 		inode:       inodeNum,
 		size:        entry.ObjectSize,
+		nlink:       1,
 		time:        fs.time,
 		mode:        header.Mode,
 		uid:         header.UID,
@@ -230,12 +453,70 @@ func (fs *FS) makeNode(entry stemma.DirectoryEntry, parent uint64) (node fs.Node
 	return node, nil
 }
 
+// getHeader returns the decoded header object with the given digest and
+// encoded size, using the header cache.
+func (fs *FS) getHeader(digest stemma.Digest, size uint64) (stemma.Header, error) {
+	if header, ok := fs.headers.Get(digest.Hex()); ok {
+		return header.(stemma.Header), nil
+	}
+
+	header, err := fs.objects.GetHeader(digest)
+	if err != nil {
+		return header, fmt.Errorf("unable to get header from object store: %s", err)
+	}
+
+	fs.headers.Add(digest.Hex(), header, size)
+
+	return header, nil
+}
+
+// dirEntries holds the entries of a directory along with an index of the
+// entries by name.
+type dirEntries struct {
+	entries stemma.Directory
+	index   map[string]int
+
+	// The number of entries which are subdirectories.
+	numSubdirs uint32
+}
+
+// getDirectory returns the entries of the directory object with the given
+// digest and encoded size, using the directory cache.
+func (fs *FS) getDirectory(digest stemma.Digest, size uint64) (*dirEntries, error) {
+	if entries, ok := fs.directories.Get(digest.Hex()); ok {
+		return entries.(*dirEntries), nil
+	}
+
+	dir, err := fs.objects.GetDirectory(digest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get directory from object store: %s", err)
+	}
+
+	entries := &dirEntries{
+		entries: dir,
+		index:   make(map[string]int, len(dir)),
+	}
+
+	for i, de := range dir {
+		entries.index[de.Name] = i
+
+		if de.Type == stemma.DirentTypeDirectory {
+			entries.numSubdirs++
+		}
+	}
+
+	fs.directories.Add(digest.Hex(), entries, size)
+
+	return entries, nil
+}
+
 // attr contains common file attributes to meet the FUSE Attr() request.
 type attr struct {
 	fs *FS
 
 	inode uint64      // inode number
 	size  uint64      // size in bytes
+	nlink uint32      // number of hard links
 	time  time.Time   // time of last access, modification, change, creation
 	mode  os.FileMode // file mode
 	uid   uint32      // owner uid
@@ -249,10 +530,7 @@ type attr struct {
 // Attr fills attr with the standard metadata for the node.
 func (a *attr) Attr(ctx context.Context, attr *fuse.Attr) error {
 	*attr = fuse.Attr{
-		// Cache for only a minute. The filesystem is read-only so we
-		// could probably just cache forever. This needs to be looked
-		// into further.
-		Valid:     time.Minute,
+		Valid:     cacheValidity,
 		Inode:     a.inode,
 		Size:      a.size,
 		Atime:     a.time,
@@ -260,11 +538,12 @@ func (a *attr) Attr(ctx context.Context, attr *fuse.Attr) error {
 		Ctime:     a.time,
 		Crtime:    a.time,
 		Mode:      a.mode,
-		Nlink:     1,
+		Nlink:     a.nlink,
 		Uid:       a.uid,
 		Gid:       a.gid,
 		Rdev:      a.rdev,
-		BlockSize: 4096,
+		Blocks:    (a.size + 511) / 512, // Always 512-byte units.
+		BlockSize: blockSize,
 	}
 
 	return nil
@@ -309,29 +588,6 @@ func (a *attr) Forget() {
 	a.fs.derefNode(a.inode)
 }
 
-// inode computes a random/unique inode number for the given directory
-// entry. The indode number should identify unique (header, object) pairs
-// so we can't just use the object digest. We should also consider the
-// symlink target. DO NOT consider the name of the entry. If the entry is a
-// directory, the parent inode number will be hashed into the value as well.
-func inode(de stemma.DirectoryEntry, parent uint64) uint64 {
-	hash := sha512.New()
-
-	if de.Type == stemma.DirentTypeDirectory {
-		// Only hash the parent inode if this is a directory. This
-		// helps ensure that no 2 directories have the same inode as
-		// hard links to directories are not allowed (what would ".."
-		// mean?).
-		binary.Write(hash, binary.LittleEndian, parent)
-	}
-
-	hash.Write([]byte(de.HeaderDigest))
-	hash.Write([]byte(de.ObjectDigest))
-	hash.Write([]byte(de.LinkTarget))
-
-	return binary.LittleEndian.Uint64(hash.Sum(nil))
-}
-
 // fuseDirentTypes stores a mapping of stemma dirent types to fuse dirent
 // types. Note that if the dirent type is unknown, the default zero value
 // corresponds to the unknown fuse dirent type.
@@ -351,32 +607,58 @@ type Dir struct {
 	parent uint64
 	digest stemma.Digest
 
-	entries    stemma.Directory
-	entryIndex map[string]int
+	// The link count of this directory, or zero until its entries are
+	// first loaded.
+	linkCount uint32
+	sync.Mutex
 }
 
-func (d *Dir) load() error {
-	entries, err := d.fs.objects.GetDirectory(d.digest)
+// load returns the entries of this directory.
+func (d *Dir) load() (*dirEntries, error) {
+	entries, err := d.fs.getDirectory(d.digest, d.size)
 	if err != nil {
-		return fmt.Errorf("unable to get directory object store: %s", err)
+		return nil, err
+	}
+
+	d.Lock()
+	d.linkCount = 2 + entries.numSubdirs
+	d.Unlock()
+
+	return entries, nil
+}
+
+// Attr fills attr with the standard metadata for the directory. A directory
+// is linked from its parent, from its own "." entry and from the ".." entry
+// of each of its subdirectories. The link count is kept once the entries
+// have been loaded so that they need not be loaded again on each stat.
+func (d *Dir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	d.Lock()
+	linkCount := d.linkCount
+	d.Unlock()
+
+	if linkCount == 0 {
+		entries, err := d.load()
+		if err != nil {
+			return err
+		}
+
+		linkCount = 2 + entries.numSubdirs
 	}
 
-	d.entries = entries
-	d.entryIndex = make(map[string]int, len(entries))
-	for i, de := range entries {
-		d.entryIndex[de.Name] = i
+	if err := d.attr.Attr(ctx, attr); err != nil {
+		return err
 	}
 
+	attr.Nlink = linkCount
+
 	return nil
 }
 
 // ReadDirAll returns a list of entries from this directory.
 func (d *Dir) ReadDirAll(ctx context.Context) (fuseEntries []fuse.Dirent, err error) {
-	// Ensure that entries have been loaded.
-	if d.entries == nil {
-		if err := d.load(); err != nil {
-			return nil, err
-		}
+	entries, err := d.load()
+	if err != nil {
+		return nil, err
 	}
 
 	currentDir := fuse.Dirent{
@@ -391,12 +673,12 @@ func (d *Dir) ReadDirAll(ctx context.Context) (fuseEntries []fuse.Dirent, err er
 	}
 
 	// Allocate space for every directory entry, including "." and "..".
-	fuseEntries = make([]fuse.Dirent, 0, len(d.entries)+2)
+	fuseEntries = make([]fuse.Dirent, 0, len(entries.entries)+2)
 	fuseEntries = append(fuseEntries, currentDir, parentDir)
 
-	for _, entry := range d.entries {
+	for _, entry := range entries.entries {
 		fuseEntries = append(fuseEntries, fuse.Dirent{
-			Inode: inode(entry, d.inode),
+			Inode: d.fs.inodes.entryInode(entry, d.inode),
 			Type:  fuseDirentTypes[entry.Type],
 			Name:  entry.Name,
 		})
@@ -411,27 +693,27 @@ func (d *Dir) ReadDirAll(ctx context.Context) (fuseEntries []fuse.Dirent, err er
 // the directory, Lookup should return ENOENT.
 //
 // Lookup need not to handle the names "." and "..".
-func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
-	// Ensure that entries have been loaded.
-	if d.entries == nil {
-		if err := d.load(); err != nil {
-			return nil, err
-		}
+func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	name := req.Name
+	resp.EntryValid = cacheValidity
+
+	entries, err := d.load()
+	if err != nil {
+		return nil, err
 	}
 
-	i, ok := d.entryIndex[name]
+	i, ok := entries.index[name]
 	if !ok {
 		return nil, fuse.ENOENT
 	}
 
-	return d.fs.makeNode(d.entries[i], d.inode)
+	return d.fs.makeNode(entries.entries[i], d.inode)
 }
 
 // File represents a file node.
 type File struct {
 	*attr
 	digest stemma.Digest
-	rsc    stemma.ReadSeekCloser
 }
 
 // Open opens the receiver. After a successful open, a client
@@ -450,12 +732,31 @@ func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenR
 		return nil, fmt.Errorf("unable to get file from object store: %s", err)
 	}
 
-	return &FileHandle{rsc: rsc}, nil
+	// File contents never change so there is no need for the kernel to
+	// drop its page cache for this file when it is opened again.
+	resp.Flags |= fuse.OpenKeepCache
+
+	return newFileHandle(rsc), nil
 }
 
-// FileHandle represents an open file handle.
+// FileHandle represents an open file handle. The kernel may send concurrent
+// reads for the same handle.
 type FileHandle struct {
 	rsc stemma.ReadSeekCloser
+	// The file if it supports positional reads, otherwise nil.
+	readerAt io.ReaderAt
+
+	// Serializes seeking and reading if the file does not support
+	// positional reads.
+	sync.Mutex
+}
+
+// newFileHandle returns a handle for the given open file.
+func newFileHandle(rsc stemma.ReadSeekCloser) *FileHandle {
+	fh := &FileHandle{rsc: rsc}
+	fh.readerAt, _ = rsc.(io.ReaderAt)
+
+	return fh
 }
 
 // Read requests to read data from the handle.
@@ -468,17 +769,34 @@ type FileHandle struct {
 // Note that reads beyond the size of the file as reported by Attr
 // are not even attempted (except in OpenDirectIO mode).
 func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	if _, err := fh.rsc.Seek(req.Offset, os.SEEK_SET); err != nil {
-		return fmt.Errorf("unable to seek: %s", err)
-	}
-
 	resp.Data = make([]byte, req.Size)
-	n, err := fh.rsc.Read(resp.Data)
+
+	n, err := fh.readAt(resp.Data, req.Offset)
 	resp.Data = resp.Data[:n]
 
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// A short read indicates the end of the file.
+		err = nil
+	}
+
 	return err
 }
 
+func (fh *FileHandle) readAt(p []byte, offset int64) (n int, err error) {
+	if fh.readerAt != nil {
+		return fh.readerAt.ReadAt(p, offset)
+	}
+
+	fh.Lock()
+	defer fh.Unlock()
+
+	if _, err := fh.rsc.Seek(offset, os.SEEK_SET); err != nil {
+		return 0, fmt.Errorf("unable to seek: %s", err)
+	}
+
+	return io.ReadFull(fh.rsc, p)
+}
+
 // Release asks to release (close) an open file handle.
 func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
 	return fh.rsc.Close()
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs/fstestutil"
+	"github.com/jlhawn/stemma"
+	"golang.org/x/net/context"
+)
+
+// benchFileName is the name of the only file in the rootfs of test
+// applications.
+const benchFileName = "bench"
+
+// testApp is an application with a single file stored in a temporary
+// repository.
+type testApp struct {
+	root     string
+	repo     *stemma.Repository
+	app      stemma.Digest
+	file     stemma.Digest
+	contents []byte
+}
+
+// newTestApp stores an application with a single file of the given size in a
+// new repository. The file is packed if pack is true.
+func newTestApp(tb testing.TB, size int, pack bool) *testApp {
+	root, err := ioutil.TempDir("", "stemma-mount-test")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	repo, err := stemma.InitRepository(filepath.Join(root, "repo"), stemma.DefaultConfig)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	contents := make([]byte, size)
+	for i := range contents {
+		contents[i] = byte(i * 7)
+	}
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		tb.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(rootfs, benchFileName), contents, 0644); err != nil {
+		tb.Fatal(err)
+	}
+
+	fileDesc, err := repo.StoreFile(filepath.Join(rootfs, benchFileName))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	dirDesc, err := repo.StoreDirectory(rootfs)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	header, err := stemma.NewHeader(rootfs)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	hdrDesc, err := repo.PutHeader(header)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	appDesc, err := repo.PutApplication(stemma.Application{
+		Rootfs: stemma.Rootfs{
+			Header: stemma.RootfsHeader{
+				Digest: hdrDesc.Digest(),
+				Size:   hdrDesc.Size(),
+			},
+			Directory: stemma.RootfsDirectory{
+				Digest:         dirDesc.Digest(),
+				Size:           dirDesc.Size(),
+				NumSubObjects:  dirDesc.NumSubObjects(),
+				SubObjectsSize: dirDesc.SubObjectsSize(),
+			},
+		},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if pack {
+		if _, err := repo.Repack(int64(size) + 1); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return &testApp{
+		root:     root,
+		repo:     repo,
+		app:      appDesc.Digest(),
+		file:     fileDesc.Digest(),
+		contents: contents,
+	}
+}
+
+// Close removes the repository of the application.
+func (ta *testApp) Close() {
+	os.RemoveAll(ta.root)
+}
+
+// seekOnly hides the positional reads of a file so that a file handle must
+// seek and read.
+type seekOnly struct {
+	stemma.ReadSeekCloser
+}
+
+// failingReaderAt is a file whose positional reads always fail.
+type failingReaderAt struct {
+	seekOnly
+}
+
+var errReadAt = errors.New("injected read error")
+
+func (failingReaderAt) ReadAt(p []byte, offset int64) (n int, err error) {
+	return 0, errReadAt
+}
+
+func TestFileHandleReadAtErrors(t *testing.T) {
+	ta := newTestApp(t, 100, false)
+	defer ta.Close()
+
+	rsc, err := ta.repo.GetFile(ta.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fh := newFileHandle(failingReaderAt{seekOnly{rsc}})
+	defer fh.rsc.Close()
+
+	// Positional read errors are not hidden by falling back to seeking.
+	if _, err := fh.readAt(make([]byte, 10), 0); err != errReadAt {
+		t.Errorf("got error %v, expected %v", err, errReadAt)
+	}
+
+	req := &fuse.ReadRequest{Offset: 0, Size: 10}
+	if err := fh.Read(context.Background(), req, &fuse.ReadResponse{}); err != errReadAt {
+		t.Errorf("Read returned error %v, expected %v", err, errReadAt)
+	}
+}
+
+func TestFileHandleReadAtBounds(t *testing.T) {
+	const size = 10000
+
+	for _, pack := range []bool{false, true} {
+		ta := newTestApp(t, size, pack)
+		defer ta.Close()
+
+		for _, positional := range []bool{true, false} {
+			rsc, err := ta.repo.GetFile(ta.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var file stemma.ReadSeekCloser = rsc
+			if !positional {
+				file = seekOnly{rsc}
+			}
+
+			fh := newFileHandle(file)
+			if (fh.readerAt != nil) != positional {
+				t.Fatalf("pack=%t: positional reads supported is %t, expected %t", pack, fh.readerAt != nil, positional)
+			}
+
+			for _, test := range []struct {
+				offset int64
+				length int
+			}{
+				{0, size},
+				{0, size + 100},
+				{size - 10, 100},
+				{size - 1, 1},
+				{size, 100},
+				{size + 100, 100},
+			} {
+				p := bytes.Repeat([]byte{0xff}, test.length)
+
+				n, err := fh.readAt(p, test.offset)
+				if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+					t.Fatalf("pack=%t positional=%t offset=%d: %s", pack, positional, test.offset, err)
+				}
+
+				expected := []byte{}
+				if test.offset < size {
+					end := test.offset + int64(test.length)
+					if end > size {
+						end = size
+					}
+
+					expected = ta.contents[test.offset:end]
+				}
+
+				if !bytes.Equal(p[:n], expected) {
+					t.Errorf("pack=%t positional=%t offset=%d length=%d: read %d bytes, expected %d",
+						pack, positional, test.offset, test.length, n, len(expected))
+				}
+
+				resp := &fuse.ReadResponse{}
+				req := &fuse.ReadRequest{Offset: test.offset, Size: test.length}
+				if err := fh.Read(context.Background(), req, resp); err != nil {
+					t.Fatalf("pack=%t positional=%t offset=%d: %s", pack, positional, test.offset, err)
+				}
+
+				if !bytes.Equal(resp.Data, expected) {
+					t.Errorf("pack=%t positional=%t offset=%d length=%d: Read returned %d bytes, expected %d",
+						pack, positional, test.offset, test.length, len(resp.Data), len(expected))
+				}
+			}
+
+			fh.rsc.Close()
+		}
+	}
+}
+
+// benchFunc runs a benchmark on the file at the given path in the given
+// mounted filesystem.
+type benchFunc func(b *testing.B, filesystem *FS, mnt *fstestutil.Mount, path string)
+
+// benchmark mounts an application with a single file of the given size and
+// runs the given benchmark function on the path of the file.
+func benchmark(b *testing.B, size int, fn benchFunc) {
+	ta := newTestApp(b, size, false)
+	defer ta.Close()
+
+	filesystem := newFS(ta.repo, inodeModeContent, 16<<20, 64<<20)
+	if err := filesystem.mountApp(ta.app); err != nil {
+		b.Fatal(err)
+	}
+
+	mnt, err := fstestutil.Mounted(filesystem, nil, fuse.MaxReadahead(maxReadahead))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer mnt.Close()
+
+	b.SetBytes(int64(size))
+	fn(b, filesystem, mnt, filepath.Join(mnt.Dir, benchFileName))
+}
+
+// openBlocking opens the file at the given path for reading without adding
+// it to the runtime poller. Adding a file on a FUSE filesystem to the poller
+// polls the filesystem, which deadlocks when this process serves it.
+func openBlocking(path string) (*os.File, error) {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// doReads opens and reads the whole file each iteration. Unless cold, the
+// kernel keeps its page cache for the file between opens so only the first
+// iteration reaches the filesystem.
+func doReads(cold bool) benchFunc {
+	return func(b *testing.B, filesystem *FS, mnt *fstestutil.Mount, path string) {
+		var node *File
+		if cold {
+			// Look up the file so that the node whose data is
+			// invalidated is the one known to the kernel.
+			if _, err := os.Stat(path); err != nil {
+				b.Fatalf("stat: %v", err)
+			}
+
+			n, err := filesystem.root.(*Dir).Lookup(context.Background(), &fuse.LookupRequest{Name: benchFileName}, &fuse.LookupResponse{})
+			if err != nil {
+				b.Fatalf("lookup: %v", err)
+			}
+
+			node = n.(*File)
+		}
+
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			if cold {
+				b.StopTimer()
+				if err := mnt.Server.InvalidateNodeData(node); err != nil {
+					b.Fatalf("invalidate: %v", err)
+				}
+				b.StartTimer()
+			}
+
+			f, err := openBlocking(path)
+			if err != nil {
+				b.Fatalf("open: %v", err)
+			}
+
+			if _, err := io.Copy(ioutil.Discard, f); err != nil {
+				b.Fatalf("read: %v", err)
+			}
+
+			f.Close()
+		}
+	}
+}
+
+// doPositionalReads reads the file in blocks of the given size at offsets
+// spread over the whole file.
+func doPositionalReads(readSize int) benchFunc {
+	return func(b *testing.B, filesystem *FS, mnt *fstestutil.Mount, path string) {
+		f, err := openBlocking(path)
+		if err != nil {
+			b.Fatalf("open: %v", err)
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			b.Fatalf("stat: %v", err)
+		}
+
+		numBlocks := fi.Size() / int64(readSize)
+		p := make([]byte, readSize)
+
+		b.SetBytes(int64(readSize))
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			// Step through the blocks out of order so that reads are
+			// not sequential.
+			offset := (int64(i) * 7919 % numBlocks) * int64(readSize)
+			if _, err := f.ReadAt(p, offset); err != nil {
+				b.Fatalf("read: %v", err)
+			}
+		}
+	}
+}
+
+func BenchmarkReadKeepCache100(b *testing.B) {
+	benchmark(b, 100, doReads(false))
+}
+
+func BenchmarkReadKeepCache10MB(b *testing.B) {
+	benchmark(b, 10*1024*1024, doReads(false))
+}
+
+func BenchmarkReadCold100(b *testing.B) {
+	benchmark(b, 100, doReads(true))
+}
+
+func BenchmarkReadCold10MB(b *testing.B) {
+	benchmark(b, 10*1024*1024, doReads(true))
+}
+
+func BenchmarkPositionalRead4KB(b *testing.B) {
+	benchmark(b, 10*1024*1024, doPositionalReads(4096))
+}
+
+func BenchmarkPositionalRead128KB(b *testing.B) {
+	benchmark(b, 10*1024*1024, doPositionalReads(128*1024))
+}
+
+// benchmarkReadAt reads a file in blocks of the given size directly from a
+// file handle, without going through the kernel.
+func benchmarkReadAt(b *testing.B, pack, positional bool) {
+	const (
+		size     = 16 * 1024
+		readSize = 4096
+	)
+
+	ta := newTestApp(b, size, pack)
+	defer ta.Close()
+
+	rsc, err := ta.repo.GetFile(ta.file)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var file stemma.ReadSeekCloser = rsc
+	if !positional {
+		file = seekOnly{rsc}
+	}
+
+	fh := newFileHandle(file)
+	defer fh.rsc.Close()
+
+	p := make([]byte, readSize)
+
+	b.SetBytes(readSize)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		offset := int64(i%(size/readSize)) * readSize
+		if _, err := fh.readAt(p, offset); err != nil {
+			b.Fatalf("read: %v", err)
+		}
+	}
+}
+
+func BenchmarkFileHandleReadAtLoose(b *testing.B) {
+	benchmarkReadAt(b, false, true)
+}
+
+func BenchmarkFileHandleReadAtPacked(b *testing.B) {
+	benchmarkReadAt(b, true, true)
+}
+
+func BenchmarkFileHandleSeekReadLoose(b *testing.B) {
+	benchmarkReadAt(b, false, false)
+}
+
+func BenchmarkFileHandleSeekReadPacked(b *testing.B) {
+	benchmarkReadAt(b, true, false)
+}
+
+func TestDirLinkCountCached(t *testing.T) {
+	ta := newTestApp(t, 100, false)
+	defer ta.Close()
+
+	filesystem := newFS(ta.repo, inodeModeContent, 16<<20, 64<<20)
+	if err := filesystem.mountApp(ta.app); err != nil {
+		t.Fatal(err)
+	}
+
+	root := filesystem.root.(*Dir)
+
+	var attr fuse.Attr
+	if err := root.Attr(context.Background(), &attr); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rootfs has no subdirectories.
+	if attr.Nlink != 2 {
+		t.Errorf("got link count %d, expected 2", attr.Nlink)
+	}
+
+	// Once loaded, the directory is not loaded again to stat it, neither
+	// from the directory cache nor from the object store.
+	filesystem.directories = newLRUCache(0)
+	filesystem.objects = nil
+	if err := root.Attr(context.Background(), &attr); err != nil {
+		t.Fatalf("unable to stat loaded directory: %s", err)
+	}
+
+	if attr.Nlink != 2 {
+		t.Errorf("got cached link count %d, expected 2", attr.Nlink)
+	}
+}
+
+func TestAllUsageCached(t *testing.T) {
+	ta := newTestApp(t, 100, false)
+	defer ta.Close()
+
+	desc, err := ta.repo.GetDescriptor(ta.app)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ta.repo.TagStore().Set("app", desc); err != nil {
+		t.Fatal(err)
+	}
+
+	filesystem := newFS(ta.repo, inodeModeContent, 16<<20, 64<<20)
+	filesystem.mountAll(ta.repo.TagStore())
+
+	numObjects, size, err := filesystem.usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := filesystem.appRootEntry(ta.app)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expectedObjects, expectedSize := appRootUsage(entry); numObjects != expectedObjects || size != expectedSize {
+		t.Errorf("got usage %d objects, %d bytes, expected %d objects, %d bytes", numObjects, size, expectedObjects, expectedSize)
+	}
+
+	// Untagging the application does not change the usage until it is
+	// recomputed.
+	if err := ta.repo.TagStore().Remove("app"); err != nil {
+		t.Fatal(err)
+	}
+
+	if cachedObjects, cachedSize, err := filesystem.usage(); err != nil || cachedObjects != numObjects || cachedSize != size {
+		t.Errorf("got usage %d objects, %d bytes, %v, expected the cached usage", cachedObjects, cachedSize, err)
+	}
+
+	byDigest := filesystem.root.(*appsDir).byDigest
+	byDigest.usageTime = time.Now().Add(-tagValidity)
+
+	if numObjects, size, err := filesystem.usage(); err != nil || numObjects != 0 || size != 0 {
+		t.Errorf("got usage %d objects, %d bytes, %v, expected none", numObjects, size, err)
+	}
+}
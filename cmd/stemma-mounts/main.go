@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/jlhawn/stemma"
+)
+
+// stemma-mounts lists the applications mounted from the repository. Mounts
+// whose serving process is no longer running are reported as stale and may
+// be cleaned up with stemma-umount.
+func main() {
+	repoPath := flag.String("repo", stemma.DefaultRepositoryPath(), "path to the repository (defaults to $STEMMA_REPO or the current directory)")
+
+	flag.Parse()
+
+	repo, err := stemma.NewRepository(*repoPath)
+	if err != nil {
+		log.Fatalf("unable to initialize repository: %s", err)
+	}
+
+	mounts, err := repo.MountSet().List()
+	if err != nil {
+		log.Fatalf("unable to list mounts: %s", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "MOUNTPOINT\tPID\tDIGEST\tSTATUS")
+
+	for _, mount := range mounts {
+		status := "active"
+		if !mount.Active() {
+			status = "stale"
+		}
+
+		digest := mount.Digest.String()
+		if len(mount.Digest) == 0 {
+			digest = "(all)"
+		}
+
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", mount.Mountpoint, mount.PID, digest, status)
+	}
+
+	tw.Flush()
+}
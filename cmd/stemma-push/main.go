@@ -11,14 +11,17 @@ import (
 )
 
 func main() {
+	repoPath := flag.String("repo", stemma.DefaultRepositoryPath(), "path to the repository (defaults to $STEMMA_REPO or the current directory)")
+	force := flag.Bool("force", false, "update the remote tag even if it has changed since it was last seen")
+
 	flag.Parse()
 
 	if flag.NArg() < 2 {
-		fmt.Println("Usage: stemma-push REMOTE TAG")
+		fmt.Println("Usage: stemma-push [-force] REMOTE TAG")
 		os.Exit(1)
 	}
 
-	repo, err := stemma.NewRepository(".")
+	repo, err := stemma.NewRepository(*repoPath)
 	if err != nil {
 		log.Fatalf("unable to initialize repository: %s", err)
 	}
@@ -34,12 +37,39 @@ func main() {
 		log.Fatalf("unable to resolve reference: %s", err)
 	}
 
+	// The remote will only update its tag if it still refers to what we
+	// last saw: the remote-tracking tag for a named remote, or what the
+	// remote has now. This prevents silently clobbering a concurrent push.
+	var tracking stemma.TagStore
+	if _, ok := repo.Config().Remotes[flag.Arg(0)]; ok {
+		if tracking, err = repo.RemoteTagStore(flag.Arg(0)); err != nil {
+			log.Fatalf("unable to get remote-tracking tags: %s", err)
+		}
+	}
+
+	var expected stemma.Descriptor
+	if tracking != nil {
+		expected, err = tracking.Get(ref)
+	}
+
+	if tracking == nil || err == stemma.ErrNoSuchTag {
+		expected, err = remote.GetTag(ref)
+	}
+
+	if err != nil {
+		if err != stemma.ErrNoSuchTag {
+			log.Fatalf("unable to resolve remote reference: %s", err)
+		}
+
+		expected = nil
+	}
+
 	progress := &stemma.ProgressMeter{
 		TotalObjects: 1 + desc.NumSubObjects(),
 		TotalSize:    desc.Size() + desc.SubObjectsSize(),
 	}
 
-	fmt.Printf("Total Objects: %10d %6s\n", progress.TotalObjects, humanSize(progress.TotalSize))
+	fmt.Printf("Total Objects: %10d %6s\n", progress.TotalObjects, stemma.HumanSize(progress.TotalSize))
 
 	done := make(chan int)
 	go func() {
@@ -56,14 +86,24 @@ func main() {
 		}
 	}()
 
-	if err := remote.Push(desc, progress); err != nil {
+	if err := remote.Push(ref, desc, expected, *force, progress); err != nil {
+		if err == stemma.ErrTagConflict {
+			log.Fatalf("rejected: remote tag %q was updated by someone else - fetch it or use -force", ref)
+		}
+
 		log.Fatalf("unable to push to remote: %s", err)
 	}
 
 	done <- 1
 	<-done
 
-	fmt.Printf("\nSkipped Objects: %10d %6s\n", progress.SkippedObjects, humanSize(progress.SkippedSize))
+	fmt.Printf("\nSkipped Objects: %10d %6s\n", progress.SkippedObjects, stemma.HumanSize(progress.SkippedSize))
+
+	if tracking != nil {
+		if err := tracking.Set(ref, desc); err != nil {
+			log.Fatalf("unable to set remote-tracking tag: %s", err)
+		}
+	}
 }
 
 func updateProgress(progress *stemma.ProgressMeter) {
@@ -72,32 +112,10 @@ func updateProgress(progress *stemma.ProgressMeter) {
 	fmt.Printf(
 		"\rTransferring Objects: %6d %6.2f%%  %10s %6.2f%%",
 		objectsProgress, percent(objectsProgress, uint64(progress.TotalObjects)),
-		humanSize(sizeProgress), percent(sizeProgress, progress.TotalSize),
+		stemma.HumanSize(sizeProgress), percent(sizeProgress, progress.TotalSize),
 	)
 }
 
 func percent(current, total uint64) float64 {
 	return float64(current) / float64(total) * 100.0
 }
-
-const (
-	kilobyte = 1024
-	megabyte = kilobyte * kilobyte
-	gigabyte = megabyte * kilobyte
-	terabyte = megabyte * kilobyte
-)
-
-func humanSize(numBytes uint64) string {
-	switch {
-	case numBytes > terabyte:
-		return fmt.Sprintf("%.3fTB", float64(numBytes)/terabyte)
-	case numBytes > gigabyte:
-		return fmt.Sprintf("%.3fGB", float64(numBytes)/gigabyte)
-	case numBytes > megabyte:
-		return fmt.Sprintf("%.3fMB", float64(numBytes)/megabyte)
-	case numBytes > kilobyte:
-		return fmt.Sprintf("%.3fKB", float64(numBytes)/kilobyte)
-	default:
-		return fmt.Sprintf("%dB", numBytes)
-	}
-}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jlhawn/stemma"
+)
+
+// stemma-reflog lists the recorded changes to a tag, most recent first. The
+// object a tag referred to n changes ago may be used as TAG@{n} wherever a
+// reference is expected.
+func main() {
+	repoPath := flag.String("repo", stemma.DefaultRepositoryPath(), "path to the repository (defaults to $STEMMA_REPO or the current directory)")
+
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Println("Usage: stemma-reflog TAG")
+		os.Exit(1)
+	}
+
+	tag := flag.Arg(0)
+
+	repo, err := stemma.NewRepository(*repoPath)
+	if err != nil {
+		log.Fatalf("unable to initialize repository: %s", err)
+	}
+
+	entries, err := repo.TagStore().Log(tag)
+	if err != nil {
+		log.Fatalf("unable to read log of tag %q: %s", tag, err)
+	}
+
+	if len(entries) == 0 {
+		log.Fatalf("no changes recorded for tag %q", tag)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "REF\tDIGEST\tPREVIOUS\tTIME\tUSER\tOPERATION")
+
+	for i, entry := range entries {
+		fmt.Fprintf(tw, "%s@{%d}\t%s\t%s\t%s\t%s\t%s (%s)\n",
+			tag, i, descDigest(entry.New), descDigest(entry.Old),
+			entry.Time.Format(time.RFC3339), entry.User, entry.Operation, entry.Program)
+	}
+
+	tw.Flush()
+}
+
+// descDigest returns the digest of the given descriptor, or "-" if there is
+// no descriptor.
+func descDigest(desc stemma.Descriptor) string {
+	if desc == nil {
+		return "-"
+	}
+
+	return desc.Digest().String()
+}
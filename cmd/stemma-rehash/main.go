@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/jlhawn/stemma"
+)
+
+func main() {
+	repoPath := flag.String("repo", stemma.DefaultRepositoryPath(), "path to the repository (defaults to $STEMMA_REPO or the current directory)")
+	algName := flag.String("alg", stemma.DefaultConfig.DigestAlg.String(), "name of the digest algorithm to rewrite objects with")
+	setDefault := flag.Bool("set-default", true, "make the algorithm the repository's algorithm for new objects")
+
+	flag.Parse()
+
+	alg, err := stemma.ParseDigestAlg(*algName)
+	if err != nil {
+		fmt.Println("Usage: stemma-rehash [-alg NAME] [-set-default=false] [TAG...]")
+		log.Fatalf("unable to use digest algorithm %q: %s", *algName, err)
+	}
+
+	repo, err := stemma.NewRepository(*repoPath)
+	if err != nil {
+		log.Fatalf("unable to initialize repository: %s", err)
+	}
+
+	// Acquire an exclusive lock on the repository as we will be updating
+	// tags and the repository config.
+	if err := repo.ExclusiveLock(); err != nil {
+		log.Fatalf("unable to acquire exclusive repo lock: %s", err)
+	}
+	defer repo.Unlock()
+
+	tags := flag.Args()
+	if len(tags) == 0 {
+		if tags, err = repo.TagStore().List(""); err != nil {
+			log.Fatalf("unable to list tags: %s", err)
+		}
+
+		sort.Strings(tags)
+	}
+
+	// New objects written while rehashing should use the new algorithm
+	// even if the rehash is interrupted part way through.
+	if *setDefault {
+		config := repo.Config()
+		config.DigestAlg = alg
+
+		if err := repo.SetConfig(config); err != nil {
+			log.Fatalf("unable to set repository digest algorithm: %s", err)
+		}
+	}
+
+	rehashed := map[string]stemma.Descriptor{}
+
+	failed := false
+	for _, tag := range tags {
+		if err := rehashTag(repo, tag, alg, rehashed); err != nil {
+			log.Printf("unable to rehash tag %q: %s", tag, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// rehashTag rewrites the object which the given tag refers to using the
+// given algorithm and updates the tag to refer to the rewritten object.
+func rehashTag(repo *stemma.Repository, tag string, alg stemma.DigestAlg, rehashed map[string]stemma.Descriptor) error {
+	desc, err := repo.TagStore().Get(tag)
+	if err != nil {
+		return err
+	}
+
+	newDesc, err := repo.Rehash(desc, alg, rehashed)
+	if err != nil {
+		return err
+	}
+
+	if !newDesc.Digest().Equals(desc.Digest()) {
+		if err := repo.TagStore().CompareAndSet(tag, desc, newDesc); err != nil {
+			return fmt.Errorf("unable to update tag: %s", err)
+		}
+	}
+
+	fmt.Printf("%s\t%s -> %s\n", tag, desc.Digest(), newDesc.Digest())
+
+	return nil
+}
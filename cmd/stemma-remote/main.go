@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/jlhawn/stemma"
+)
+
+const usage = `Usage:
+	stemma-remote [list]
+	stemma-remote add NAME URL
+	stemma-remote remove NAME
+	stemma-remote show NAME
+	stemma-remote [-force] apply NAME [TAG...]`
+
+// stemma-remote manages the named remotes of the repository. Fetching from a
+// named remote only updates its remote-tracking tags; apply is the explicit
+// step which updates local tags from them.
+func main() {
+	repoPath := flag.String("repo", stemma.DefaultRepositoryPath(), "path to the repository (defaults to $STEMMA_REPO or the current directory)")
+	force := flag.Bool("force", false, "apply: replace local tags which refer to something else")
+
+	flag.Parse()
+
+	command, args := "list", flag.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	numArgs := map[string]int{
+		"list":   0,
+		"add":    2,
+		"remove": 1,
+		"show":   1,
+		"apply":  1,
+	}
+
+	minArgs, ok := numArgs[command]
+	if !ok || len(args) < minArgs || (command != "apply" && len(args) > minArgs) {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	repo, err := stemma.NewRepository(*repoPath)
+	if err != nil {
+		log.Fatalf("unable to initialize repository: %s", err)
+	}
+
+	// Acquire an exclusive lock on the repository as we may be changing
+	// its config or tags.
+	if err := repo.ExclusiveLock(); err != nil {
+		log.Fatalf("unable to acquire exclusive repo lock: %s", err)
+	}
+	defer repo.Unlock()
+
+	switch command {
+	case "list":
+		listRemotes(repo)
+	case "add":
+		if err := repo.AddRemote(args[0], args[1]); err != nil {
+			log.Fatalf("unable to add remote %q: %s", args[0], err)
+		}
+	case "remove":
+		if err := repo.RemoveRemote(args[0]); err != nil {
+			log.Fatalf("unable to remove remote %q: %s", args[0], err)
+		}
+	case "show":
+		showRemote(repo, args[0])
+	case "apply":
+		if !applyRemoteTags(repo, args[0], args[1:], *force) {
+			os.Exit(1)
+		}
+	}
+}
+
+func listRemotes(repo *stemma.Repository) {
+	remotes := repo.Config().Remotes
+
+	names := make([]string, 0, len(remotes))
+	for name := range remotes {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("%s\t%s\n", name, remotes[name])
+	}
+}
+
+// showRemote prints the URL and remote-tracking tags of the named remote.
+func showRemote(repo *stemma.Repository, name string) {
+	tags, err := repo.RemoteTagStore(name)
+	if err != nil {
+		log.Fatalf("unable to get remote %q: %s", name, err)
+	}
+
+	tagNames, err := tags.List("")
+	if err != nil {
+		log.Fatalf("unable to list remote-tracking tags: %s", err)
+	}
+
+	sort.Strings(tagNames)
+
+	fmt.Printf("URL: %s\n", repo.Config().Remotes[name])
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "TAG\tDIGEST\tLOCAL")
+
+	for _, tag := range tagNames {
+		desc, err := tags.Get(tag)
+		if err != nil {
+			log.Fatalf("unable to get remote-tracking tag %q: %s", tag, err)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\n", tag, desc.Digest(), localStatus(repo, tag, desc))
+	}
+}
+
+// localStatus describes how the local tag with the given name compares to
+// the given remote-tracking tag.
+func localStatus(repo *stemma.Repository, tag string, remoteDesc stemma.Descriptor) string {
+	localDesc, err := repo.TagStore().Get(tag)
+	switch {
+	case err == stemma.ErrNoSuchTag:
+		return "none"
+	case err != nil:
+		return "unknown"
+	case localDesc.Digest().Equals(remoteDesc.Digest()):
+		return "up to date"
+	default:
+		return "differs"
+	}
+}
+
+// applyRemoteTags sets the given local tags, or every tag tracked from the
+// named remote, to refer to the same objects as the remote-tracking tags.
+// Local tags which already refer to something else are only replaced if
+// forced. It returns whether every tag was applied.
+func applyRemoteTags(repo *stemma.Repository, name string, tagNames []string, force bool) bool {
+	tags, err := repo.RemoteTagStore(name)
+	if err != nil {
+		log.Fatalf("unable to get remote %q: %s", name, err)
+	}
+
+	if len(tagNames) == 0 {
+		if tagNames, err = tags.List(""); err != nil {
+			log.Fatalf("unable to list remote-tracking tags: %s", err)
+		}
+
+		sort.Strings(tagNames)
+	}
+
+	ok := true
+	for _, tag := range tagNames {
+		desc, err := tags.Get(tag)
+		if err != nil {
+			log.Printf("unable to get remote-tracking tag %q: %s", tag, err)
+			ok = false
+			continue
+		}
+
+		localDesc, err := repo.TagStore().Get(tag)
+		switch {
+		case err == stemma.ErrNoSuchTag:
+			localDesc = nil
+		case err != nil:
+			log.Printf("unable to get local tag %q: %s", tag, err)
+			ok = false
+			continue
+		case localDesc.Digest().Equals(desc.Digest()):
+			continue
+		case !force:
+			log.Printf("not replacing local tag %q which refers to %s - use -force", tag, localDesc.Digest())
+			ok = false
+			continue
+		}
+
+		if err := repo.TagStore().CompareAndSet(tag, localDesc, desc); err != nil {
+			log.Printf("unable to set local tag %q: %s", tag, err)
+			ok = false
+			continue
+		}
+
+		fmt.Printf("%s -> %s\n", tag, desc.Digest())
+	}
+
+	return ok
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jlhawn/stemma"
+)
+
+// stemma-repack moves small loose objects into a pack, saving the inode and
+// directory entries of each. Packed objects are read just like loose ones.
+func main() {
+	repoPath := flag.String("repo", stemma.DefaultRepositoryPath(), "path to the repository (defaults to $STEMMA_REPO or the current directory)")
+	maxSize := flag.Int64("max-size", stemma.DefaultPackMaxObjectSize, "size in bytes of the largest object to pack, or 0 to pack every loose object")
+
+	flag.Parse()
+
+	if flag.NArg() != 0 || *maxSize < 0 {
+		fmt.Println("Usage: stemma-repack [-max-size BYTES]")
+		os.Exit(1)
+	}
+
+	repo, err := stemma.NewRepository(*repoPath)
+	if err != nil {
+		log.Fatalf("unable to initialize repository: %s", err)
+	}
+
+	// Acquire an exclusive lock on the repository as loose objects will
+	// be removed.
+	if err := repo.ExclusiveLock(); err != nil {
+		log.Fatalf("unable to acquire exclusive repo lock: %s", err)
+	}
+	defer repo.Unlock()
+
+	numPacked, err := repo.Repack(*maxSize)
+	if err != nil {
+		log.Fatalf("unable to repack objects: %s", err)
+	}
+
+	fmt.Printf("Packed %d objects\n", numPacked)
+}
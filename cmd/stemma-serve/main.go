@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/jlhawn/stemma"
+)
+
+// stemma-serve serves a single request for the repository at the given path
+// over its standard input and output. It is run on remote hosts by clients
+// using ssh:// remote URLs.
+func main() {
+	repoPath := flag.String("repo", stemma.DefaultRepositoryPath(), "path to the repository to serve (defaults to $STEMMA_REPO or the current directory)")
+	path := flag.String("path", "", "same as -repo, for clients which predate it")
+
+	flag.Parse()
+
+	if *path != "" {
+		repoPath = path
+	}
+
+	repo, err := stemma.NewRepository(*repoPath)
+	if err != nil {
+		log.Fatalf("unable to initialize repository: %s", err)
+	}
+
+	buf := bufio.NewReadWriter(bufio.NewReader(os.Stdin), bufio.NewWriter(os.Stdout))
+
+	if err := repo.ServeStream(buf); err != nil {
+		log.Fatalf("unable to serve repository: %s", err)
+	}
+}
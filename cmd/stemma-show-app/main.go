@@ -12,6 +12,8 @@ import (
 )
 
 func main() {
+	repoPath := flag.String("repo", stemma.DefaultRepositoryPath(), "path to the repository (defaults to $STEMMA_REPO or the current directory)")
+
 	flag.Parse()
 
 	if flag.NArg() < 1 {
@@ -19,7 +21,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	repo, err := stemma.NewRepository(".")
+	repo, err := stemma.NewRepository(*repoPath)
 	if err != nil {
 		log.Fatalf("unable to initialize repository: %s", err)
 	}
@@ -10,6 +10,8 @@ import (
 )
 
 func main() {
+	repoPath := flag.String("repo", stemma.DefaultRepositoryPath(), "path to the repository (defaults to $STEMMA_REPO or the current directory)")
+
 	flag.Parse()
 
 	if flag.NArg() < 2 {
@@ -17,7 +19,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	repo, err := stemma.NewRepository(".")
+	repo, err := stemma.NewRepository(*repoPath)
 	if err != nil {
 		log.Fatalf("unable to initialize repository: %s", err)
 	}
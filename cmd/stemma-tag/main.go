@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/jlhawn/stemma"
+)
+
+const usage = `Usage:
+	stemma-tag [list [-json] [PREFIX]]
+	stemma-tag create [-json] [-force] TAG REF
+	stemma-tag delete TAG...
+	stemma-tag rename [-json] [-force] TAG NEWTAG
+	stemma-tag show [-json] TAG`
+
+// tagJSON is the JSON output for a single tag.
+type tagJSON struct {
+	Tag        string                `json:"tag"`
+	Descriptor stemma.DescriptorJSON `json:"descriptor"`
+}
+
+// stemma-tag manages the tags of the repository. New tags may refer to any
+// object in the repository given by digest or by any other reference.
+func main() {
+	repoPath := flag.String("repo", stemma.DefaultRepositoryPath(), "path to the repository (defaults to $STEMMA_REPO or the current directory)")
+
+	flag.Parse()
+
+	command, args := "list", flag.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	// The minimum and maximum number of arguments for each command. A
+	// negative maximum means there is no limit.
+	numArgs := map[string][2]int{
+		"list":   {0, 1},
+		"create": {2, 2},
+		"delete": {1, -1},
+		"rename": {2, 2},
+		"show":   {1, 1},
+	}
+
+	limits, ok := numArgs[command]
+	if !ok {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	t := &tagger{}
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	if command != "delete" {
+		flags.BoolVar(&t.json, "json", false, "print tags and descriptors as JSON")
+	}
+	if command == "create" || command == "rename" {
+		flags.BoolVar(&t.force, "force", false, "replace an existing tag")
+	}
+
+	// Allow flags to be given before, between, or after positional
+	// arguments.
+	var positional []string
+	for {
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			break
+		}
+
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	if len(positional) < limits[0] || (limits[1] >= 0 && len(positional) > limits[1]) {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	repo, err := stemma.NewRepository(*repoPath)
+	if err != nil {
+		log.Fatalf("unable to initialize repository: %s", err)
+	}
+
+	// Acquire an exclusive lock on the repository if we may be changing
+	// tags. Otherwise, a shared lock is enough to read them.
+	lock := repo.ExclusiveLock
+	if command == "list" || command == "show" {
+		lock = repo.SharedLock
+	}
+
+	if err := lock(); err != nil {
+		log.Fatalf("unable to acquire repo lock: %s", err)
+	}
+	defer repo.Unlock()
+
+	t.repo = repo
+
+	switch command {
+	case "list":
+		prefix := ""
+		if len(positional) > 0 {
+			prefix = positional[0]
+		}
+
+		t.list(prefix)
+	case "create":
+		t.create(positional[0], positional[1])
+	case "delete":
+		if !t.delete(positional) {
+			os.Exit(1)
+		}
+	case "rename":
+		t.rename(positional[0], positional[1])
+	case "show":
+		t.show(positional[0])
+	}
+}
+
+type tagger struct {
+	repo  *stemma.Repository
+	json  bool
+	force bool
+}
+
+// list prints every tag which begins with the given prefix along with the
+// size and object counts of the object it refers to.
+func (t *tagger) list(prefix string) {
+	tags, err := t.repo.TagStore().List(prefix)
+	if err != nil {
+		log.Fatalf("unable to list tags: %s", err)
+	}
+
+	sort.Strings(tags)
+
+	descs := make(map[string]stemma.Descriptor, len(tags))
+	for _, tag := range tags {
+		desc, err := t.repo.TagStore().Get(tag)
+		if err != nil {
+			if err == stemma.ErrNoSuchTag {
+				// Removed since listing the tags.
+				continue
+			}
+
+			log.Fatalf("unable to get tag %q: %s", tag, err)
+		}
+
+		descs[tag] = desc
+	}
+
+	if t.json {
+		descsJSON := make(map[string]stemma.DescriptorJSON, len(descs))
+		for tag, desc := range descs {
+			descsJSON[tag] = stemma.NewDescriptorJSON(desc)
+		}
+
+		printJSON(descsJSON)
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TAG\tDIGEST\tTYPE\tSIZE\tOBJECTS\tTOTAL SIZE")
+
+	for _, tag := range tags {
+		desc, ok := descs[tag]
+		if !ok {
+			continue
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n",
+			tag, desc.Digest(), desc.Type(), stemma.HumanSize(desc.Size()),
+			desc.NumSubObjects()+1, stemma.HumanSize(desc.Size()+desc.SubObjectsSize()))
+	}
+
+	tw.Flush()
+}
+
+// create sets the given tag to refer to the object which the given
+// reference resolves to. An existing tag is only replaced if forced.
+func (t *tagger) create(tag, ref string) {
+	digest, err := t.repo.ResolveRef(ref)
+	if err != nil {
+		log.Fatalf("unable to resolve reference: %s", err)
+	}
+
+	desc, err := t.repo.GetDescriptor(digest)
+	if err != nil {
+		log.Fatalf("unable to get descriptor for %s: %s", digest, err)
+	}
+
+	if t.force {
+		err = t.repo.TagStore().Set(tag, desc)
+	} else {
+		err = t.repo.TagStore().CompareAndSet(tag, nil, desc)
+	}
+
+	if err != nil {
+		if err == stemma.ErrTagConflict {
+			log.Fatalf("tag %q already exists - use -force to replace it", tag)
+		}
+
+		log.Fatalf("unable to set tag %q: %s", tag, err)
+	}
+
+	t.printTag(tag, desc)
+}
+
+// delete removes the given tags. It returns whether every tag was removed.
+func (t *tagger) delete(tags []string) bool {
+	ok := true
+	for _, tag := range tags {
+		if err := t.repo.TagStore().Remove(tag); err != nil {
+			if err == stemma.ErrNoSuchTag {
+				log.Printf("no such tag %q", tag)
+			} else {
+				log.Printf("unable to remove tag %q: %s", tag, err)
+			}
+
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// rename moves the given tag to a new name. An existing tag with the new
+// name is only replaced if forced.
+func (t *tagger) rename(tag, newTag string) {
+	if tag == newTag {
+		log.Fatalf("unable to rename tag %q to itself", tag)
+	}
+
+	desc, err := t.repo.TagStore().Get(tag)
+	if err != nil {
+		log.Fatalf("unable to get tag %q: %s", tag, err)
+	}
+
+	if t.force {
+		err = t.repo.TagStore().Set(newTag, desc)
+	} else {
+		err = t.repo.TagStore().CompareAndSet(newTag, nil, desc)
+	}
+
+	if err != nil {
+		if err == stemma.ErrTagConflict {
+			log.Fatalf("tag %q already exists - use -force to replace it", newTag)
+		}
+
+		log.Fatalf("unable to set tag %q: %s", newTag, err)
+	}
+
+	if err := t.repo.TagStore().Remove(tag); err != nil {
+		log.Fatalf("unable to remove tag %q: %s", tag, err)
+	}
+
+	t.printTag(newTag, desc)
+}
+
+// show prints the descriptor of the given tag.
+func (t *tagger) show(tag string) {
+	desc, err := t.repo.TagStore().Get(tag)
+	if err != nil {
+		log.Fatalf("unable to get tag %q: %s", tag, err)
+	}
+
+	if t.json {
+		printJSON(tagJSON{Tag: tag, Descriptor: stemma.NewDescriptorJSON(desc)})
+		return
+	}
+
+	fmt.Printf("Tag:                  %s\n", tag)
+	fmt.Printf("Digest:               %s\n", desc.Digest())
+	fmt.Printf("Type:                 %s\n", desc.Type())
+	fmt.Printf("Size:                 %d\n", desc.Size())
+	fmt.Printf("Subobject Count:      %d\n", desc.NumSubObjects())
+	fmt.Printf("Total Subobject Size: %d\n", desc.SubObjectsSize())
+}
+
+// printTag prints the object which a tag was set to refer to.
+func (t *tagger) printTag(tag string, desc stemma.Descriptor) {
+	if t.json {
+		printJSON(tagJSON{Tag: tag, Descriptor: stemma.NewDescriptorJSON(desc)})
+		return
+	}
+
+	fmt.Printf("%s -> %s\n", tag, desc.Digest())
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+
+	if err := enc.Encode(v); err != nil {
+		log.Fatalf("unable to encode JSON: %s", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"bazil.org/fuse"
+	"github.com/jlhawn/stemma"
+)
+
+func main() {
+	repoPath := flag.String("repo", stemma.DefaultRepositoryPath(), "path to the repository (defaults to $STEMMA_REPO or the current directory)")
+	stale := flag.Bool("stale", false, "remove all mounts whose serving process is no longer running")
+
+	flag.Parse()
+
+	if flag.NArg() < 1 && !*stale {
+		fmt.Println("Usage: stemma-umount [-stale] [MOUNTPOINT...]")
+		os.Exit(1)
+	}
+
+	repo, err := stemma.NewRepository(*repoPath)
+	if err != nil {
+		log.Fatalf("unable to initialize repository: %s", err)
+	}
+
+	failed := false
+
+	for _, arg := range flag.Args() {
+		mountpoint, err := filepath.Abs(arg)
+		if err != nil {
+			log.Fatalf("unable to get absolute path of mountpoint: %s", err)
+		}
+
+		mount, err := repo.MountSet().Get(mountpoint)
+		if err != nil {
+			log.Printf("unable to get mount %s: %s", mountpoint, err)
+			failed = true
+			continue
+		}
+
+		if err := umount(repo, mount); err != nil {
+			log.Print(err)
+			failed = true
+		}
+	}
+
+	if *stale {
+		mounts, err := repo.MountSet().List()
+		if err != nil {
+			log.Fatalf("unable to list mounts: %s", err)
+		}
+
+		for _, mount := range mounts {
+			if mount.Active() {
+				continue
+			}
+
+			if err := umount(repo, mount); err != nil {
+				log.Print(err)
+				failed = true
+			}
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// umount unmounts the given mount and removes its record. The serving process
+// exits once the filesystem is unmounted. If the serving process is no longer
+// running, the filesystem may have been left mounted without anything to
+// serve it, so an unmount is still attempted but is allowed to fail.
+func umount(repo *stemma.Repository, mount stemma.Mount) error {
+	if err := fuse.Unmount(mount.Mountpoint); err != nil && mount.Active() {
+		return fmt.Errorf("unable to unmount %s: %s", mount.Mountpoint, err)
+	}
+
+	if err := repo.MountSet().Remove(mount.Mountpoint); err != nil && err != stemma.ErrNoSuchMount {
+		return fmt.Errorf("unable to remove mount %s: %s", mount.Mountpoint, err)
+	}
+
+	fmt.Println(mount.Mountpoint)
+
+	return nil
+}
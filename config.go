@@ -0,0 +1,216 @@
+package stemma
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// RepositoryFormatVersion is the version of the repository format written
+// and understood by this package. Repositories with a newer format may not
+// be opened.
+const RepositoryFormatVersion = 1
+
+// RepositoryEnv is the environment variable which names the repository used
+// by commands when no repository is given on the command line.
+const RepositoryEnv = "STEMMA_REPO"
+
+// Common repository errors.
+var (
+	ErrNotRepository         = errors.New("not a repository")
+	ErrUnsupportedFormat     = errors.New("unsupported repository format")
+	ErrRepositoryInitialized = errors.New("repository already initialized")
+)
+
+// Config holds the settings of a repository. It is stored as JSON in the
+// config file at the root of the repository.
+type Config struct {
+	// FormatVersion is the version of the repository format.
+	FormatVersion int `json:"formatVersion"`
+
+	// DigestAlg is the algorithm used to digest new objects written to
+	// the repository. Objects with digests of any registered algorithm
+	// may be read or fetched regardless of this setting.
+	DigestAlg DigestAlg `json:"digestAlgorithm"`
+
+	// Compression is the preferred compression method for object
+	// transfers: "flate" or "none".
+	Compression string `json:"compression"`
+
+	// Durability is how much of each new object is synced to stable
+	// storage before it is committed: "none", "file" or "file+dir".
+	Durability string `json:"durability"`
+
+	// FetchSyncBatch is the number of fetched objects which are synced
+	// together. Syncing in batches is much faster than syncing each of
+	// the thousands of objects a fetch may commit, but a crash may lose
+	// any of the objects in a batch which has not yet been synced. If it
+	// is not positive, each object is synced as it is committed.
+	FetchSyncBatch int `json:"fetchSyncBatch"`
+
+	// Remotes maps names to remote URLs. A configured name may be used
+	// anywhere a remote URL is expected.
+	Remotes map[string]string `json:"remotes,omitempty"`
+}
+
+// DefaultConfig is the configuration of a new repository, and of a
+// repository created before config files were introduced.
+var DefaultConfig = Config{
+	FormatVersion:  RepositoryFormatVersion,
+	DigestAlg:      DigestAlgSHA512_256,
+	Compression:    "flate",
+	Durability:     DurabilityFileAndDir,
+	FetchSyncBatch: 1024,
+}
+
+// DefaultRepositoryPath returns the path of the repository which commands
+// use by default: the value of $STEMMA_REPO if set, or the current
+// directory.
+func DefaultRepositoryPath() string {
+	if path := os.Getenv(RepositoryEnv); path != "" {
+		return path
+	}
+
+	return "."
+}
+
+// validate checks that this configuration may be used by this package.
+func (c Config) validate() error {
+	if c.FormatVersion > RepositoryFormatVersion {
+		return fmt.Errorf("%s: version %d is newer than version %d", ErrUnsupportedFormat, c.FormatVersion, RepositoryFormatVersion)
+	}
+
+	if _, ok := registeredDigestAlgs[c.DigestAlg]; !ok {
+		return fmt.Errorf("unable to use digest algorithm %d: %s", c.DigestAlg, ErrInvalidDigestAlg)
+	}
+
+	if _, ok := transferCompressionNames[c.Compression]; !ok {
+		return fmt.Errorf("unknown compression method %q", c.Compression)
+	}
+
+	if !durabilityModes[c.Durability] {
+		return fmt.Errorf("unknown durability mode %q", c.Durability)
+	}
+
+	return nil
+}
+
+func getConfigPath(root string) string {
+	return filepath.Join(root, "config")
+}
+
+// readConfig reads the configuration of the repository at the given root
+// directory. A repository created before config files were introduced has
+// an objects directory but no config file and uses the default
+// configuration.
+func readConfig(root string) (Config, error) {
+	config := DefaultConfig
+
+	configFile, err := os.Open(getConfigPath(root))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return config, fmt.Errorf("unable to open config file: %s", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(root, "objects")); err != nil {
+			return config, ErrNotRepository
+		}
+
+		return config, nil
+	}
+	defer configFile.Close()
+
+	if err := json.NewDecoder(configFile).Decode(&config); err != nil {
+		return config, fmt.Errorf("unable to decode config file: %s", err)
+	}
+
+	if err := config.validate(); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+// writeConfig writes the given configuration to the config file in the given
+// root directory. The config file is written to a temporary file which is
+// synced and renamed into place, and the root directory is then synced, so
+// that the config file is never seen partially written, even after a crash.
+func writeConfig(root string, config Config) error {
+	buf, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return fmt.Errorf("unable to encode config: %s", err)
+	}
+
+	err = writeFileAtomic(osFS{}, getConfigPath(root), os.FileMode(0644), func(w io.Writer) error {
+		_, err := w.Write(append(buf, '\n'))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write config file: %s", err)
+	}
+
+	if err := syncDir(root); err != nil {
+		return fmt.Errorf("unable to sync repository directory: %s", err)
+	}
+
+	return nil
+}
+
+// InitRepository creates a repository with the given configuration at the
+// given root directory, creating the directory if necessary. A repository
+// created before config files were introduced may be initialized to give it
+// a config file.
+func InitRepository(root string, config Config) (*Repository, error) {
+	if err := os.MkdirAll(root, os.FileMode(0755)); err != nil {
+		return nil, fmt.Errorf("unable to make directory %q: %s", root, err)
+	}
+
+	if _, err := os.Lstat(getConfigPath(root)); err == nil {
+		return nil, ErrRepositoryInitialized
+	}
+
+	config.FormatVersion = RepositoryFormatVersion
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "objects"), os.FileMode(0755)); err != nil {
+		return nil, fmt.Errorf("unable to make objects directory: %s", err)
+	}
+
+	if err := writeConfig(root, config); err != nil {
+		return nil, err
+	}
+
+	return NewRepository(root)
+}
+
+// Config returns the configuration of this repository.
+func (r *Repository) Config() Config {
+	return r.config
+}
+
+// SetConfig replaces the configuration of this repository. Acquire an
+// exclusive lock before changing the configuration.
+func (r *Repository) SetConfig(config Config) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	if err := writeConfig(r.root, config); err != nil {
+		return err
+	}
+
+	r.config = config
+
+	return nil
+}
+
+// transferCompressions returns the compression methods this repository
+// offers for object transfers, in order of preference.
+func (r *Repository) transferCompressions() []transferCompression {
+	return offeredCompressions(r.config.Compression)
+}
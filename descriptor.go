@@ -107,6 +107,47 @@ func UnmarshalDescriptor(r io.Reader) (Descriptor, error) {
 	return &d, nil
 }
 
+// DescriptorJSON is the JSON representation of a descriptor.
+type DescriptorJSON struct {
+	Digest         string `json:"digest"`
+	Size           uint64 `json:"size"`
+	Type           string `json:"type"`
+	NumSubObjects  uint32 `json:"numSubObjects"`
+	SubObjectsSize uint64 `json:"subObjectsSize"`
+}
+
+// NewDescriptorJSON returns the JSON representation of the given descriptor.
+func NewDescriptorJSON(d Descriptor) DescriptorJSON {
+	return DescriptorJSON{
+		Digest:         d.Digest().Hex(),
+		Size:           d.Size(),
+		Type:           d.Type().String(),
+		NumSubObjects:  d.NumSubObjects(),
+		SubObjectsSize: d.SubObjectsSize(),
+	}
+}
+
+// Descriptor returns the descriptor represented by this JSON descriptor.
+func (dj DescriptorJSON) Descriptor() (Descriptor, error) {
+	digest, err := ParseDigest(dj.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse digest: %s", err)
+	}
+
+	objectType, err := ParseObjectType(dj.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	return &descriptor{
+		digest:         digest,
+		size:           dj.Size,
+		objectType:     objectType,
+		numSubObjects:  dj.NumSubObjects,
+		subObjectsSize: dj.SubObjectsSize,
+	}, nil
+}
+
 // DescriptorQueue is a FIFO queue of object descriptors.
 type DescriptorQueue interface {
 	Len() int
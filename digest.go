@@ -13,6 +13,8 @@ import (
 	_ "crypto/sha256"
 	_ "crypto/sha512"
 	_ "golang.org/x/crypto/sha3"
+
+	"github.com/zeebo/blake3"
 )
 
 // Common Digest Errors.
@@ -40,27 +42,50 @@ const (
 	DigestAlgSHA3_256
 	DigestAlgSHA3_384
 	DigestAlgSHA3_512
+	DigestAlgBLAKE3
 
 	DigestAlgUnknown = 255
 )
 
 type digestAlgInfo struct {
-	name       string
-	cryptoHash crypto.Hash
+	name    string
+	size    int // Size in bytes of sums, excluding the algorithm byte.
+	newHash func() hash.Hash
+}
+
+// cryptoDigestAlg returns the info for a digest algorithm implemented by the
+// given crypto hash function.
+func cryptoDigestAlg(name string, cryptoHash crypto.Hash) digestAlgInfo {
+	return digestAlgInfo{
+		name:    name,
+		size:    cryptoHash.Size(),
+		newHash: cryptoHash.New,
+	}
 }
 
-// registeredDigestAlgs holds the names of registered digest algorithms.
+// registeredDigestAlgs holds the names and implementations of registered
+// digest algorithms.
 var registeredDigestAlgs = map[DigestAlg]digestAlgInfo{
-	DigestAlgSHA224:     {"SHA224", crypto.SHA224},
-	DigestAlgSHA256:     {"SHA256", crypto.SHA256},
-	DigestAlgSHA384:     {"SHA384", crypto.SHA384},
-	DigestAlgSHA512:     {"SHA512", crypto.SHA512},
-	DigestAlgSHA512_224: {"SHA512_224", crypto.SHA512_224},
-	DigestAlgSHA512_256: {"SHA512_256", crypto.SHA512_256},
-	DigestAlgSHA3_224:   {"SHA3_224", crypto.SHA3_224},
-	DigestAlgSHA3_256:   {"SHA3_256", crypto.SHA3_256},
-	DigestAlgSHA3_384:   {"SHA3_384", crypto.SHA3_384},
-	DigestAlgSHA3_512:   {"SHA3_512", crypto.SHA3_512},
+	DigestAlgSHA224:     cryptoDigestAlg("SHA224", crypto.SHA224),
+	DigestAlgSHA256:     cryptoDigestAlg("SHA256", crypto.SHA256),
+	DigestAlgSHA384:     cryptoDigestAlg("SHA384", crypto.SHA384),
+	DigestAlgSHA512:     cryptoDigestAlg("SHA512", crypto.SHA512),
+	DigestAlgSHA512_224: cryptoDigestAlg("SHA512_224", crypto.SHA512_224),
+	DigestAlgSHA512_256: cryptoDigestAlg("SHA512_256", crypto.SHA512_256),
+	DigestAlgSHA3_224:   cryptoDigestAlg("SHA3_224", crypto.SHA3_224),
+	DigestAlgSHA3_256:   cryptoDigestAlg("SHA3_256", crypto.SHA3_256),
+	DigestAlgSHA3_384:   cryptoDigestAlg("SHA3_384", crypto.SHA3_384),
+	DigestAlgSHA3_512:   cryptoDigestAlg("SHA3_512", crypto.SHA3_512),
+
+	// BLAKE3 with the default 256-bit output. The implementation hashes
+	// the chunks of large writes in parallel using SIMD instructions
+	// where available. Any parallel tree hashing produces the same sum, so
+	// it does not need an algorithm of its own.
+	DigestAlgBLAKE3: {
+		name:    "BLAKE3",
+		size:    32,
+		newHash: func() hash.Hash { return blake3.New() },
+	},
 }
 
 func (a DigestAlg) String() string {
@@ -72,6 +97,33 @@ func (a DigestAlg) String() string {
 	return info.name
 }
 
+// ParseDigestAlg returns the registered digest algorithm with the given name,
+// e.g., "SHA512_256".
+func ParseDigestAlg(name string) (DigestAlg, error) {
+	for alg, info := range registeredDigestAlgs {
+		if info.name == name {
+			return alg, nil
+		}
+	}
+
+	return DigestAlgUnknown, ErrInvalidDigestAlg
+}
+
+// MarshalText encodes this digest algorithm as its name.
+func (a DigestAlg) MarshalText() ([]byte, error) {
+	if _, ok := registeredDigestAlgs[a]; !ok {
+		return nil, ErrInvalidDigestAlg
+	}
+
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText decodes a digest algorithm from its name.
+func (a *DigestAlg) UnmarshalText(text []byte) (err error) {
+	*a, err = ParseDigestAlg(string(text))
+	return err
+}
+
 // Digest is a byte sum from a cryptographic hash function tagged with an
 // algorithm identifier prefix byte corresponding to one of the above Digest
 // Algorithms.
@@ -85,7 +137,7 @@ func (d Digest) Algorithm() DigestAlg {
 
 	// Should be encoded in the first byte.
 	alg := DigestAlg(d[0])
-	if int(alg) >= len(registeredDigestAlgs) {
+	if _, ok := registeredDigestAlgs[alg]; !ok {
 		return DigestAlgUnknown
 	}
 
@@ -115,12 +167,27 @@ func (d Digest) String() string {
 }
 
 // ParseDigest parses a new digest from the given hexadecimal digest string.
+// The digest must be of a registered algorithm and of the correct length for
+// that algorithm.
 func ParseDigest(dgst string) (Digest, error) {
 	buf, err := hex.DecodeString(dgst)
 	if err != nil {
 		return nil, fmt.Errorf("unable to decode digest hex: %s", err)
 	}
 
+	if len(buf) == 0 {
+		return nil, ErrInvalidDigestFormat
+	}
+
+	algInfo, ok := registeredDigestAlgs[DigestAlg(buf[0])]
+	if !ok {
+		return nil, ErrInvalidDigestAlg
+	}
+
+	if len(buf) != 1+algInfo.size {
+		return nil, ErrInvalidDigestFormat
+	}
+
 	return Digest(buf), nil
 }
 
@@ -161,7 +228,7 @@ func NewDigester(alg DigestAlg) (Digester, error) {
 
 	return &digester{
 		alg:  alg,
-		Hash: algInfo.cryptoHash.New(),
+		Hash: algInfo.newHash(),
 	}, nil
 }
 
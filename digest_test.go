@@ -0,0 +1,79 @@
+package stemma
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// BenchmarkStoreFile stores a file using each registered digest algorithm.
+// Objects are never synced so that the cost of digesting is not hidden by
+// the cost of syncing.
+func BenchmarkStoreFile(b *testing.B) {
+	var algs []DigestAlg
+	for alg := DigestAlg(0); alg < DigestAlgUnknown; alg++ {
+		if _, ok := registeredDigestAlgs[alg]; ok {
+			algs = append(algs, alg)
+		}
+	}
+
+	for _, size := range []int{4 * 1024, 1024 * 1024, 16 * 1024 * 1024} {
+		for _, alg := range algs {
+			b.Run(fmt.Sprintf("%s/%d", alg, size), func(b *testing.B) {
+				benchmarkStoreFile(b, alg, size)
+			})
+		}
+	}
+}
+
+func benchmarkStoreFile(b *testing.B, alg DigestAlg, size int) {
+	root, err := ioutil.TempDir("", "stemma-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	repoPath := filepath.Join(root, "repo")
+	if err := os.Mkdir(repoPath, 0755); err != nil {
+		b.Fatal(err)
+	}
+
+	repo, err := NewRepository(repoPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	config := DefaultConfig
+	config.DigestAlg = alg
+	config.Durability = DurabilityNone
+
+	if err := repo.SetConfig(config); err != nil {
+		b.Fatal(err)
+	}
+
+	contents := make([]byte, size)
+	for i := range contents {
+		contents[i] = byte(i * 7)
+	}
+
+	path := filepath.Join(root, "file")
+	if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		desc, err := repo.StoreFile(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if desc.Digest().Algorithm() != alg {
+			b.Fatalf("stored file with %s, expected %s", desc.Digest().Algorithm(), alg)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package stemma
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Durability modes control how much of a new object is synced to stable
+// storage before it is considered committed.
+const (
+	// DurabilityNone never syncs. Objects committed shortly before a
+	// crash or power loss may be lost or corrupt.
+	DurabilityNone = "none"
+	// DurabilityFile syncs the contents of each object before it is moved
+	// into place, so an object is never seen with contents which do not
+	// match its digest. Objects committed shortly before a crash may be
+	// lost.
+	DurabilityFile = "file"
+	// DurabilityFileAndDir also syncs the object directories after an
+	// object is moved into place, so a committed object is never lost.
+	DurabilityFileAndDir = "file+dir"
+)
+
+// durabilityModes are the valid durability modes.
+var durabilityModes = map[string]bool{
+	DurabilityNone:       true,
+	DurabilityFile:       true,
+	DurabilityFileAndDir: true,
+}
+
+// syncFile flushes the contents of the file at the given path to stable
+// storage.
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// makeObjectDir makes the given object directory if it does not already
+// exist. It returns the directories which must be synced for an object moved
+// into the directory to survive a crash: the object directory itself and the
+// parent of each directory which was made.
+func makeObjectDir(objectDir string) (syncDirs []string, err error) {
+	syncDirs = []string{objectDir}
+
+	// The objects directory always exists so this stops there at the
+	// latest.
+	for dir := objectDir; ; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+			break
+		}
+
+		syncDirs = append(syncDirs, filepath.Dir(dir))
+	}
+
+	if err := os.MkdirAll(objectDir, os.FileMode(0755)); err != nil {
+		return nil, err
+	}
+
+	return syncDirs, nil
+}
+
+// syncBatch defers the syncing of committed objects so that many objects may
+// be synced together. The contents of every object in the batch are synced
+// before any of them is moved into place, so a crash never leaves an object
+// whose contents do not match its digest, but any of the objects committed
+// since the batch was last flushed may be lost.
+//
+// Objects must be committed after their dependencies. Each object in the
+// batch has a level one greater than the highest level of its dependencies
+// in the batch, or zero if it has none. The objects are moved into place one
+// level at a time, and if the repository syncs object directories, those of
+// each level are synced before the next level is moved into place. So, in
+// that mode, a crash never leaves an object in the repository without its
+// dependencies. Otherwise, an object may survive a crash which its
+// dependencies do not.
+type syncBatch struct {
+	r       *Repository
+	size    int
+	pending []*tempRef
+	// Levels of the objects in the batch by digest.
+	levels map[string]int
+}
+
+// newSyncBatch returns a batch which is flushed each time the given number
+// of objects have been committed to it. It returns nil, meaning objects are
+// synced as they are committed, if the size is not positive or if this
+// repository never syncs objects. The methods of a nil batch may be called.
+func (r *Repository) newSyncBatch(size int) *syncBatch {
+	if size <= 0 || r.config.Durability == DurabilityNone {
+		return nil
+	}
+
+	return &syncBatch{
+		r:       r,
+		size:    size,
+		pending: make([]*tempRef, 0, size),
+		levels:  make(map[string]int, size),
+	}
+}
+
+// Contains returns whether an object with the given digest has been
+// committed to this batch but not yet moved into place.
+func (b *syncBatch) Contains(digest Digest) bool {
+	if b == nil {
+		return false
+	}
+
+	_, ok := b.levels[digest.Hex()]
+	return ok
+}
+
+// add commits the given object to this batch, flushing the batch if it is
+// full.
+func (b *syncBatch) add(tr *tempRef) error {
+	level := 0
+	for _, dep := range tr.deps {
+		if depLevel, ok := b.levels[dep.Digest().Hex()]; ok && depLevel >= level {
+			level = depLevel + 1
+		}
+	}
+
+	b.pending = append(b.pending, tr)
+	b.levels[tr.desc.Digest().Hex()] = level
+
+	if len(b.pending) < b.size {
+		return nil
+	}
+
+	return b.Flush()
+}
+
+// Flush syncs the objects committed to this batch and moves them into
+// place.
+func (b *syncBatch) Flush() (err error) {
+	if b == nil || len(b.pending) == 0 {
+		return nil
+	}
+
+	pending, levels := b.pending, b.levels
+	b.pending = make([]*tempRef, 0, b.size)
+	b.levels = make(map[string]int, b.size)
+
+	defer func() {
+		if err != nil {
+			for _, tr := range pending {
+				os.Remove(tr.tempPath)
+			}
+		}
+	}()
+
+	for _, tr := range pending {
+		if err := syncFile(tr.tempPath); err != nil {
+			return fmt.Errorf("unable to sync object %s: %s", tr.desc.Digest(), err)
+		}
+	}
+
+	// Group the objects by level, keeping the order they were committed
+	// in.
+	var byLevel [][]*tempRef
+	for _, tr := range pending {
+		level := levels[tr.desc.Digest().Hex()]
+		for len(byLevel) <= level {
+			byLevel = append(byLevel, nil)
+		}
+
+		byLevel[level] = append(byLevel[level], tr)
+	}
+
+	for _, levelRefs := range byLevel {
+		if err := b.moveIntoPlace(levelRefs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// moveIntoPlace moves the given objects into place and, if this repository
+// syncs object directories, syncs the directories they were moved into.
+func (b *syncBatch) moveIntoPlace(refs []*tempRef) error {
+	syncDirs := map[string]bool{}
+
+	for _, tr := range refs {
+		dirs, err := tr.moveIntoPlace()
+		if err != nil {
+			return fmt.Errorf("unable to commit object %s: %s", tr.desc.Digest(), err)
+		}
+
+		for _, dir := range dirs {
+			syncDirs[dir] = true
+		}
+	}
+
+	if b.r.config.Durability != DurabilityFileAndDir {
+		return nil
+	}
+
+	for dir := range syncDirs {
+		if err := syncDir(dir); err != nil {
+			return fmt.Errorf("unable to sync object directory: %s", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package stemma
+
+import "testing"
+
+func TestSyncBatchLevels(t *testing.T) {
+	file1 := testDescriptor(t, "file1")
+	file2 := testDescriptor(t, "file2")
+	subdir := testDescriptor(t, "subdir")
+	dir := testDescriptor(t, "dir")
+	app := testDescriptor(t, "app")
+	outside := testDescriptor(t, "outside")
+
+	batch := &syncBatch{size: 100, levels: map[string]int{}}
+
+	// Objects are committed after their dependencies. A dependency which
+	// is not in the batch is already in place.
+	for _, test := range []struct {
+		desc  Descriptor
+		deps  []Descriptor
+		level int
+	}{
+		{file1, nil, 0},
+		{file2, []Descriptor{outside}, 0},
+		{subdir, []Descriptor{file1}, 1},
+		{dir, []Descriptor{file2, subdir, outside}, 2},
+		{app, []Descriptor{dir, file1}, 3},
+	} {
+		if err := batch.add(&tempRef{desc: test.desc, deps: test.deps}); err != nil {
+			t.Fatal(err)
+		}
+
+		if level := batch.levels[test.desc.Digest().Hex()]; level != test.level {
+			t.Errorf("%s: got level %d, expected %d", test.desc.Digest(), level, test.level)
+		}
+
+		if !batch.Contains(test.desc.Digest()) {
+			t.Errorf("%s: not in batch", test.desc.Digest())
+		}
+	}
+
+	if batch.Contains(outside.Digest()) {
+		t.Errorf("batch contains object which was not added")
+	}
+}
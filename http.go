@@ -4,19 +4,27 @@ import (
 	"bufio"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
+	"strconv"
 )
 
 // RemoteObjectStore represents a connection to a remote object store.
 type RemoteObjectStore interface {
 	GetTag(name string) (Descriptor, error)
-	ListTags() (map[string]Descriptor, error)
+	// ListTags returns the descriptors of the remote tags which begin
+	// with the given prefix.
+	ListTags(prefix string) (map[string]Descriptor, error)
 	Fetch(desc Descriptor, progress *ProgressMeter) error
-	Push(desc Descriptor, progress *ProgressMeter) error
+	// Push uploads the object with the given descriptor and sets the
+	// given tag on the remote to refer to it. The tag is only updated if
+	// it currently refers to the expected descriptor (nil meaning that
+	// the tag must not exist) unless force is set. If the remote tag does
+	// not match, ErrTagConflict is returned.
+	Push(tag string, desc, expected Descriptor, force bool, progress *ProgressMeter) error
 }
 
 type remoteObjectStore struct {
@@ -24,7 +32,22 @@ type remoteObjectStore struct {
 	baseURL *url.URL
 }
 
+// RemoteObjectStore returns a remote object store for the given URL. HTTP
+// and HTTPS URLs refer to a stemma-httpserver. File URLs and bare paths refer
+// to another repository on a local (or network) filesystem which is accessed
+// directly by this process. SSH URLs (ssh://[user@]host[:port]/path) refer to
+// a repository on another host which is served by running stemma-serve there.
+// REST URLs (rest+http:// and rest+https://) refer to a stemma-httpserver, or
+// a cache in front of one, which is accessed using only plain GET requests.
+// Pushing to a REST remote is not supported.
+//
+// The name of a remote in the repository config may be given instead of a
+// URL.
 func (r *Repository) RemoteObjectStore(remoteURL string) (RemoteObjectStore, error) {
+	if configured, ok := r.config.Remotes[remoteURL]; ok {
+		remoteURL = configured
+	}
+
 	parsed, err := url.Parse(remoteURL)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse remote URL: %s", err)
@@ -33,6 +56,28 @@ func (r *Repository) RemoteObjectStore(remoteURL string) (RemoteObjectStore, err
 	switch parsed.Scheme {
 	case "http", "https":
 		// These schemes are currently supported.
+	case "file", "":
+		path := parsed.Path
+		if parsed.Scheme == "" {
+			path = remoteURL
+		}
+
+		remote, err := NewRepository(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open remote repository: %s", err)
+		}
+
+		return &streamObjectStore{
+			r:    r,
+			dial: localDialer(remote),
+		}, nil
+	case "ssh":
+		return &streamObjectStore{
+			r:    r,
+			dial: sshDialer(parsed),
+		}, nil
+	case "rest+http", "rest+https":
+		return newRESTObjectStore(r, parsed), nil
 	default:
 		return nil, fmt.Errorf("unspported scheme: %q", parsed.Scheme)
 	}
@@ -76,7 +121,7 @@ func (r *Repository) HandleGetTag(rw http.ResponseWriter, req *http.Request) {
 
 	tag := req.Form.Get("tag")
 
-	desc, err := r.TagStore().Get(tag)
+	desc, err := r.getTag(tag)
 	if err != nil {
 		if err == ErrNoSuchTag {
 			rw.WriteHeader(http.StatusNotFound)
@@ -93,9 +138,12 @@ func (r *Repository) HandleGetTag(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (ros *remoteObjectStore) ListTags() (map[string]Descriptor, error) {
+func (ros *remoteObjectStore) ListTags(prefix string) (map[string]Descriptor, error) {
 	query := url.Values{}
 	query.Set("service", "list-tags")
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
 
 	reqURL := new(url.URL)
 	*reqURL = *ros.baseURL
@@ -113,31 +161,25 @@ func (ros *remoteObjectStore) ListTags() (map[string]Descriptor, error) {
 		return nil, fmt.Errorf("unable to decode tag descriptors: %s", err)
 	}
 
-	return tagDescriptors, nil
+	// Servers which predate prefix filtering list every tag.
+	return filterTagPrefix(tagDescriptors, prefix), nil
 }
 
+// HandleListTags serves the descriptors of the tags which begin with the
+// "prefix" query parameter, or of every tag if it is not given.
 func (r *Repository) HandleListTags(rw http.ResponseWriter, req *http.Request) {
-	tags, err := r.TagStore().List()
+	req.ParseForm()
+
+	prefix := req.Form.Get("prefix")
+
+	tagDescriptors, err := r.tagDescriptors(prefix)
 	if err != nil {
 		log.Printf("unable to list tags: %s", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	tagDescriptors := make(map[string]Descriptor, len(tags))
-
-	for _, tag := range tags {
-		desc, err := r.TagStore().Get(tag)
-		if err != nil {
-			log.Printf("unable to get descriptor for tag %q: %s", tag, err)
-			rw.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		tagDescriptors[tag] = desc
-	}
-
-	if err := MarshalTagDescriptors(rw, tagDescriptors); err != nil {
+	if err := MarshalTagDescriptors(rw, tagDescriptors, prefix); err != nil {
 		log.Printf("unable to encode tag descriptors: %s", err)
 	}
 }
@@ -159,9 +201,19 @@ func (ros *remoteObjectStore) newConn() (conn net.Conn, err error) {
 	return conn, nil
 }
 
-func (ros *remoteObjectStore) Fetch(desc Descriptor, progress *ProgressMeter) error {
+// protocolHeader is set on upgrade requests and responses by peers which
+// support the transfer protocol handshake. Its value is the highest protocol
+// version supported by the peer.
+const protocolHeader = "Stemma-Protocol"
+
+// upgrade requests the given transfer service from the remote and upgrades
+// the connection to a raw stream. If the remote supports the transfer
+// protocol handshake, the transfer parameters are negotiated. Otherwise the
+// legacy parameters are used. The caller is responsible for closing the
+// returned connection.
+func (ros *remoteObjectStore) upgrade(service string) (conn net.Conn, rwf ReadWriteFlusher, params transferParams, err error) {
 	query := url.Values{}
-	query.Set("service", "serve-objects")
+	query.Set("service", service)
 
 	reqURL := new(url.URL)
 	*reqURL = *ros.baseURL
@@ -169,137 +221,164 @@ func (ros *remoteObjectStore) Fetch(desc Descriptor, progress *ProgressMeter) er
 
 	req, err := http.NewRequest("POST", reqURL.String(), nil)
 	if err != nil {
-		return fmt.Errorf("unable to create hijack request: %s", err)
+		return nil, nil, params, fmt.Errorf("unable to create %s request: %s", service, err)
 	}
 
 	req.Header.Set("Connection", "Upgrade")
 	req.Header.Set("Upgrade", "tcp")
+	req.Header.Set(protocolHeader, strconv.Itoa(ProtocolVersion))
 
-	conn, err := ros.newConn()
-	if err != nil {
-		return err
+	if conn, err = ros.newConn(); err != nil {
+		return nil, nil, params, err
 	}
 
-	defer conn.Close()
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
 
-	// Server also hijacks the connection, error 'connection closed'
-	// expected.
-	httputil.NewClientConn(conn, nil).Do(req)
+	if err := req.Write(conn); err != nil {
+		return nil, nil, params, fmt.Errorf("unable to send %s request: %s", service, err)
+	}
 
+	// Read the response using the same buffered reader as the rest of the
+	// stream so that nothing sent by the remote after the response header
+	// is lost.
 	buf := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 
-	fetcher := newRemoteObjectFetcher(buf)
+	resp, err := http.ReadResponse(buf.Reader, req)
+	if err != nil {
+		return nil, nil, params, fmt.Errorf("unable to read %s response: %s", service, err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return nil, nil, params, fmt.Errorf("unexpected %s response status: %s", service, resp.Status)
+	}
+
+	if resp.Header.Get(protocolHeader) == "" {
+		// The remote predates the handshake.
+		return conn, buf, legacyTransferParams, nil
+	}
+
+	if params, err = negotiateTransfer(buf, true, ros.r.transferCompressions()); err != nil {
+		return nil, nil, params, fmt.Errorf("unable to negotiate transfer protocol: %s", err)
+	}
+
+	if rwf, err = newTransferStream(buf, params); err != nil {
+		return nil, nil, params, err
+	}
 
-	return ros.r.fetchObjects(fetcher, desc, progress)
+	return conn, rwf, params, nil
 }
 
-func (r *Repository) HandleServeObjects(rw http.ResponseWriter, req *http.Request) {
+// hijackUpgrade hijacks the connection for the given request and upgrades it
+// to a raw stream. If the client supports the transfer protocol handshake,
+// the transfer parameters are negotiated. Otherwise the legacy parameters are
+// used. The caller is responsible for closing the returned connection.
+func (r *Repository) hijackUpgrade(rw http.ResponseWriter, req *http.Request) (conn net.Conn, rwf ReadWriteFlusher, params transferParams, err error) {
 	hijacker, ok := rw.(http.Hijacker)
 	if !ok {
-		log.Print("http hijacking not supported")
 		rw.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, nil, params, fmt.Errorf("http hijacking not supported")
 	}
 
 	conn, buf, err := hijacker.Hijack()
 	if err != nil {
-		log.Printf("unable to hijack connection :%s", err)
 		rw.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, nil, params, fmt.Errorf("unable to hijack connection: %s", err)
 	}
 
-	defer conn.Close()
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
 
-	fmt.Fprint(conn, "HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	handshake := req.Header.Get(protocolHeader) != ""
 
-	if err := r.serveObjects(buf, &ProgressMeter{}); err != nil {
-		log.Printf("unable to serve objects: %s", err)
+	fmt.Fprint(buf, "HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n")
+	if handshake {
+		fmt.Fprintf(buf, "%s: %d\r\n", protocolHeader, ProtocolVersion)
 	}
-}
+	fmt.Fprint(buf, "\r\n")
 
-func (ros *remoteObjectStore) Push(desc Descriptor, progress *ProgressMeter) error {
-	query := url.Values{}
-	query.Set("service", "receive-objects")
+	if err := buf.Flush(); err != nil {
+		return nil, nil, params, fmt.Errorf("unable to write upgrade response: %s", err)
+	}
 
-	reqURL := new(url.URL)
-	*reqURL = *ros.baseURL
-	reqURL.RawQuery = query.Encode()
+	if !handshake {
+		// The client predates the handshake.
+		return conn, buf, legacyTransferParams, nil
+	}
 
-	req, err := http.NewRequest("POST", reqURL.String(), nil)
-	if err != nil {
-		return fmt.Errorf("unable to create receive-objects request: %s", err)
+	if params, err = negotiateTransfer(buf, false, r.transferCompressions()); err != nil {
+		return nil, nil, params, fmt.Errorf("unable to negotiate transfer protocol: %s", err)
 	}
 
-	req.Header.Set("Connection", "Upgrade")
-	req.Header.Set("Upgrade", "tcp")
+	if rwf, err = newTransferStream(buf, params); err != nil {
+		return nil, nil, params, err
+	}
+
+	return conn, rwf, params, nil
+}
 
-	conn, err := ros.newConn()
+func (ros *remoteObjectStore) Fetch(desc Descriptor, progress *ProgressMeter) error {
+	fetcher, params, conn, err := ros.openFetchSession()
 	if err != nil {
 		return err
 	}
 
 	defer conn.Close()
 
-	// Server also hijacks the connection, error 'connection closed'
-	// expected.
-	httputil.NewClientConn(conn, nil).Do(req)
-
-	buf := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-
-	// First, send the descriptor for the object we'd like to upload.
-	if err := MarshalDescriptor(buf, desc); err != nil {
-		return fmt.Errorf("unable to encode descriptor: %s", err)
-	}
+	return ros.r.fetchObjects(fetcher, params, desc, progress)
+}
 
-	if err := buf.Flush(); err != nil {
-		return fmt.Errorf("unable to flush descriptor buffer: %s", err)
+func (ros *remoteObjectStore) openFetchSession() (RemoteObjectFetcher, transferParams, io.Closer, error) {
+	conn, rwf, params, err := ros.upgrade("serve-objects")
+	if err != nil {
+		return nil, params, nil, err
 	}
 
-	return ros.r.serveObjects(buf, progress)
+	return newRemoteObjectFetcher(rwf), params, conn, nil
 }
 
-func (r *Repository) HandleReceiveObjects(rw http.ResponseWriter, req *http.Request) {
-	req.ParseForm()
+func (r *Repository) HandleServeObjects(rw http.ResponseWriter, req *http.Request) {
+	conn, rwf, params, err := r.hijackUpgrade(rw, req)
+	if err != nil {
+		log.Printf("unable to upgrade connection: %s", err)
+		return
+	}
 
-	tag := req.Form.Get("tag")
+	defer conn.Close()
 
-	hijacker, ok := rw.(http.Hijacker)
-	if !ok {
-		log.Print("http hijacking not supported")
-		rw.WriteHeader(http.StatusInternalServerError)
-		return
+	if err := r.serveLockedObjects(rwf, params, &ProgressMeter{}); err != nil {
+		log.Printf("unable to serve objects: %s", err)
 	}
+}
 
-	conn, buf, err := hijacker.Hijack()
+func (ros *remoteObjectStore) Push(tag string, desc, expected Descriptor, force bool, progress *ProgressMeter) error {
+	conn, rwf, params, err := ros.upgrade("receive-objects")
 	if err != nil {
-		log.Printf("unable to hijack connection :%s", err)
-		rw.WriteHeader(http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	defer conn.Close()
 
-	fmt.Fprint(conn, "HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	return ros.r.sendPush(rwf, params, tag, desc, expected, force, progress)
+}
 
-	// First, read a descriptor for the object that the remote would like
-	// to upload.
-	desc, err := UnmarshalDescriptor(buf)
+func (r *Repository) HandleReceiveObjects(rw http.ResponseWriter, req *http.Request) {
+	conn, rwf, params, err := r.hijackUpgrade(rw, req)
 	if err != nil {
-		log.Printf("unable to read descriptor requested by remote: %s", err)
+		log.Printf("unable to upgrade connection: %s", err)
 		return
 	}
 
-	// Get a remote object fetcher.
-	fetcher := newRemoteObjectFetcher(buf)
-
-	if r.Contains(desc.Digest()) {
-		fetcher.SkipObject(desc)
-		return
-	}
+	defer conn.Close()
 
-	if err := r.fetchObjects(fetcher, desc, &ProgressMeter{}); err != nil {
-		log.Printf("unable to fetch objects: %s", err)
+	if err := r.receivePush(rwf, params, &ProgressMeter{}); err != nil {
+		log.Printf("unable to receive push: %s", err)
 	}
-
-	r.TagStore().Set(tag, desc)
 }
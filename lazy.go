@@ -0,0 +1,327 @@
+package stemma
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// fetchSessionOpener is implemented by remote object stores which are able to
+// open a session for fetching individual objects.
+type fetchSessionOpener interface {
+	openFetchSession() (RemoteObjectFetcher, transferParams, io.Closer, error)
+}
+
+// LazyObjectStore is an object store backed by a local repository which
+// fetches objects that are missing from the repository from a remote on first
+// access. Fetched headers and files are verified and stored in the local
+// repository. Fetched applications and directories are verified but only kept
+// in memory as the repository must not contain an object unless it also
+// contains all of that object's dependencies.
+type LazyObjectStore struct {
+	*Repository
+	remote RemoteObjectStore
+	opener fetchSessionOpener
+
+	mu sync.Mutex
+	// Descriptors of the objects which may be fetched, keyed by hex
+	// digest. Only objects referenced by the root object or by an object
+	// which has already been fetched can be fetched as the remote
+	// protocol requires the size of an object in order to fetch it.
+	known        map[string]Descriptor
+	applications map[string]Application
+	directories  map[string]Directory
+
+	// A single session is used for fetching objects one at a time.
+	sessionMu sync.Mutex
+	fetcher   RemoteObjectFetcher
+	params    transferParams
+	conn      io.Closer
+}
+
+var _ ObjectStore = &LazyObjectStore{}
+
+// NewLazyObjectStore returns an object store which fetches objects reachable
+// from the given root descriptor from the given remote as they are accessed.
+// The returned store should be closed when it is no longer needed.
+func (r *Repository) NewLazyObjectStore(remote RemoteObjectStore, root Descriptor) (*LazyObjectStore, error) {
+	opener, ok := remote.(fetchSessionOpener)
+	if !ok {
+		return nil, fmt.Errorf("remote does not support fetching individual objects")
+	}
+
+	return &LazyObjectStore{
+		Repository:   r,
+		remote:       remote,
+		opener:       opener,
+		known:        map[string]Descriptor{root.Digest().Hex(): root},
+		applications: map[string]Application{},
+		directories:  map[string]Directory{},
+	}, nil
+}
+
+// Prefetch fetches the object with the given descriptor and all of its
+// dependencies into the local repository using a separate session from the
+// one used to fetch objects on demand. Objects which have already been
+// fetched on demand are skipped. Once complete, applications and directories
+// held in memory are served from the local repository instead.
+func (ls *LazyObjectStore) Prefetch(desc Descriptor, progress *ProgressMeter) error {
+	if err := ls.remote.Fetch(desc, progress); err != nil {
+		return err
+	}
+
+	ls.mu.Lock()
+	ls.applications = map[string]Application{}
+	ls.directories = map[string]Directory{}
+	ls.mu.Unlock()
+
+	return nil
+}
+
+// Close ends the current fetch session, if any.
+func (ls *LazyObjectStore) Close() error {
+	ls.sessionMu.Lock()
+	defer ls.sessionMu.Unlock()
+
+	return ls.closeSession()
+}
+
+// GetHeader gets the header object with the given digest, fetching it from
+// the remote if it is not in the local repository.
+func (ls *LazyObjectStore) GetHeader(digest Digest) (header Header, err error) {
+	if err := ls.ensureLocal(digest); err != nil {
+		return header, err
+	}
+
+	return ls.Repository.GetHeader(digest)
+}
+
+// GetFile gets the file object with the given digest, fetching it from the
+// remote if it is not in the local repository.
+func (ls *LazyObjectStore) GetFile(digest Digest) (ReadSeekCloser, error) {
+	if err := ls.ensureLocal(digest); err != nil {
+		return nil, err
+	}
+
+	return ls.Repository.GetFile(digest)
+}
+
+// GetDirectory gets the directory object with the given digest, fetching it
+// from the remote if it is not in the local repository.
+func (ls *LazyObjectStore) GetDirectory(digest Digest) (Directory, error) {
+	if ls.Repository.Contains(digest) {
+		return ls.Repository.GetDirectory(digest)
+	}
+
+	ls.mu.Lock()
+	dir, ok := ls.directories[digest.Hex()]
+	ls.mu.Unlock()
+
+	if ok {
+		return dir, nil
+	}
+
+	data, err := ls.fetchObjectData(digest, ObjectTypeDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err = UnmarshalDirectory(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode directory object: %s", err)
+	}
+
+	ls.mu.Lock()
+	ls.directories[digest.Hex()] = dir
+	ls.addKnown(dir.Dependencies())
+	ls.mu.Unlock()
+
+	return dir, nil
+}
+
+// GetApplication gets the application object with the given digest, fetching
+// it from the remote if it is not in the local repository.
+func (ls *LazyObjectStore) GetApplication(digest Digest) (a Application, err error) {
+	if ls.Repository.Contains(digest) {
+		return ls.Repository.GetApplication(digest)
+	}
+
+	ls.mu.Lock()
+	a, ok := ls.applications[digest.Hex()]
+	ls.mu.Unlock()
+
+	if ok {
+		return a, nil
+	}
+
+	data, err := ls.fetchObjectData(digest, ObjectTypeApplication)
+	if err != nil {
+		return a, err
+	}
+
+	a, err = UnmarshalApplication(bytes.NewReader(data))
+	if err != nil {
+		return a, fmt.Errorf("unable to decode application object: %s", err)
+	}
+
+	ls.mu.Lock()
+	ls.applications[digest.Hex()] = a
+	ls.addKnown(a.Dependencies())
+	ls.mu.Unlock()
+
+	return a, nil
+}
+
+// addKnown records the given descriptors as fetchable. The caller must hold
+// the mutex.
+func (ls *LazyObjectStore) addKnown(descriptors []Descriptor) {
+	for _, desc := range descriptors {
+		ls.known[desc.Digest().Hex()] = desc
+	}
+}
+
+// descriptor returns the known descriptor for the given digest.
+func (ls *LazyObjectStore) descriptor(digest Digest) (Descriptor, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	desc, ok := ls.known[digest.Hex()]
+	if !ok {
+		return nil, fmt.Errorf("unable to fetch object %s: object is not referenced by any fetched object", digest)
+	}
+
+	return desc, nil
+}
+
+// ensureLocal fetches the object with the given digest into the local
+// repository if it is not already there. This must only be used for objects
+// which have no dependencies.
+func (ls *LazyObjectStore) ensureLocal(digest Digest) error {
+	if ls.Repository.Contains(digest) {
+		return nil
+	}
+
+	desc, err := ls.descriptor(digest)
+	if err != nil {
+		return err
+	}
+
+	if desc.Type() != ObjectTypeHeader && desc.Type() != ObjectTypeFile {
+		return fmt.Errorf("unable to fetch object %s: %s objects may not be stored without their dependencies", digest, desc.Type())
+	}
+
+	return ls.fetch(desc, func(remoteObject io.Reader) error {
+		// Another caller may have fetched this object while we were
+		// waiting for the session.
+		if ls.Repository.Contains(digest) {
+			_, err := io.Copy(ioutil.Discard, remoteObject)
+			return err
+		}
+
+		tempRef, _, err := ls.Repository.receiveObject(remoteObject, desc, nil)
+		if err != nil {
+			return fmt.Errorf("unable to copy remote object %s to local store: %s", digest.Hex(), err)
+		}
+
+		if _, err := tempRef.Commit(); err != nil {
+			return fmt.Errorf("unable to commit object to local store: %s", err)
+		}
+
+		return nil
+	})
+}
+
+// fetchObjectData fetches the object with the given digest, which must be of
+// the given type, and returns its verified contents without storing it.
+func (ls *LazyObjectStore) fetchObjectData(digest Digest, objectType ObjectType) ([]byte, error) {
+	desc, err := ls.descriptor(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	if desc.Type() != objectType {
+		return nil, fmt.Errorf("unable to fetch object %s: object is a %s not a %s", digest, desc.Type(), objectType)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, desc.Size()))
+
+	err = ls.fetch(desc, func(remoteObject io.Reader) error {
+		digester, err := NewDigester(digest.Algorithm())
+		if err != nil {
+			return fmt.Errorf("unable to create object digester: %s", err)
+		}
+
+		// The object type is included in the digest of an object.
+		if err := objectType.Marshal(digester); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(io.MultiWriter(buf, digester), remoteObject); err != nil {
+			return fmt.Errorf("unable to copy all bytes from object: %s", err)
+		}
+
+		if !digester.Digest().Equals(digest) {
+			return fmt.Errorf("digest mismatch: %s", digester.Digest().Hex())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// fetch requests the object with the given descriptor using the current
+// fetch session, opening a new session if needed, and calls receive with a
+// reader for the object's contents. If any error occurs the session is
+// closed so that a new one is opened for the next object.
+func (ls *LazyObjectStore) fetch(desc Descriptor, receive func(remoteObject io.Reader) error) error {
+	ls.sessionMu.Lock()
+	defer ls.sessionMu.Unlock()
+
+	if ls.fetcher == nil {
+		fetcher, params, conn, err := ls.opener.openFetchSession()
+		if err != nil {
+			return fmt.Errorf("unable to open fetch session: %s", err)
+		}
+
+		ls.fetcher, ls.params, ls.conn = fetcher, params, conn
+	}
+
+	if !ls.params.supportsDigestAlg(desc.Digest().Algorithm()) {
+		return fmt.Errorf("unable to fetch object %s: unsupported digest algorithm %s", desc.Digest(), desc.Digest().Algorithm())
+	}
+
+	if err := ls.fetcher.RequestObject(desc); err != nil {
+		ls.closeSession()
+		return fmt.Errorf("unable to request object %s: %s", desc.Digest(), err)
+	}
+
+	if err := receive(ls.fetcher.NextObject(desc.Size())); err != nil {
+		ls.closeSession()
+		return err
+	}
+
+	return nil
+}
+
+// closeSession ends the current fetch session, if any. The caller must hold
+// the session mutex.
+func (ls *LazyObjectStore) closeSession() error {
+	if ls.fetcher == nil {
+		return nil
+	}
+
+	err := ls.fetcher.SignalDone()
+	if cerr := ls.conn.Close(); err == nil {
+		err = cerr
+	}
+
+	ls.fetcher, ls.conn = nil, nil
+
+	return err
+}
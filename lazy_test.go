@@ -0,0 +1,96 @@
+package stemma
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestLazyObjectStore(t *testing.T) {
+	remoteRepo, cleanupRemote := newTestRepository(t)
+	defer cleanupRemote()
+
+	local, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	root := storeTestDirectory(t, remoteRepo, map[string]string{"a": "one", "b": "two"})
+	unknown := storeTestFile(t, remoteRepo, "unknown")
+
+	remote, err := local.RemoteObjectStore("file://" + remoteRepo.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls, err := local.NewLazyObjectStore(remote, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	// Only objects reachable from the root may be fetched.
+	if _, err := ls.GetFile(unknown.Digest()); err == nil {
+		t.Error("expected an error getting an object which is not reachable from the root")
+	}
+
+	dir, err := ls.GetDirectory(root.Digest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Directories are only kept in memory until all of their dependencies
+	// have been fetched.
+	if local.Contains(root.Digest()) {
+		t.Error("directory was committed before its dependencies")
+	}
+
+	entries := map[string]DirectoryEntry{}
+	for _, entry := range dir {
+		entries[entry.Name] = entry
+	}
+
+	a, b := entries["a"], entries["b"]
+
+	if local.Contains(a.ObjectDigest) {
+		t.Fatal("file was fetched before it was opened")
+	}
+
+	file, err := ls.GetFile(a.ObjectDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(contents) != "one" {
+		t.Errorf("lazily fetched file contains %q, expected %q", contents, "one")
+	}
+
+	if !local.Contains(a.ObjectDigest) {
+		t.Error("opened file was not committed to the local repository")
+	}
+
+	if local.Contains(b.ObjectDigest) {
+		t.Error("file which was not opened was fetched")
+	}
+
+	if _, err := ls.GetHeader(a.HeaderDigest); err != nil {
+		t.Fatal(err)
+	}
+
+	if !local.Contains(a.HeaderDigest) {
+		t.Error("header was not committed to the local repository")
+	}
+
+	if err := ls.Prefetch(root, &ProgressMeter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, digest := range []Digest{root.Digest(), b.ObjectDigest, b.HeaderDigest} {
+		if !local.Contains(digest) {
+			t.Errorf("object %s is missing after prefetching", digest)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package stemma
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jlhawn/stemma/sysutil"
+)
+
+// ErrNoSuchMount is returned when there is no mount recorded for a
+// mountpoint.
+var ErrNoSuchMount = errors.New("no such mount")
+
+type mountSet struct {
+	root string
+}
+
+// NewMountSet creates a new mount set using the given root directory.
+func NewMountSet(root string) (MountSet, error) {
+	if fi, err := os.Stat(root); err != nil {
+		return nil, fmt.Errorf("unable to stat directory %q: %s", root, err)
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("unable to use directory %q: not a directory", root)
+	}
+
+	return &mountSet{root: root}, nil
+}
+
+// getPath returns the path of the file recording the mount on the given
+// mountpoint. Mountpoints may contain any characters so the file is named
+// using the digest of the mountpoint.
+func (s *mountSet) getPath(mountpoint string) (string, error) {
+	digester, err := NewDigester(DigestAlgSHA512_256)
+	if err != nil {
+		return "", fmt.Errorf("unable to create mountpoint digester: %s", err)
+	}
+
+	io.WriteString(digester, mountpoint)
+
+	return filepath.Join(s.root, digester.Digest().Hex()), nil
+}
+
+func (s *mountSet) List() (mounts []Mount, err error) {
+	mountsDir, err := os.Open(s.root)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open mounts directory: %s", err)
+	}
+	defer mountsDir.Close()
+
+	names, err := mountsDir.Readdirnames(0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read mounts directory: %s", err)
+	}
+
+	mounts = make([]Mount, 0, len(names))
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") {
+			// Temporary file for a mount being added.
+			continue
+		}
+
+		mount, err := s.read(filepath.Join(s.root, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed since listing the directory.
+				continue
+			}
+
+			return nil, err
+		}
+
+		mounts = append(mounts, mount)
+	}
+
+	return mounts, nil
+}
+
+func (s *mountSet) Get(mountpoint string) (Mount, error) {
+	path, err := s.getPath(mountpoint)
+	if err != nil {
+		return Mount{}, err
+	}
+
+	mount, err := s.read(path)
+	if os.IsNotExist(err) {
+		return Mount{}, ErrNoSuchMount
+	}
+
+	return mount, err
+}
+
+func (s *mountSet) read(path string) (Mount, error) {
+	mountFile, err := os.Open(path)
+	if err != nil {
+		return Mount{}, err
+	}
+	defer mountFile.Close()
+
+	return unmarshalMount(mountFile)
+}
+
+// Add records the given mount, replacing any mount previously recorded for
+// the same mountpoint. The record is written to a temporary file and renamed
+// into place so that it is never seen partially written.
+func (s *mountSet) Add(mount Mount) error {
+	if !filepath.IsAbs(mount.Mountpoint) {
+		return fmt.Errorf("mountpoint %q is not an absolute path", mount.Mountpoint)
+	}
+
+	path, err := s.getPath(mount.Mountpoint)
+	if err != nil {
+		return err
+	}
+
+	tempPath := filepath.Join(s.root, "."+filepath.Base(path))
+
+	mountFile, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0644))
+	if err != nil {
+		return fmt.Errorf("unable to open mount file: %s", err)
+	}
+
+	err = marshalMount(mountFile, mount)
+	if cerr := mountFile.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("unable to write mount file: %s", err)
+	}
+
+	return nil
+}
+
+func (s *mountSet) Remove(mountpoint string) error {
+	path, err := s.getPath(mountpoint)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNoSuchMount
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Active returns whether the process serving this mount is still running. A
+// mount which is not active is stale and may be removed.
+func (m Mount) Active() bool {
+	return sysutil.ProcessExists(m.PID)
+}
+
+func marshalMount(w io.Writer, mount Mount) error {
+	if err := marshalBytes(w, []byte(mount.Mountpoint)); err != nil {
+		return fmt.Errorf("unable to encode mountpoint: %s", err)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, uint32(mount.PID)); err != nil {
+		return fmt.Errorf("unable to encode mount process ID: %s", err)
+	}
+
+	if err := mount.Digest.Marshal(w); err != nil {
+		return fmt.Errorf("unable to encode mount digest: %s", err)
+	}
+
+	return nil
+}
+
+func unmarshalMount(r io.Reader) (mount Mount, err error) {
+	mountpoint, err := unmarshalBytes(r)
+	if err != nil {
+		return mount, fmt.Errorf("unable to decode mountpoint: %s", err)
+	}
+
+	var pid uint32
+	if err := binary.Read(r, binary.LittleEndian, &pid); err != nil {
+		return mount, fmt.Errorf("unable to decode mount process ID: %s", err)
+	}
+
+	digest, err := UnmarshalDigest(r)
+	if err != nil {
+		return mount, fmt.Errorf("unable to decode mount digest: %s", err)
+	}
+
+	// A mount of every application is recorded with an empty digest.
+	if len(digest) == 0 {
+		digest = nil
+	}
+
+	return Mount{
+		Mountpoint: string(mountpoint),
+		PID:        int(pid),
+		Digest:     digest,
+	}, nil
+}
@@ -0,0 +1,36 @@
+package stemma
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMountMarshalRoundTrip(t *testing.T) {
+	digester, err := NewDigester(DigestAlgSHA512_256)
+	if err != nil {
+		t.Fatalf("unable to create digester: %s", err)
+	}
+
+	for _, mount := range []Mount{
+		{Mountpoint: "/mnt/app", PID: 42, Digest: digester.Digest()},
+		{Mountpoint: "/mnt/all", PID: 43},
+	} {
+		var buf bytes.Buffer
+		if err := marshalMount(&buf, mount); err != nil {
+			t.Fatalf("unable to marshal mount: %s", err)
+		}
+
+		decoded, err := unmarshalMount(&buf)
+		if err != nil {
+			t.Fatalf("unable to unmarshal mount: %s", err)
+		}
+
+		if decoded.Mountpoint != mount.Mountpoint || decoded.PID != mount.PID {
+			t.Errorf("got mount %+v, expected %+v", decoded, mount)
+		}
+
+		if (decoded.Digest == nil) != (mount.Digest == nil) || !bytes.Equal(decoded.Digest, mount.Digest) {
+			t.Errorf("got digest %#v, expected %#v", decoded.Digest, mount.Digest)
+		}
+	}
+}
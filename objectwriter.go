@@ -15,12 +15,27 @@ type objectWriter struct {
 	digester     Digester
 	objectType   ObjectType
 	bytesWritten uint64
+
+	// If set, the object is synced as part of this batch when it is
+	// committed rather than on its own.
+	batch *syncBatch
+	// Dependencies of the object which the batch must move into place
+	// before it.
+	deps []Descriptor
 }
 
 var _ FileWriter = &objectWriter{}
 
+// newObjectWriter returns a writer for a new object of the given type which
+// is digested using this repository's configured digest algorithm.
 func (r *Repository) newObjectWriter(objectType ObjectType) (*objectWriter, error) {
-	digester, err := NewDigester(DigestAlgSHA512_256)
+	return r.newObjectWriterAlg(objectType, r.config.DigestAlg)
+}
+
+// newObjectWriterAlg returns a writer for a new object of the given type
+// which is digested using the given algorithm.
+func (r *Repository) newObjectWriterAlg(objectType ObjectType, alg DigestAlg) (*objectWriter, error) {
+	digester, err := NewDigester(alg)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create new object digester: %s", err)
 	}
@@ -72,6 +87,12 @@ func (w *objectWriter) Hold() (tr TempRef, err error) {
 		return nil, fmt.Errorf("unable to flush write buffer: %s", err)
 	}
 
+	if w.batch == nil && w.r.config.Durability != DurabilityNone {
+		if err := w.tempFile.Sync(); err != nil {
+			return nil, fmt.Errorf("unable to sync temporary file: %s", err)
+		}
+	}
+
 	if err := w.tempFile.Close(); err != nil {
 		return nil, fmt.Errorf("unable to close temporary file: %s", err)
 	}
@@ -86,6 +107,9 @@ func (w *objectWriter) Hold() (tr TempRef, err error) {
 		},
 		tempPath:        w.tempFile.Name(),
 		destinationPath: w.r.getObjectPath(digest),
+		r:               w.r,
+		batch:           w.batch,
+		deps:            w.deps,
 	}, nil
 }
 
@@ -115,20 +139,67 @@ type tempRef struct {
 	desc            Descriptor
 	tempPath        string
 	destinationPath string
+	r               *Repository
+	batch           *syncBatch
+	deps            []Descriptor
 }
 
 func (tr *tempRef) Descriptor() Descriptor {
 	return tr.desc
 }
 
+// Commit moves the object into place in the object store. Depending on the
+// durability mode of the repository, the object is synced to stable storage
+// first. If the object belongs to a sync batch, it is only moved into place
+// once the batch is flushed.
 func (tr *tempRef) Commit() (d Descriptor, err error) {
+	if tr.batch != nil {
+		if err := tr.batch.add(tr); err != nil {
+			return nil, err
+		}
+
+		return tr.desc, nil
+	}
+
 	defer func() {
 		if err != nil {
 			os.Remove(tr.tempPath)
 		}
 	}()
 
+	syncDirs, err := tr.moveIntoPlace()
+	if err != nil {
+		return nil, err
+	}
+
+	if tr.r.config.Durability == DurabilityFileAndDir {
+		for _, dir := range syncDirs {
+			if err := syncDir(dir); err != nil {
+				return nil, fmt.Errorf("unable to sync object directory: %s", err)
+			}
+		}
+	}
+
+	return tr.desc, nil
+}
+
+// moveIntoPlace moves the temporary file into place as the object file
+// unless an object with the same digest already exists. It returns the
+// directories which must be synced for the new object file to survive a
+// crash.
+func (tr *tempRef) moveIntoPlace() (syncDirs []string, err error) {
 	_, err = os.Lstat(tr.destinationPath)
+	if os.IsNotExist(err) {
+		packed, packErr := tr.r.packs.contains(tr.desc.Digest())
+		if packErr != nil {
+			return nil, packErr
+		}
+
+		if packed {
+			err = nil
+		}
+	}
+
 	switch {
 	case err == nil:
 		// An object with this digest already exists.
@@ -137,8 +208,8 @@ func (tr *tempRef) Commit() (d Descriptor, err error) {
 		}
 	case os.IsNotExist(err):
 		// Create the object directory if it doesn't already exist.
-		objectDir := filepath.Dir(tr.destinationPath)
-		if err := os.MkdirAll(objectDir, os.FileMode(0755)); err != nil {
+		syncDirs, err = makeObjectDir(filepath.Dir(tr.destinationPath))
+		if err != nil {
 			return nil, fmt.Errorf("unable to make object directory: %s", err)
 		}
 
@@ -151,7 +222,7 @@ func (tr *tempRef) Commit() (d Descriptor, err error) {
 		return nil, fmt.Errorf("unable to stat object path: %s", err)
 	}
 
-	return tr.desc, nil
+	return syncDirs, nil
 }
 
 // offsetSeekWrapper is used to wrap file objects so that seeking never reads
@@ -184,7 +255,24 @@ func (osw *offsetSeekWrapper) Seek(offset int64, whence int) (newOffset int64, e
 	return osw.ReadSeekCloser.Seek(osw.relOffset, os.SEEK_SET)
 }
 
+// offsetReaderAtWrapper is an offsetSeekWrapper for files which support
+// positional reads. It is only used for such files so that callers may
+// decide whether positional reads are supported with a type assertion.
+type offsetReaderAtWrapper struct {
+	*offsetSeekWrapper
+	readerAt io.ReaderAt
+}
+
+// ReadAt reads from the given offset relative to our relative offset without
+// changing the current offset. This allows concurrent reads from the same
+// file without racing on seeks.
+func (orw *offsetReaderAtWrapper) ReadAt(p []byte, offset int64) (n int, err error) {
+	return orw.readerAt.ReadAt(p, offset+orw.relOffset)
+}
+
 // GetFile opens the file object with the given digest from this repository.
+// The returned file implements io.ReaderAt if the object file supports
+// positional reads.
 func (r *Repository) GetFile(digest Digest) (ReadSeekCloser, error) {
 	object, err := r.getObjectFile(digest)
 	if err != nil {
@@ -196,10 +284,19 @@ func (r *Repository) GetFile(digest Digest) (ReadSeekCloser, error) {
 		return nil, err
 	}
 
-	return &offsetSeekWrapper{
+	wrapper := &offsetSeekWrapper{
 		ReadSeekCloser: object,
 		relOffset:      EncodedObjectTypeSize,
-	}, nil
+	}
+
+	if readerAt, ok := object.(io.ReaderAt); ok {
+		return &offsetReaderAtWrapper{
+			offsetSeekWrapper: wrapper,
+			readerAt:          readerAt,
+		}, nil
+	}
+
+	return wrapper, nil
 }
 
 // NewFileWriter begins the process of writing a new file in this repository.
@@ -0,0 +1,546 @@
+package stemma
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PackVersion is the version of the pack and pack index file formats written
+// by this package.
+const PackVersion = 1
+
+// DefaultPackMaxObjectSize is the size of the largest loose object which is
+// moved into a pack by default. Header objects and small files make up most
+// objects but little of the total size of a repository.
+const DefaultPackMaxObjectSize = 16 * 1024
+
+var (
+	// packMagic begins every pack file.
+	packMagic = []byte("STEMMA-PACK")
+	// packIndexMagic begins every pack index file.
+	packIndexMagic = []byte("STEMMA-PACK-INDEX")
+)
+
+/*
+Pack Layout:
+
+	magic            "STEMMA-PACK"
+	version          uint16
+	objects          the object files, each beginning with its object type
+	                 byte, one after another.
+
+Pack Index Layout:
+
+	magic            "STEMMA-PACK-INDEX"
+	version          uint16
+	entries          uint32 count, followed by that many entries sorted by
+	                 digest, each an object digest and its uint64 offset
+	                 and uint64 length in the pack.
+
+A pack named pack-<hex>.pack, where <hex> is the hex digest of the pack, is
+stored in objects/pack/ along with its index, pack-<hex>.idx. Packs are
+written once and never modified. The index is written after the pack so a
+pack is only used once it is complete.
+
+*/
+
+type packIndexEntry struct {
+	digest Digest
+	offset uint64
+	length uint64
+}
+
+// packIndex is the index of a single pack.
+type packIndex struct {
+	packPath string
+	// Entries sorted by digest.
+	entries []packIndexEntry
+}
+
+// find returns the index entry for the object with the given digest.
+func (idx *packIndex) find(digest Digest) (packIndexEntry, bool) {
+	i := sort.Search(len(idx.entries), func(i int) bool {
+		return bytes.Compare(idx.entries[i].digest, digest) >= 0
+	})
+
+	if i < len(idx.entries) && idx.entries[i].digest.Equals(digest) {
+		return idx.entries[i], true
+	}
+
+	return packIndexEntry{}, false
+}
+
+// packRescanInterval is the least time between scans of the pack directory
+// for objects which are only checked for. Objects which are opened always
+// scan again when they are not found in the known packs.
+const packRescanInterval = time.Second
+
+// packSet is the set of packs in a repository. Packs may be added by other
+// processes at any time, so the pack directory is scanned again when an
+// object is not found in the known packs, and the index of any pack which
+// was not known before is loaded. Most objects which are only checked for
+// are new to the repository, so such misses scan at most once every
+// packRescanInterval.
+type packSet struct {
+	dir string
+
+	indexes []*packIndex
+	loaded  map[string]bool // Names of loaded index files.
+	scanned time.Time       // When the pack directory was last scanned.
+
+	sync.Mutex
+}
+
+func newPackSet(dir string) *packSet {
+	return &packSet{
+		dir:    dir,
+		loaded: map[string]bool{},
+	}
+}
+
+// find returns the pack index which contains the object with the given
+// digest and its entry. If the object is not in the known packs, the pack
+// directory is scanned again unless it was scanned within the given
+// interval.
+func (ps *packSet) find(digest Digest, rescanInterval time.Duration) (*packIndex, packIndexEntry, bool, error) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	for _, idx := range ps.indexes {
+		if entry, ok := idx.find(digest); ok {
+			return idx, entry, true, nil
+		}
+	}
+
+	if rescanInterval > 0 && time.Since(ps.scanned) < rescanInterval {
+		return nil, packIndexEntry{}, false, nil
+	}
+
+	numIndexes := len(ps.indexes)
+	if err := ps.scan(); err != nil {
+		return nil, packIndexEntry{}, false, fmt.Errorf("unable to scan packs: %s", err)
+	}
+
+	for _, idx := range ps.indexes[numIndexes:] {
+		if entry, ok := idx.find(digest); ok {
+			return idx, entry, true, nil
+		}
+	}
+
+	return nil, packIndexEntry{}, false, nil
+}
+
+// contains returns whether the object with the given digest is in a pack.
+// An object in a pack added by another process may be missed until the
+// pack directory is next scanned.
+func (ps *packSet) contains(digest Digest) (bool, error) {
+	_, _, ok, err := ps.find(digest, packRescanInterval)
+	return ok, err
+}
+
+// open opens the object with the given digest from the pack which contains
+// it. It returns false if no pack contains the object.
+func (ps *packSet) open(digest Digest) (ReadSeekCloser, bool, error) {
+	idx, entry, ok, err := ps.find(digest, 0)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	pack, err := os.Open(idx.packPath)
+	if err != nil {
+		return nil, true, fmt.Errorf("unable to open pack: %s", err)
+	}
+
+	return &packedObject{
+		SectionReader: io.NewSectionReader(pack, int64(entry.offset), int64(entry.length)),
+		pack:          pack,
+	}, true, nil
+}
+
+// rescan loads the indexes of any packs which have been added to the pack
+// directory since it was last scanned.
+func (ps *packSet) rescan() error {
+	ps.Lock()
+	defer ps.Unlock()
+
+	if err := ps.scan(); err != nil {
+		return fmt.Errorf("unable to scan packs: %s", err)
+	}
+
+	return nil
+}
+
+// add adds the index of a pack written by this process with the given index
+// file name.
+func (ps *packSet) add(name string, idx *packIndex) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	if !ps.loaded[name] {
+		ps.indexes = append(ps.indexes, idx)
+		ps.loaded[name] = true
+	}
+}
+
+// scan loads the indexes of any packs in the pack directory which have not
+// already been loaded. It must be called with the pack set locked.
+func (ps *packSet) scan() error {
+	ps.scanned = time.Now()
+
+	dir, err := os.Open(ps.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// There are no packs yet.
+			return nil
+		}
+
+		return err
+	}
+
+	names, err := dir.Readdirnames(0)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".idx") || ps.loaded[name] {
+			continue
+		}
+
+		idx, err := readPackIndex(filepath.Join(ps.dir, name))
+		if err != nil {
+			return err
+		}
+
+		ps.indexes = append(ps.indexes, idx)
+		ps.loaded[name] = true
+	}
+
+	return nil
+}
+
+// packedObject is an object file read from a pack.
+type packedObject struct {
+	*io.SectionReader
+	pack *os.File
+}
+
+func (o *packedObject) Close() error {
+	return o.pack.Close()
+}
+
+func readPackIndex(indexPath string) (*packIndex, error) {
+	indexFile, err := os.Open(indexPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open pack index: %s", err)
+	}
+	defer indexFile.Close()
+
+	r := bufio.NewReader(indexFile)
+
+	magic := make([]byte, len(packIndexMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, fmt.Errorf("unable to read pack index magic: %s", err)
+	}
+
+	if !bytes.Equal(magic, packIndexMagic) {
+		return nil, fmt.Errorf("not a pack index file: %s", indexPath)
+	}
+
+	var version uint16
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, fmt.Errorf("unable to decode pack index version: %s", err)
+	}
+
+	if version > PackVersion {
+		return nil, fmt.Errorf("unsupported pack index version %d", version)
+	}
+
+	var numEntries uint32
+	if err := binary.Read(r, binary.LittleEndian, &numEntries); err != nil {
+		return nil, fmt.Errorf("unable to decode number of pack index entries: %s", err)
+	}
+
+	entries := make([]packIndexEntry, numEntries)
+	for i := range entries {
+		if entries[i].digest, err = UnmarshalDigest(r); err != nil {
+			return nil, fmt.Errorf("unable to decode pack index digest: %s", err)
+		}
+
+		if err := binary.Read(r, binary.LittleEndian, &entries[i].offset); err != nil {
+			return nil, fmt.Errorf("unable to decode pack index offset: %s", err)
+		}
+
+		if err := binary.Read(r, binary.LittleEndian, &entries[i].length); err != nil {
+			return nil, fmt.Errorf("unable to decode pack index length: %s", err)
+		}
+	}
+
+	return &packIndex{
+		packPath: strings.TrimSuffix(indexPath, ".idx") + ".pack",
+		entries:  entries,
+	}, nil
+}
+
+func writePackIndex(w io.Writer, entries []packIndexEntry) error {
+	if _, err := w.Write(packIndexMagic); err != nil {
+		return fmt.Errorf("unable to write pack index magic: %s", err)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, uint16(PackVersion)); err != nil {
+		return fmt.Errorf("unable to encode pack index version: %s", err)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(entries))); err != nil {
+		return fmt.Errorf("unable to encode number of pack index entries: %s", err)
+	}
+
+	for _, entry := range entries {
+		if err := entry.digest.Marshal(w); err != nil {
+			return fmt.Errorf("unable to encode pack index digest: %s", err)
+		}
+
+		if err := binary.Write(w, binary.LittleEndian, entry.offset); err != nil {
+			return fmt.Errorf("unable to encode pack index offset: %s", err)
+		}
+
+		if err := binary.Write(w, binary.LittleEndian, entry.length); err != nil {
+			return fmt.Errorf("unable to encode pack index length: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func (r *Repository) getPackDir() string {
+	return filepath.Join(r.root, "objects", "pack")
+}
+
+// looseObject is an object stored in its own file.
+type looseObject struct {
+	digest Digest
+	path   string
+}
+
+// looseObjects returns the loose objects in this repository no larger than
+// the given size, including the object type byte, sorted by digest. A
+// maximum size of 0 includes every loose object.
+func (r *Repository) looseObjects(maxSize int64) ([]looseObject, error) {
+	objectsDir := filepath.Join(r.root, "objects")
+
+	var objects []looseObject
+
+	err := filepath.Walk(objectsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if path == r.getPackDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if maxSize > 0 && info.Size() > maxSize {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(objectsDir, path)
+		if err != nil {
+			return err
+		}
+
+		digest, err := ParseDigest(strings.Replace(relPath, string(filepath.Separator), "", -1))
+		if err != nil {
+			// Not an object file.
+			return nil
+		}
+
+		objects = append(objects, looseObject{digest: digest, path: path})
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to walk objects directory: %s", err)
+	}
+
+	sort.Sort(looseObjectsByDigest(objects))
+
+	return objects, nil
+}
+
+type looseObjectsByDigest []looseObject
+
+func (s looseObjectsByDigest) Len() int           { return len(s) }
+func (s looseObjectsByDigest) Less(i, j int) bool { return bytes.Compare(s[i].digest, s[j].digest) < 0 }
+func (s looseObjectsByDigest) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Repack moves the loose objects in this repository no larger than the given
+// size into a new pack, or every loose object if the size is 0. Loose
+// objects which are already packed are removed. The pack and its index are
+// synced before any loose object is removed. It returns the number of
+// objects moved into the new pack. Acquire an exclusive lock before
+// repacking.
+func (r *Repository) Repack(maxSize int64) (numPacked int, err error) {
+	objects, err := r.looseObjects(maxSize)
+	if err != nil {
+		return 0, err
+	}
+
+	// Load any packs added since the pack directory was last scanned so
+	// that objects which are already packed are not packed again.
+	if err := r.packs.rescan(); err != nil {
+		return 0, err
+	}
+
+	var toPack []looseObject
+	for _, object := range objects {
+		packed, err := r.packs.contains(object.digest)
+		if err != nil {
+			return 0, err
+		}
+
+		if !packed {
+			toPack = append(toPack, object)
+		}
+	}
+
+	if len(toPack) > 0 {
+		if err := r.writePack(toPack); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, object := range objects {
+		if err := os.Remove(object.path); err != nil {
+			return len(toPack), fmt.Errorf("unable to remove loose object %s: %s", object.digest, err)
+		}
+
+		// Remove the object directories once they are empty.
+		dir := filepath.Dir(object.path)
+		for i := 0; i < 3 && os.Remove(dir) == nil; i++ {
+			dir = filepath.Dir(dir)
+		}
+	}
+
+	return len(toPack), nil
+}
+
+// writePack writes a new pack of the given loose objects, sorted by digest,
+// along with its index.
+func (r *Repository) writePack(objects []looseObject) (err error) {
+	tempFile, err := r.tempFile()
+	if err != nil {
+		return fmt.Errorf("unable to get temporary pack file: %s", err)
+	}
+
+	defer func() {
+		tempFile.Close()
+		if err != nil {
+			os.Remove(tempFile.Name())
+		}
+	}()
+
+	digester, err := NewDigester(DigestAlgSHA512_256)
+	if err != nil {
+		return fmt.Errorf("unable to create pack digester: %s", err)
+	}
+
+	buf := bufio.NewWriter(io.MultiWriter(tempFile, digester))
+
+	if _, err := buf.Write(packMagic); err != nil {
+		return fmt.Errorf("unable to write pack magic: %s", err)
+	}
+
+	if err := binary.Write(buf, binary.LittleEndian, uint16(PackVersion)); err != nil {
+		return fmt.Errorf("unable to encode pack version: %s", err)
+	}
+
+	offset := uint64(len(packMagic) + 2)
+	entries := make([]packIndexEntry, 0, len(objects))
+
+	for _, object := range objects {
+		length, err := copyFile(buf, object.path)
+		if err != nil {
+			return fmt.Errorf("unable to copy object %s into pack: %s", object.digest, err)
+		}
+
+		entries = append(entries, packIndexEntry{
+			digest: object.digest,
+			offset: offset,
+			length: uint64(length),
+		})
+
+		offset += uint64(length)
+	}
+
+	if err := buf.Flush(); err != nil {
+		return fmt.Errorf("unable to flush pack: %s", err)
+	}
+
+	if err := tempFile.Sync(); err != nil {
+		return fmt.Errorf("unable to sync pack: %s", err)
+	}
+
+	packDir := r.getPackDir()
+	if err := os.MkdirAll(packDir, os.FileMode(0755)); err != nil {
+		return fmt.Errorf("unable to make pack directory: %s", err)
+	}
+
+	packName := "pack-" + digester.Digest().Hex()
+
+	if err := os.Rename(tempFile.Name(), filepath.Join(packDir, packName+".pack")); err != nil {
+		return fmt.Errorf("unable to move pack into place: %s", err)
+	}
+
+	err = writeFileAtomic(osFS{}, filepath.Join(packDir, packName+".idx"), os.FileMode(0644), func(w io.Writer) error {
+		buf := bufio.NewWriter(w)
+		if err := writePackIndex(buf, entries); err != nil {
+			return err
+		}
+
+		return buf.Flush()
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write pack index: %s", err)
+	}
+
+	for _, dir := range []string{packDir, filepath.Dir(packDir)} {
+		if err := syncDir(dir); err != nil {
+			return fmt.Errorf("unable to sync pack directory: %s", err)
+		}
+	}
+
+	// The objects are looked up in the new pack without waiting for the
+	// pack directory to be scanned again.
+	r.packs.add(packName+".idx", &packIndex{
+		packPath: filepath.Join(packDir, packName+".pack"),
+		entries:  entries,
+	})
+
+	return nil
+}
+
+// copyFile copies the contents of the file at the given path to the given
+// writer.
+func copyFile(w io.Writer, path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return io.Copy(w, file)
+}
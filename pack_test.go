@@ -0,0 +1,241 @@
+package stemma
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRepository returns a repository in a new temporary directory.
+func newTestRepository(t *testing.T) (*Repository, func()) {
+	root, err := ioutil.TempDir("", "stemma-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := InitRepository(root, DefaultConfig)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+
+	return repo, func() { os.RemoveAll(root) }
+}
+
+// storeTestFile stores a file with the given contents in the given
+// repository.
+func storeTestFile(t *testing.T, repo *Repository, contents string) Descriptor {
+	fileWriter, err := repo.NewFileWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fileWriter.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	}
+
+	desc, err := fileWriter.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return desc
+}
+
+func TestPackSetFindsPacksWithUnchangedModTime(t *testing.T) {
+	repo, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	first := storeTestFile(t, repo, "first")
+	if _, err := repo.Repack(DefaultPackMaxObjectSize); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process has the first pack loaded.
+	other, err := NewRepository(repo.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !other.Contains(first.Digest()) {
+		t.Fatal("packed object not found")
+	}
+
+	packDir := filepath.Join(repo.root, "objects", "pack")
+	fi, err := os.Stat(packDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := storeTestFile(t, repo, "second")
+	if _, err := repo.Repack(DefaultPackMaxObjectSize); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second pack added within the timestamp granularity of the file
+	// system leaves the modification time of the directory unchanged.
+	if err := os.Chtimes(packDir, time.Now(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening an object always scans for new packs when it is missing.
+	object, err := other.getObjectFile(second.Digest())
+	if err != nil {
+		t.Fatalf("unable to open object in new pack: %s", err)
+	}
+	object.Close()
+
+	if !other.Contains(second.Digest()) {
+		t.Error("object in new pack not found")
+	}
+}
+
+func TestPackSetScanErrors(t *testing.T) {
+	repo, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	storeTestFile(t, repo, "packed")
+	if _, err := repo.Repack(DefaultPackMaxObjectSize); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := testDescriptor(t, "missing").Digest()
+
+	if _, err := repo.getObjectFile(missing); !os.IsNotExist(err) {
+		t.Fatalf("got error %v for missing object, expected it not to exist", err)
+	}
+
+	bogusIndex := filepath.Join(repo.root, "objects", "pack", "pack-bogus.idx")
+	if err := ioutil.WriteFile(bogusIndex, []byte("not an index"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Objects which are only checked for do not scan the pack directory
+	// again so soon.
+	if _, err := repo.packs.contains(missing); err != nil {
+		t.Errorf("unexpected error checking for an object within the rescan interval: %s", err)
+	}
+
+	repo.packs.scanned = time.Time{}
+
+	if _, err := repo.packs.contains(missing); err == nil {
+		t.Error("expected an error scanning a bad pack index")
+	}
+
+	if _, err := repo.getObjectFile(missing); err == nil || os.IsNotExist(err) {
+		t.Errorf("got error %v, expected an error scanning a bad pack index", err)
+	}
+}
+
+// readTestObject returns the contents of the object file with the given
+// digest and the contents which are sent to a remote for it.
+func readTestObject(t *testing.T, repo *Repository, digest Digest) (object, sent []byte) {
+	file, err := repo.getObjectFile(digest)
+	if err != nil {
+		t.Fatalf("unable to open object %s: %s", digest, err)
+	}
+
+	object, err = ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("unable to read object %s: %s", digest, err)
+	}
+
+	var buf bytes.Buffer
+	wf := bufio.NewWriter(&buf)
+	if err := repo.sendObject(wf, &ProgressMeter{}, digest); err != nil {
+		t.Fatalf("unable to send object %s: %s", digest, err)
+	}
+
+	return object, buf.Bytes()
+}
+
+func TestRepackRoundTrip(t *testing.T) {
+	repo, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	files := map[string]string{
+		"a":     "one",
+		"b":     "two",
+		"empty": "",
+		"large": strings.Repeat("large", DefaultPackMaxObjectSize),
+	}
+
+	root := storeTestDirectory(t, repo, files)
+
+	objects, err := repo.looseObjects(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := make(map[string][2][]byte, len(objects))
+	for _, object := range objects {
+		objectContents, sent := readTestObject(t, repo, object.digest)
+		contents[object.digest.Hex()] = [2][]byte{objectContents, sent}
+	}
+
+	numPacked, err := repo.Repack(DefaultPackMaxObjectSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if numPacked != len(objects)-1 {
+		t.Errorf("packed %d objects, expected all %d but the large file", numPacked, len(objects)-1)
+	}
+
+	// Objects are read the same from the packs by this repository and by
+	// another process which has not loaded them yet.
+	other, err := NewRepository(repo.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, r := range map[string]*Repository{"repacked": repo, "reopened": other} {
+		for _, object := range objects {
+			if !r.Contains(object.digest) {
+				t.Errorf("%s: object %s is missing", name, object.digest)
+				continue
+			}
+
+			objectContents, sent := readTestObject(t, r, object.digest)
+			expected := contents[object.digest.Hex()]
+
+			if !bytes.Equal(objectContents, expected[0]) {
+				t.Errorf("%s: object %s contains %q, expected %q", name, object.digest, objectContents, expected[0])
+			}
+
+			if !bytes.Equal(sent, expected[1]) {
+				t.Errorf("%s: object %s was sent as %q, expected %q", name, object.digest, sent, expected[1])
+			}
+		}
+
+		dir, err := r.GetDirectory(root.Digest())
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		for _, entry := range dir {
+			if got := readTestFile(t, r, entry.ObjectDigest); got != files[entry.Name] {
+				t.Errorf("%s: file %q contains %q, expected %q", name, entry.Name, got, files[entry.Name])
+			}
+		}
+
+		if len(dir) != len(files) {
+			t.Errorf("%s: directory has %d entries, expected %d", name, len(dir), len(files))
+		}
+	}
+
+	remaining, err := repo.looseObjects(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(remaining) != 1 {
+		t.Errorf("%d loose objects remain, expected only the large file", len(remaining))
+	}
+}
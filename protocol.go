@@ -0,0 +1,310 @@
+package stemma
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ProtocolVersion is the version of the object transfer protocol spoken by
+// this package. Version 0 is the original protocol which has no handshake.
+const ProtocolVersion = 1
+
+// protocolMagic begins every handshake message so that a peer which is not
+// speaking the same protocol is detected early.
+var protocolMagic = []byte("STMA")
+
+// Transfer window sizes. The window is the maximum number of objects which
+// may be requested from a remote before it has sent them.
+const (
+	legacyTransferWindow = 256
+	maxTransferWindow    = 4096
+)
+
+// transferCompression is used to indicate how a transfer stream is
+// compressed once the handshake is complete.
+type transferCompression byte
+
+// Supported transfer stream compression methods.
+const (
+	transferCompressionNone transferCompression = iota
+	transferCompressionFlate
+)
+
+// transferCompressionNames maps the names used in repository configs to
+// transfer stream compression methods.
+var transferCompressionNames = map[string]transferCompression{
+	"none":  transferCompressionNone,
+	"flate": transferCompressionFlate,
+}
+
+// offeredCompressions returns the transfer compression methods offered in
+// order of preference by a repository which prefers the named method. No
+// compression is always offered as a fallback.
+func offeredCompressions(preferred string) []transferCompression {
+	compression, ok := transferCompressionNames[preferred]
+	if !ok || compression == transferCompressionNone {
+		return []transferCompression{transferCompressionNone}
+	}
+
+	return []transferCompression{compression, transferCompressionNone}
+}
+
+// transferHello is exchanged by both ends of a transfer stream before any
+// descriptors or objects are sent.
+type transferHello struct {
+	version      uint16
+	window       uint32
+	compressions []transferCompression
+	digestAlgs   []DigestAlg
+}
+
+// transferParams are the parameters agreed on by both ends of a transfer
+// stream.
+type transferParams struct {
+	version     uint16
+	window      int
+	compression transferCompression
+	digestAlgs  []DigestAlg
+}
+
+// legacyTransferParams are used when the remote does not support the
+// handshake.
+var legacyTransferParams = transferParams{
+	version:     0,
+	window:      legacyTransferWindow,
+	compression: transferCompressionNone,
+	digestAlgs:  []DigestAlg{DigestAlgSHA512_256},
+}
+
+// supportsDigestAlg returns whether objects with digests of the given
+// algorithm may be transferred.
+func (p transferParams) supportsDigestAlg(alg DigestAlg) bool {
+	for _, supported := range p.digestAlgs {
+		if alg == supported {
+			return true
+		}
+	}
+
+	return false
+}
+
+// localDigestAlgs returns all registered digest algorithms in order.
+func localDigestAlgs() []DigestAlg {
+	digestAlgs := make([]DigestAlg, 0, len(registeredDigestAlgs))
+	for alg := DigestAlg(0); alg < DigestAlgUnknown; alg++ {
+		if _, ok := registeredDigestAlgs[alg]; ok {
+			digestAlgs = append(digestAlgs, alg)
+		}
+	}
+
+	return digestAlgs
+}
+
+func localTransferHello(compressions []transferCompression) transferHello {
+	return transferHello{
+		version:      ProtocolVersion,
+		window:       maxTransferWindow,
+		compressions: compressions,
+		digestAlgs:   localDigestAlgs(),
+	}
+}
+
+func (h transferHello) marshal(w io.Writer) error {
+	if _, err := w.Write(protocolMagic); err != nil {
+		return fmt.Errorf("unable to write protocol magic: %s", err)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, h.version); err != nil {
+		return fmt.Errorf("unable to encode protocol version: %s", err)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, h.window); err != nil {
+		return fmt.Errorf("unable to encode transfer window: %s", err)
+	}
+
+	compressions := make([]byte, len(h.compressions))
+	for i, c := range h.compressions {
+		compressions[i] = byte(c)
+	}
+
+	if err := marshalBytes(w, compressions); err != nil {
+		return fmt.Errorf("unable to encode compression methods: %s", err)
+	}
+
+	digestAlgs := make([]byte, len(h.digestAlgs))
+	for i, alg := range h.digestAlgs {
+		digestAlgs[i] = byte(alg)
+	}
+
+	if err := marshalBytes(w, digestAlgs); err != nil {
+		return fmt.Errorf("unable to encode digest algorithms: %s", err)
+	}
+
+	return nil
+}
+
+func unmarshalTransferHello(r io.Reader) (h transferHello, err error) {
+	magic := make([]byte, len(protocolMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return h, fmt.Errorf("unable to read protocol magic: %s", err)
+	}
+
+	if !bytes.Equal(magic, protocolMagic) {
+		return h, fmt.Errorf("invalid protocol magic: %q", magic)
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &h.version); err != nil {
+		return h, fmt.Errorf("unable to decode protocol version: %s", err)
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &h.window); err != nil {
+		return h, fmt.Errorf("unable to decode transfer window: %s", err)
+	}
+
+	compressions, err := unmarshalBytes(r)
+	if err != nil {
+		return h, fmt.Errorf("unable to decode compression methods: %s", err)
+	}
+
+	h.compressions = make([]transferCompression, len(compressions))
+	for i, c := range compressions {
+		h.compressions[i] = transferCompression(c)
+	}
+
+	digestAlgs, err := unmarshalBytes(r)
+	if err != nil {
+		return h, fmt.Errorf("unable to decode digest algorithms: %s", err)
+	}
+
+	h.digestAlgs = make([]DigestAlg, len(digestAlgs))
+	for i, alg := range digestAlgs {
+		h.digestAlgs[i] = DigestAlg(alg)
+	}
+
+	return h, nil
+}
+
+// negotiateTransfer exchanges a hello message with the remote end of the
+// given stream and returns the parameters which both ends agree on. Both
+// ends write their hello before reading so neither can deadlock waiting on
+// the other. The compression method is the first one in the client's order
+// of preference which the server also supports. The given compression
+// methods are those offered by this end.
+func negotiateTransfer(rwf ReadWriteFlusher, isClient bool, compressions []transferCompression) (params transferParams, err error) {
+	local := localTransferHello(compressions)
+
+	if err := local.marshal(rwf); err != nil {
+		return params, fmt.Errorf("unable to send hello: %s", err)
+	}
+
+	if err := rwf.Flush(); err != nil {
+		return params, fmt.Errorf("unable to flush hello: %s", err)
+	}
+
+	remote, err := unmarshalTransferHello(rwf)
+	if err != nil {
+		return params, fmt.Errorf("unable to read hello from remote: %s", err)
+	}
+
+	if remote.version == 0 {
+		return params, fmt.Errorf("invalid remote protocol version: %d", remote.version)
+	}
+
+	params.version = local.version
+	if remote.version < params.version {
+		params.version = remote.version
+	}
+
+	params.window = int(local.window)
+	if int(remote.window) < params.window {
+		params.window = int(remote.window)
+	}
+
+	if params.window <= 0 {
+		return params, fmt.Errorf("invalid remote transfer window: %d", remote.window)
+	}
+
+	client, server := local, remote
+	if !isClient {
+		client, server = remote, local
+	}
+
+	params.compression = transferCompressionNone
+	for _, c := range client.compressions {
+		if containsCompression(server.compressions, c) {
+			params.compression = c
+			break
+		}
+	}
+
+	for _, alg := range local.digestAlgs {
+		for _, remoteAlg := range remote.digestAlgs {
+			if alg == remoteAlg {
+				params.digestAlgs = append(params.digestAlgs, alg)
+				break
+			}
+		}
+	}
+
+	return params, nil
+}
+
+func containsCompression(compressions []transferCompression, c transferCompression) bool {
+	for _, supported := range compressions {
+		if c == supported {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newTransferStream wraps the given stream according to the negotiated
+// transfer parameters.
+func newTransferStream(rwf ReadWriteFlusher, params transferParams) (ReadWriteFlusher, error) {
+	switch params.compression {
+	case transferCompressionNone:
+		return rwf, nil
+	case transferCompressionFlate:
+		fw, err := flate.NewWriter(rwf, flate.DefaultCompression)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create compressor: %s", err)
+		}
+
+		return &flateStream{
+			rwf: rwf,
+			r:   flate.NewReader(rwf),
+			w:   fw,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported transfer compression: %d", params.compression)
+	}
+}
+
+// flateStream compresses everything written to and decompresses everything
+// read from an underlying stream. Flushing completes the current compressed
+// block so that the remote is able to decompress everything written so far.
+type flateStream struct {
+	rwf ReadWriteFlusher
+	r   io.Reader
+	w   *flate.Writer
+}
+
+func (fs *flateStream) Read(p []byte) (n int, err error) {
+	return fs.r.Read(p)
+}
+
+func (fs *flateStream) Write(p []byte) (nn int, err error) {
+	return fs.w.Write(p)
+}
+
+func (fs *flateStream) Flush() error {
+	if err := fs.w.Flush(); err != nil {
+		return err
+	}
+
+	return fs.rwf.Flush()
+}
@@ -0,0 +1,293 @@
+package stemma
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// newTestStreams returns both ends of an in-process stream. A pipeConn is
+// used rather than net.Pipe because both ends of the handshake write their
+// hello before reading it.
+func newTestStreams(t *testing.T) (client, server ReadWriteFlusher, cleanup func()) {
+	clientConn, serverConn, err := newPipeConns()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client = bufio.NewReadWriter(bufio.NewReader(clientConn), bufio.NewWriter(clientConn))
+	server = bufio.NewReadWriter(bufio.NewReader(serverConn), bufio.NewWriter(serverConn))
+
+	return client, server, func() {
+		clientConn.Close()
+		serverConn.Close()
+	}
+}
+
+func TestNegotiateTransfer(t *testing.T) {
+	flate := []transferCompression{transferCompressionFlate, transferCompressionNone}
+	none := []transferCompression{transferCompressionNone}
+
+	for _, test := range []struct {
+		name                string
+		client, server      []transferCompression
+		expectedCompression transferCompression
+	}{
+		{"both flate", flate, flate, transferCompressionFlate},
+		{"server without flate", flate, none, transferCompressionNone},
+		{"client without flate", none, flate, transferCompressionNone},
+		{"no common compression", []transferCompression{transferCompressionFlate}, none, transferCompressionNone},
+	} {
+		client, server, cleanup := newTestStreams(t)
+
+		type result struct {
+			params transferParams
+			err    error
+		}
+
+		serverResult := make(chan result, 1)
+		go func() {
+			params, err := negotiateTransfer(server, false, test.server)
+			serverResult <- result{params, err}
+		}()
+
+		clientParams, err := negotiateTransfer(client, true, test.client)
+		if err != nil {
+			t.Fatalf("%s: client: %s", test.name, err)
+		}
+
+		res := <-serverResult
+		if res.err != nil {
+			t.Fatalf("%s: server: %s", test.name, res.err)
+		}
+
+		cleanup()
+
+		if !reflect.DeepEqual(clientParams, res.params) {
+			t.Errorf("%s: client params %+v differ from server params %+v", test.name, clientParams, res.params)
+		}
+
+		expected := transferParams{
+			version:     ProtocolVersion,
+			window:      maxTransferWindow,
+			compression: test.expectedCompression,
+			digestAlgs:  localDigestAlgs(),
+		}
+
+		if !reflect.DeepEqual(clientParams, expected) {
+			t.Errorf("%s: got params %+v, expected %+v", test.name, clientParams, expected)
+		}
+	}
+}
+
+func TestNegotiateTransferRemoteHello(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		hello    transferHello
+		expected *transferParams
+	}{
+		{
+			name: "smaller window",
+			hello: transferHello{
+				version:      ProtocolVersion,
+				window:       16,
+				compressions: []transferCompression{transferCompressionNone},
+				digestAlgs:   []DigestAlg{DigestAlgSHA512_256},
+			},
+			expected: &transferParams{
+				version:     ProtocolVersion,
+				window:      16,
+				compression: transferCompressionNone,
+				digestAlgs:  []DigestAlg{DigestAlgSHA512_256},
+			},
+		},
+		{
+			name: "legacy version",
+			hello: transferHello{
+				window:       legacyTransferWindow,
+				compressions: []transferCompression{transferCompressionNone},
+				digestAlgs:   []DigestAlg{DigestAlgSHA512_256},
+			},
+		},
+		{
+			name: "empty window",
+			hello: transferHello{
+				version:      ProtocolVersion,
+				compressions: []transferCompression{transferCompressionNone},
+				digestAlgs:   []DigestAlg{DigestAlgSHA512_256},
+			},
+		},
+	} {
+		client, server, cleanup := newTestStreams(t)
+
+		serverErr := make(chan error, 1)
+		go func() {
+			if err := test.hello.marshal(server); err != nil {
+				serverErr <- err
+				return
+			}
+
+			if err := server.Flush(); err != nil {
+				serverErr <- err
+				return
+			}
+
+			_, err := unmarshalTransferHello(server)
+			serverErr <- err
+		}()
+
+		params, err := negotiateTransfer(client, true, offeredCompressions("flate"))
+		if err := <-serverErr; err != nil {
+			t.Fatalf("%s: server: %s", test.name, err)
+		}
+
+		cleanup()
+
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got params %+v", test.name, params)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if !reflect.DeepEqual(params, *test.expected) {
+			t.Errorf("%s: got params %+v, expected %+v", test.name, params, *test.expected)
+		}
+	}
+}
+
+// newTestUpgradeServer returns a server which upgrades every request using
+// the given repository and sends the negotiated parameters on the returned
+// channel.
+func newTestUpgradeServer(t *testing.T, repo *Repository) (*httptest.Server, <-chan transferParams) {
+	serverParams := make(chan transferParams, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, _, params, err := repo.hijackUpgrade(rw, req)
+		if err != nil {
+			t.Errorf("unable to upgrade: %s", err)
+			close(serverParams)
+			return
+		}
+		defer conn.Close()
+
+		serverParams <- params
+	}))
+
+	return srv, serverParams
+}
+
+func newTestRemote(t *testing.T, repo *Repository, rawurl string) *remoteObjectStore {
+	baseURL, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &remoteObjectStore{r: repo, baseURL: baseURL}
+}
+
+func TestUpgrade(t *testing.T) {
+	repo, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	srv, serverParams := newTestUpgradeServer(t, repo)
+	defer srv.Close()
+
+	conn, _, params, err := newTestRemote(t, repo, srv.URL).upgrade("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if params.version != ProtocolVersion {
+		t.Errorf("got protocol version %d, expected %d", params.version, ProtocolVersion)
+	}
+
+	if remote := <-serverParams; !reflect.DeepEqual(params, remote) {
+		t.Errorf("client params %+v differ from server params %+v", params, remote)
+	}
+}
+
+func TestUpgradeLegacyServer(t *testing.T) {
+	repo, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	// A server which predates the handshake does not echo the protocol
+	// header.
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, buf, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("unable to hijack connection: %s", err)
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(buf, "HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		buf.Flush()
+	}))
+	defer srv.Close()
+
+	conn, _, params, err := newTestRemote(t, repo, srv.URL).upgrade("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if !reflect.DeepEqual(params, legacyTransferParams) {
+		t.Errorf("got params %+v, expected legacy params %+v", params, legacyTransferParams)
+	}
+}
+
+func TestUpgradeLegacyClient(t *testing.T) {
+	repo, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	srv, serverParams := newTestUpgradeServer(t, repo)
+	defer srv.Close()
+
+	// A client which predates the handshake does not send the protocol
+	// header.
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("POST", srv.URL+"/?service=test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected response status: %s", resp.Status)
+	}
+
+	if header := resp.Header.Get(protocolHeader); header != "" {
+		t.Errorf("unexpected %s header in response to a legacy client: %q", protocolHeader, header)
+	}
+
+	if params := <-serverParams; !reflect.DeepEqual(params, legacyTransferParams) {
+		t.Errorf("got params %+v, expected legacy params %+v", params, legacyTransferParams)
+	}
+}
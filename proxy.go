@@ -0,0 +1,145 @@
+package stemma
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// upstream is a remote object store from which a repository acting as a
+// pull-through proxy fetches objects and tags which it does not have.
+type upstream struct {
+	remote RemoteObjectStore
+	tagTTL time.Duration
+
+	mu sync.Mutex
+	// Time at which each tag was last refreshed from the upstream.
+	refreshed map[string]time.Time
+	// Fetches which are currently in progress, keyed by the hex digest of
+	// the object being fetched. The channel is closed once the fetch
+	// completes.
+	inFlight map[string]chan struct{}
+}
+
+// SetUpstream configures this repository to act as a pull-through proxy for
+// the given remote object store. When serving objects which are not in this
+// repository, they are first fetched from the upstream. Tags which are
+// requested are refreshed from the upstream if they were last refreshed more
+// than tagTTL ago. Tags which the upstream does not have, or which cannot be
+// refreshed, are served from this repository.
+func (r *Repository) SetUpstream(remote RemoteObjectStore, tagTTL time.Duration) {
+	r.upstream = &upstream{
+		remote:    remote,
+		tagTTL:    tagTTL,
+		refreshed: map[string]time.Time{},
+		inFlight:  map[string]chan struct{}{},
+	}
+}
+
+// fetch fetches the object with the given descriptor, and all of its
+// dependencies, from the upstream into the given repository. Concurrent
+// requests for the same object wait for a single fetch to complete.
+func (u *upstream) fetch(r *Repository, desc Descriptor) error {
+	key := desc.Digest().Hex()
+
+	u.mu.Lock()
+	if done, ok := u.inFlight[key]; ok {
+		u.mu.Unlock()
+		<-done
+
+		if !r.Contains(desc.Digest()) {
+			return fmt.Errorf("unable to fetch object %s from upstream", desc.Digest())
+		}
+
+		return nil
+	}
+
+	done := make(chan struct{})
+	u.inFlight[key] = done
+	u.mu.Unlock()
+
+	defer func() {
+		u.mu.Lock()
+		delete(u.inFlight, key)
+		u.mu.Unlock()
+		close(done)
+	}()
+
+	// Objects may be written while holding only a shared lock.
+	unlock, err := r.sharedLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := u.remote.Fetch(desc, &ProgressMeter{}); err != nil {
+		return fmt.Errorf("unable to fetch object %s from upstream: %s", desc.Digest(), err)
+	}
+
+	return nil
+}
+
+// getTag returns the descriptor for the given tag. If this repository has an
+// upstream and the tag has not been refreshed within the tag TTL, the tag and
+// its objects are first fetched from the upstream.
+func (r *Repository) getTag(tag string) (Descriptor, error) {
+	if u := r.upstream; u != nil && validTag(tag) {
+		if err := u.refreshTag(r, tag); err != nil {
+			log.Printf("unable to refresh tag %q from upstream, using local tag: %s", tag, err)
+		}
+	}
+
+	return r.TagStore().Get(tag)
+}
+
+// refreshTag updates the given tag in the given repository from the upstream
+// if it has not been refreshed within the tag TTL.
+func (u *upstream) refreshTag(r *Repository, tag string) error {
+	u.mu.Lock()
+	lastRefreshed, ok := u.refreshed[tag]
+	u.mu.Unlock()
+
+	if ok && time.Since(lastRefreshed) < u.tagTTL {
+		return nil
+	}
+
+	desc, err := u.remote.GetTag(tag)
+	if err != nil {
+		if err == ErrNoSuchTag {
+			// Serve whatever we have locally.
+			u.markRefreshed(tag)
+			return nil
+		}
+
+		return fmt.Errorf("unable to get tag from upstream: %s", err)
+	}
+
+	if !r.Contains(desc.Digest()) {
+		if err := u.fetch(r, desc); err != nil {
+			return err
+		}
+	}
+
+	// Tags may only be changed while holding an exclusive lock. The fetch
+	// above must not hold it as objects are fetched with a shared lock.
+	unlock, err := r.exclusiveLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := r.TagStore().Set(tag, desc); err != nil {
+		return fmt.Errorf("unable to set tag: %s", err)
+	}
+
+	u.markRefreshed(tag)
+
+	return nil
+}
+
+func (u *upstream) markRefreshed(tag string) {
+	u.mu.Lock()
+	u.refreshed[tag] = time.Now()
+	u.mu.Unlock()
+}
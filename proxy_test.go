@@ -0,0 +1,188 @@
+package stemma
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingRemote counts the requests made to the wrapped remote. If release
+// is set, fetches block until it is closed. If getTagErr is set, it is
+// returned for every tag.
+type countingRemote struct {
+	RemoteObjectStore
+
+	started   chan struct{}
+	release   chan struct{}
+	getTagErr error
+
+	mu      sync.Mutex
+	getTags int
+	fetches int
+}
+
+func (cr *countingRemote) GetTag(name string) (Descriptor, error) {
+	cr.mu.Lock()
+	cr.getTags++
+	cr.mu.Unlock()
+
+	if cr.getTagErr != nil {
+		return nil, cr.getTagErr
+	}
+
+	return cr.RemoteObjectStore.GetTag(name)
+}
+
+func (cr *countingRemote) Fetch(desc Descriptor, progress *ProgressMeter) error {
+	cr.mu.Lock()
+	cr.fetches++
+	cr.mu.Unlock()
+
+	if cr.started != nil {
+		close(cr.started)
+		cr.started = nil
+	}
+
+	if cr.release != nil {
+		<-cr.release
+	}
+
+	return cr.RemoteObjectStore.Fetch(desc, progress)
+}
+
+func (cr *countingRemote) counts() (getTags, fetches int) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	return cr.getTags, cr.fetches
+}
+
+// newTestProxy returns a repository which uses the given repository as its
+// upstream through a counting remote.
+func newTestProxy(t *testing.T, upstreamRepo *Repository, tagTTL time.Duration) (*Repository, *countingRemote, func()) {
+	proxy, cleanup := newTestRepository(t)
+
+	remote, err := proxy.RemoteObjectStore(upstreamRepo.root)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	counting := &countingRemote{RemoteObjectStore: remote}
+	proxy.SetUpstream(counting, tagTTL)
+
+	return proxy, counting, cleanup
+}
+
+func TestUpstreamFetchCoalesces(t *testing.T) {
+	upstreamRepo, cleanupUpstream := newTestRepository(t)
+	defer cleanupUpstream()
+
+	proxy, remote, cleanup := newTestProxy(t, upstreamRepo, time.Hour)
+	defer cleanup()
+
+	desc := storeTestDirectory(t, upstreamRepo, map[string]string{"a": "one"})
+
+	started := make(chan struct{})
+	remote.started = started
+	remote.release = make(chan struct{})
+
+	const numRequests = 4
+	errs := make(chan error, numRequests)
+
+	go func() { errs <- proxy.upstream.fetch(proxy, desc) }()
+	<-started
+
+	for i := 1; i < numRequests; i++ {
+		go func() { errs <- proxy.upstream.fetch(proxy, desc) }()
+	}
+
+	// Give the other requests time to find the fetch in flight.
+	time.Sleep(100 * time.Millisecond)
+	close(remote.release)
+
+	for i := 0; i < numRequests; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, fetches := remote.counts(); fetches != 1 {
+		t.Errorf("fetched from upstream %d times, expected once", fetches)
+	}
+
+	if !proxy.Contains(desc.Digest()) {
+		t.Error("fetched object is missing from the proxy")
+	}
+}
+
+func TestRefreshTag(t *testing.T) {
+	upstreamRepo, cleanupUpstream := newTestRepository(t)
+	defer cleanupUpstream()
+
+	proxy, remote, cleanup := newTestProxy(t, upstreamRepo, time.Hour)
+	defer cleanup()
+
+	v1 := storeTestFile(t, upstreamRepo, "v1")
+	v2 := storeTestFile(t, upstreamRepo, "v2")
+
+	if err := upstreamRepo.TagStore().Set("app", v1); err != nil {
+		t.Fatal(err)
+	}
+
+	checkTag := func(name string, expected Descriptor, expectedGetTags int) {
+		desc, err := proxy.getTag("app")
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if !sameObject(desc, expected) {
+			t.Errorf("%s: got tag %s, expected %s", name, desc.Digest(), expected.Digest())
+		}
+
+		if getTags, _ := remote.counts(); getTags != expectedGetTags {
+			t.Errorf("%s: got the upstream tag %d times, expected %d", name, getTags, expectedGetTags)
+		}
+	}
+
+	checkTag("first request", v1, 1)
+
+	if !proxy.Contains(v1.Digest()) {
+		t.Error("tagged object was not fetched from upstream")
+	}
+
+	if err := upstreamRepo.TagStore().Set("app", v2); err != nil {
+		t.Fatal(err)
+	}
+
+	checkTag("within TTL", v1, 1)
+
+	proxy.upstream.mu.Lock()
+	proxy.upstream.refreshed["app"] = time.Now().Add(-2 * time.Hour)
+	proxy.upstream.mu.Unlock()
+
+	checkTag("after TTL", v2, 2)
+
+	// Once the tag has expired again, an upstream which fails leaves the
+	// local tag in place.
+	proxy.upstream.mu.Lock()
+	proxy.upstream.refreshed["app"] = time.Now().Add(-2 * time.Hour)
+	proxy.upstream.mu.Unlock()
+
+	if err := upstreamRepo.TagStore().Set("app", v1); err != nil {
+		t.Fatal(err)
+	}
+
+	remote.getTagErr = errors.New("upstream is down")
+	checkTag("failing upstream", v2, 3)
+	remote.getTagErr = nil
+
+	// Tags which the upstream does not have are served locally.
+	if err := upstreamRepo.TagStore().Remove("app"); err != nil {
+		t.Fatal(err)
+	}
+
+	checkTag("missing upstream", v2, 4)
+	checkTag("missing upstream within TTL", v2, 4)
+}
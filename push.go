@@ -0,0 +1,253 @@
+package stemma
+
+import (
+	"fmt"
+	"io"
+	"log"
+)
+
+// pushStatus is sent by the receiving end of a push to report whether the
+// push has been accepted.
+type pushStatus byte
+
+const (
+	pushStatusOK pushStatus = iota
+	pushStatusConflict
+	pushStatusError
+)
+
+// Flags which may be set on a push request.
+const (
+	pushFlagForce byte = 1 << iota
+	pushFlagHaveExpected
+)
+
+// pushRequest is sent by a client at the beginning of a push. It names the
+// tag to update, the descriptor to update it to, and the descriptor which the
+// client expects the tag to currently refer to. If the client has no
+// expectation, the tag must not exist on the remote unless force is set.
+type pushRequest struct {
+	tag      string
+	desc     Descriptor
+	expected Descriptor
+	force    bool
+}
+
+func (pr pushRequest) marshal(w io.Writer) error {
+	if err := marshalBytes(w, []byte(pr.tag)); err != nil {
+		return fmt.Errorf("unable to encode tag: %s", err)
+	}
+
+	if err := MarshalDescriptor(w, pr.desc); err != nil {
+		return fmt.Errorf("unable to encode descriptor: %s", err)
+	}
+
+	var flags byte
+	if pr.force {
+		flags |= pushFlagForce
+	}
+	if pr.expected != nil {
+		flags |= pushFlagHaveExpected
+	}
+
+	if _, err := w.Write([]byte{flags}); err != nil {
+		return fmt.Errorf("unable to encode push flags: %s", err)
+	}
+
+	if pr.expected == nil {
+		return nil
+	}
+
+	if err := MarshalDescriptor(w, pr.expected); err != nil {
+		return fmt.Errorf("unable to encode expected descriptor: %s", err)
+	}
+
+	return nil
+}
+
+func unmarshalPushRequest(r io.Reader) (pr pushRequest, err error) {
+	tagBuf, err := unmarshalBytes(r)
+	if err != nil {
+		return pr, fmt.Errorf("unable to decode tag: %s", err)
+	}
+	pr.tag = string(tagBuf)
+
+	if pr.desc, err = UnmarshalDescriptor(r); err != nil {
+		return pr, fmt.Errorf("unable to decode descriptor: %s", err)
+	}
+
+	flagsBuf := []byte{0}
+	if _, err := io.ReadFull(r, flagsBuf); err != nil {
+		return pr, fmt.Errorf("unable to decode push flags: %s", err)
+	}
+	pr.force = flagsBuf[0]&pushFlagForce != 0
+
+	if flagsBuf[0]&pushFlagHaveExpected == 0 {
+		return pr, nil
+	}
+
+	if pr.expected, err = UnmarshalDescriptor(r); err != nil {
+		return pr, fmt.Errorf("unable to decode expected descriptor: %s", err)
+	}
+
+	return pr, nil
+}
+
+func writePushStatus(wf WriteFlusher, status pushStatus, msg string) error {
+	if _, err := wf.Write([]byte{byte(status)}); err != nil {
+		return fmt.Errorf("unable to encode push status: %s", err)
+	}
+
+	if err := marshalBytes(wf, []byte(msg)); err != nil {
+		return fmt.Errorf("unable to encode push status message: %s", err)
+	}
+
+	return wf.Flush()
+}
+
+// readPushStatus reads a status from the receiving end of a push. A nil error
+// is returned only if the status is OK. A conflict status results in
+// ErrTagConflict.
+func readPushStatus(r io.Reader) error {
+	statusBuf := []byte{0}
+	if _, err := io.ReadFull(r, statusBuf); err != nil {
+		return fmt.Errorf("unable to decode push status: %s", err)
+	}
+
+	msg, err := unmarshalBytes(r)
+	if err != nil {
+		return fmt.Errorf("unable to decode push status message: %s", err)
+	}
+
+	switch pushStatus(statusBuf[0]) {
+	case pushStatusOK:
+		return nil
+	case pushStatusConflict:
+		return ErrTagConflict
+	default:
+		return fmt.Errorf("remote rejected push: %s", msg)
+	}
+}
+
+// sendPush pushes the object with the given descriptor (and all of its
+// dependencies) to a remote which is receiving a push on the other end of
+// the given connection. The remote updates the given tag to refer to the
+// pushed object only if it currently refers to the expected descriptor or if
+// force is set. If the remote rejects the update, ErrTagConflict is returned.
+func (r *Repository) sendPush(rwf ReadWriteFlusher, params transferParams, tag string, desc, expected Descriptor, force bool, progress *ProgressMeter) error {
+	req := pushRequest{
+		tag:      tag,
+		desc:     desc,
+		expected: expected,
+		force:    force,
+	}
+
+	if err := req.marshal(rwf); err != nil {
+		return fmt.Errorf("unable to send push request: %s", err)
+	}
+
+	if err := rwf.Flush(); err != nil {
+		return fmt.Errorf("unable to flush push request: %s", err)
+	}
+
+	// The remote checks the tag before any objects are transferred so
+	// that a stale push can be rejected early.
+	if err := readPushStatus(rwf); err != nil {
+		return err
+	}
+
+	if err := r.serveObjects(rwf, params, progress); err != nil {
+		return err
+	}
+
+	// Finally, the remote reports whether the tag was updated.
+	return readPushStatus(rwf)
+}
+
+// receivePush handles a push from a remote which is sending a push on the
+// other end of the given connection. Objects are fetched from the remote and
+// the requested tag is updated if it still refers to the object which the
+// remote expected.
+func (r *Repository) receivePush(rwf ReadWriteFlusher, params transferParams, progress *ProgressMeter) error {
+	req, err := unmarshalPushRequest(rwf)
+	if err != nil {
+		return fmt.Errorf("unable to read push request: %s", err)
+	}
+
+	if !validTag(req.tag) {
+		return writePushStatus(rwf, pushStatusError, fmt.Sprintf("invalid tag %q", req.tag))
+	}
+
+	if !req.force {
+		current, err := r.TagStore().Get(req.tag)
+		if err != nil && err != ErrNoSuchTag {
+			log.Printf("unable to get descriptor for tag %q: %s", req.tag, err)
+			return writePushStatus(rwf, pushStatusError, "unable to read tag")
+		}
+
+		if !sameObject(current, req.expected) {
+			return writePushStatus(rwf, pushStatusConflict, fmt.Sprintf("tag %q has been updated", req.tag))
+		}
+	}
+
+	if err := writePushStatus(rwf, pushStatusOK, ""); err != nil {
+		return err
+	}
+
+	if err := r.receivePushedObjects(rwf, params, req.desc, progress); err != nil {
+		return err
+	}
+
+	// Tags may only be changed while holding an exclusive lock. The
+	// shared lock held while receiving objects has been released, as this
+	// would otherwise wait on it.
+	unlock, err := r.exclusiveLock()
+	if err != nil {
+		log.Printf("unable to lock repository to set tag %q: %s", req.tag, err)
+		return writePushStatus(rwf, pushStatusError, "unable to set tag")
+	}
+
+	if req.force {
+		err = r.TagStore().Set(req.tag, req.desc)
+	} else {
+		err = r.TagStore().CompareAndSet(req.tag, req.expected, req.desc)
+	}
+
+	unlock()
+
+	switch err {
+	case nil:
+		return writePushStatus(rwf, pushStatusOK, "")
+	case ErrTagConflict:
+		return writePushStatus(rwf, pushStatusConflict, fmt.Sprintf("tag %q has been updated", req.tag))
+	default:
+		log.Printf("unable to set tag %q: %s", req.tag, err)
+		return writePushStatus(rwf, pushStatusError, "unable to set tag")
+	}
+}
+
+// receivePushedObjects fetches the object with the given descriptor, and all
+// of its dependencies, from the remote which is pushing it. Objects may be
+// written while holding only a shared lock.
+func (r *Repository) receivePushedObjects(rwf ReadWriteFlusher, params transferParams, desc Descriptor, progress *ProgressMeter) error {
+	unlock, err := r.sharedLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	fetcher := newRemoteObjectFetcher(rwf)
+
+	if r.Contains(desc.Digest()) {
+		fetcher.SkipObject(desc)
+		err = fetcher.SignalDone()
+	} else {
+		err = r.fetchObjects(fetcher, params, desc, progress)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to fetch objects: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package stemma
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadPushStatus(t *testing.T) {
+	for _, test := range []struct {
+		status pushStatus
+		msg    string
+		check  func(err error) bool
+	}{
+		{pushStatusOK, "", func(err error) bool { return err == nil }},
+		{pushStatusConflict, `tag "app" has been updated`, func(err error) bool { return err == ErrTagConflict }},
+		{pushStatusError, "unable to set tag", func(err error) bool {
+			return err != nil && err != ErrTagConflict && strings.Contains(err.Error(), "unable to set tag")
+		}},
+	} {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+
+		if err := writePushStatus(w, test.status, test.msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := readPushStatus(&buf); !test.check(err) {
+			t.Errorf("status %d: got error %v", test.status, err)
+		}
+	}
+}
+
+func TestPushConflicts(t *testing.T) {
+	local, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	remoteRepo, cleanupRemote := newTestRepository(t)
+	defer cleanupRemote()
+
+	remote, err := local.RemoteObjectStore(remoteRepo.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := storeTestFile(t, local, "first")
+	second := storeTestFile(t, local, "second")
+
+	for _, test := range []struct {
+		name     string
+		desc     Descriptor
+		expected Descriptor
+		force    bool
+		err      error
+		// The descriptor which the remote tag refers to afterwards.
+		result Descriptor
+	}{
+		{"create", first, nil, false, nil, first},
+		{"create existing", second, nil, false, ErrTagConflict, first},
+		{"stale expected", second, second, false, ErrTagConflict, first},
+		{"matching expected", second, first, false, nil, second},
+		{"force", first, nil, true, nil, first},
+	} {
+		if err := remote.Push("app", test.desc, test.expected, test.force, &ProgressMeter{}); err != test.err {
+			t.Errorf("%s: got error %v, expected %v", test.name, err, test.err)
+		}
+
+		current, err := remoteRepo.TagStore().Get("app")
+		if err != nil || !sameObject(current, test.result) {
+			t.Errorf("%s: remote tag is %v, %v, expected %s", test.name, current, err, test.result.Digest())
+		}
+	}
+
+	if !remoteRepo.Contains(second.Digest()) {
+		t.Error("pushed object is missing from the remote")
+	}
+}
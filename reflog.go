@@ -0,0 +1,290 @@
+package stemma
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Tag operations recorded in tag logs.
+const (
+	ReflogOpSet           = "set"
+	ReflogOpCompareAndSet = "compare-and-set"
+	ReflogOpRemove        = "remove"
+)
+
+// ReflogEntry records a change to a tag.
+type ReflogEntry struct {
+	// Old is the descriptor the tag referred to before the change, or nil
+	// if the tag did not exist.
+	Old Descriptor
+	// New is the descriptor the tag referred to after the change, or nil
+	// if the tag was removed.
+	New Descriptor
+
+	Time time.Time
+	// User is the name of the user running the program which made the
+	// change.
+	User string
+	// Operation is the tag store operation which made the change.
+	Operation string
+	// Program is the name of the program which made the change.
+	Program string
+}
+
+// reflogRefPattern matches references to a previous value of a tag of the
+// form "TAG@{n}".
+var reflogRefPattern = regexp.MustCompile(`^(.+)@\{([0-9]+)\}$`)
+
+// Flags for the descriptors present in an encoded reflog entry.
+const (
+	reflogEntryHasOld byte = 1 << iota
+	reflogEntryHasNew
+)
+
+// getLogPath returns the path of the log of the given tag. Logs outlive their
+// tags, and a tag may later be replaced by a namespace of the same name, so
+// logs are named using the digest of the tag rather than mirroring the tags
+// directory.
+func (s *tagStore) getLogPath(tag string) (string, error) {
+	digester, err := NewDigester(DigestAlgSHA512_256)
+	if err != nil {
+		return "", fmt.Errorf("unable to create tag digester: %s", err)
+	}
+
+	io.WriteString(digester, tag)
+
+	return filepath.Join(s.logRoot, digester.Digest().Hex()), nil
+}
+
+// appendLog records a change to the given tag in its log. It must be called
+// with the tags directory locked. Tag stores without a log directory keep no
+// logs.
+func (s *tagStore) appendLog(tag, operation string, oldDesc, newDesc Descriptor) error {
+	if s.logRoot == "" {
+		return nil
+	}
+
+	logPath, err := s.getLogPath(tag)
+	if err != nil {
+		return err
+	}
+
+	entry := ReflogEntry{
+		Old:       oldDesc,
+		New:       newDesc,
+		Time:      time.Now(),
+		User:      currentUser(),
+		Operation: operation,
+		Program:   filepath.Base(os.Args[0]),
+	}
+
+	// Encode the whole entry first so that it is appended with a single
+	// write.
+	var buf bytes.Buffer
+	if err := marshalReflogEntry(&buf, entry); err != nil {
+		return err
+	}
+
+	_, statErr := os.Lstat(logPath)
+	created := os.IsNotExist(statErr)
+
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, os.FileMode(0644))
+	if err != nil {
+		return fmt.Errorf("unable to open tag log: %s", err)
+	}
+
+	// Sync the entry, like the tag file itself, so that it survives a
+	// crash.
+	_, err = logFile.Write(buf.Bytes())
+	if err == nil {
+		err = logFile.Sync()
+	}
+
+	if cerr := logFile.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to append to tag log: %s", err)
+	}
+
+	if created {
+		if err := syncDir(s.logRoot); err != nil {
+			return fmt.Errorf("unable to sync tag logs directory: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Log returns the recorded changes to the given tag, most recent first. The
+// log of a tag is kept after the tag is removed.
+func (s *tagStore) Log(tag string) ([]ReflogEntry, error) {
+	if s.logRoot == "" || !validTag(tag) {
+		return nil, nil
+	}
+
+	logPath, err := s.getLogPath(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return readLog(logPath)
+}
+
+// readLog reads the tag log at the given path, returning its entries most
+// recent first. An entry which was only partially appended, such as by a
+// program which crashed, ends the log.
+func readLog(logPath string) ([]ReflogEntry, error) {
+	buf, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("unable to read tag log: %s", err)
+	}
+
+	var entries []ReflogEntry
+
+	r := bytes.NewReader(buf)
+	for r.Len() > 0 {
+		entry, err := unmarshalReflogEntry(r)
+		if err != nil {
+			break
+		}
+
+		entries = append(entries, entry)
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	return entries, nil
+}
+
+// currentUser returns the name of the user running this program.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return os.Getenv("USER")
+}
+
+func marshalReflogEntry(w io.Writer, entry ReflogEntry) error {
+	var flags byte
+	if entry.Old != nil {
+		flags |= reflogEntryHasOld
+	}
+	if entry.New != nil {
+		flags |= reflogEntryHasNew
+	}
+
+	if _, err := w.Write([]byte{flags}); err != nil {
+		return fmt.Errorf("unable to encode reflog entry flags: %s", err)
+	}
+
+	for _, desc := range []Descriptor{entry.Old, entry.New} {
+		if desc == nil {
+			continue
+		}
+
+		if err := MarshalDescriptor(w, desc); err != nil {
+			return fmt.Errorf("unable to encode reflog entry descriptor: %s", err)
+		}
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, entry.Time.UnixNano()); err != nil {
+		return fmt.Errorf("unable to encode reflog entry time: %s", err)
+	}
+
+	for _, field := range []string{entry.User, entry.Operation, entry.Program} {
+		if err := marshalBytes(w, []byte(field)); err != nil {
+			return fmt.Errorf("unable to encode reflog entry: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func unmarshalReflogEntry(r io.Reader) (entry ReflogEntry, err error) {
+	flags := make([]byte, 1)
+	if _, err := io.ReadFull(r, flags); err != nil {
+		return entry, fmt.Errorf("unable to decode reflog entry flags: %s", err)
+	}
+
+	if flags[0]&reflogEntryHasOld != 0 {
+		if entry.Old, err = UnmarshalDescriptor(r); err != nil {
+			return entry, fmt.Errorf("unable to decode reflog entry descriptor: %s", err)
+		}
+	}
+
+	if flags[0]&reflogEntryHasNew != 0 {
+		if entry.New, err = UnmarshalDescriptor(r); err != nil {
+			return entry, fmt.Errorf("unable to decode reflog entry descriptor: %s", err)
+		}
+	}
+
+	var nanos int64
+	if err := binary.Read(r, binary.LittleEndian, &nanos); err != nil {
+		return entry, fmt.Errorf("unable to decode reflog entry time: %s", err)
+	}
+	entry.Time = time.Unix(0, nanos)
+
+	var fields [3][]byte
+	for i := range fields {
+		if fields[i], err = unmarshalBytes(r); err != nil {
+			return entry, fmt.Errorf("unable to decode reflog entry: %s", err)
+		}
+	}
+
+	entry.User = string(fields[0])
+	entry.Operation = string(fields[1])
+	entry.Program = string(fields[2])
+
+	return entry, nil
+}
+
+// resolveReflogRef resolves a reference of the form "TAG@{n}" to the digest
+// of the object which the tag referred to n changes ago. TAG@{0} is the
+// current value of the tag. The ok result is false if the reference is not
+// of that form.
+func (r *Repository) resolveReflogRef(ref string) (digest Digest, ok bool, err error) {
+	match := reflogRefPattern.FindStringSubmatch(ref)
+	if match == nil {
+		return nil, false, nil
+	}
+
+	tag := match[1]
+
+	n, err := strconv.Atoi(match[2])
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid tag log index %q", match[2])
+	}
+
+	entries, err := r.TagStore().Log(tag)
+	if err != nil {
+		return nil, true, fmt.Errorf("unable to read log of tag %q: %s", tag, err)
+	}
+
+	if n >= len(entries) {
+		return nil, true, fmt.Errorf("log of tag %q has only %d entries", tag, len(entries))
+	}
+
+	if entries[n].New == nil {
+		return nil, true, fmt.Errorf("tag %q was removed at %s", tag, ref)
+	}
+
+	return entries[n].New.Digest(), true, nil
+}
@@ -0,0 +1,131 @@
+package stemma
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReflogEntryRoundTrip(t *testing.T) {
+	first := testDescriptor(t, "first")
+	second := testDescriptor(t, "second")
+
+	entries := []ReflogEntry{
+		{New: first, Operation: ReflogOpSet},
+		{Old: first, New: second, Operation: ReflogOpCompareAndSet},
+		{Old: second, Operation: ReflogOpRemove},
+	}
+
+	var buf bytes.Buffer
+	for i := range entries {
+		entries[i].Time = time.Unix(1500000000, int64(i))
+		entries[i].User = "user"
+		entries[i].Program = "stemma-test"
+
+		if err := marshalReflogEntry(&buf, entries[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := bytes.NewReader(buf.Bytes())
+	for _, expected := range entries {
+		entry, err := unmarshalReflogEntry(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !sameObject(entry.Old, expected.Old) || !sameObject(entry.New, expected.New) {
+			t.Errorf("%s: got descriptors %v -> %v, expected %v -> %v", expected.Operation, entry.Old, entry.New, expected.Old, expected.New)
+		}
+
+		if !entry.Time.Equal(expected.Time) || entry.User != expected.User || entry.Operation != expected.Operation || entry.Program != expected.Program {
+			t.Errorf("got entry %+v, expected %+v", entry, expected)
+		}
+	}
+
+	if r.Len() != 0 {
+		t.Errorf("%d bytes left after decoding every entry", r.Len())
+	}
+
+	// An entry which was only partially appended ends the log.
+	dir, err := ioutil.TempDir("", "stemma-reflog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "log")
+	if err := ioutil.WriteFile(logPath, buf.Bytes()[:buf.Len()-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	logEntries, err := readLog(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Logs are read most recent first.
+	if len(logEntries) != 2 || logEntries[0].Operation != ReflogOpCompareAndSet || logEntries[1].Operation != ReflogOpSet {
+		t.Errorf("got %d entries from a truncated log, expected the first 2 in reverse", len(logEntries))
+	}
+}
+
+func TestResolveReflogRef(t *testing.T) {
+	repo, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	first := storeTestFile(t, repo, "first")
+	second := storeTestFile(t, repo, "second")
+
+	for _, desc := range []Descriptor{first, second} {
+		if err := repo.TagStore().Set("app", desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := repo.TagStore().Remove("app"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		ref      string
+		expected Descriptor
+		err      string
+	}{
+		{ref: "app@{0}", err: "was removed"},
+		{ref: "app@{1}", expected: second},
+		{ref: "app@{2}", expected: first},
+		{ref: "app@{3}", err: "has only 3 entries"},
+		{ref: "missing@{0}", err: "has only 0 entries"},
+	} {
+		digest, err := repo.ResolveRef(test.ref)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, expected one containing %q", test.ref, err, test.err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.ref, err)
+			continue
+		}
+
+		if !digest.Equals(test.expected.Digest()) {
+			t.Errorf("%s: got %s, expected %s", test.ref, digest, test.expected.Digest())
+		}
+	}
+
+	// The log of a removed tag is kept when it is set again.
+	if err := repo.TagStore().Set("app", first); err != nil {
+		t.Fatal(err)
+	}
+
+	if digest, err := repo.ResolveRef("app@{2}"); err != nil || !digest.Equals(second.Digest()) {
+		t.Errorf("app@{2}: got %v, %v, expected %s", digest, err, second.Digest())
+	}
+}
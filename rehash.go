@@ -0,0 +1,190 @@
+package stemma
+
+import (
+	"fmt"
+	"io"
+)
+
+// Rehash rewrites the object with the given descriptor and all of its
+// dependencies in this repository using the given digest algorithm, and
+// returns the descriptor of the rewritten object. The rehashed map holds the
+// descriptors of objects which have already been rewritten, keyed by their
+// original hex digest, so that objects shared by many trees are only
+// rewritten once. Each rewritten object is added to it. The original
+// objects are left in place.
+func (r *Repository) Rehash(desc Descriptor, alg DigestAlg, rehashed map[string]Descriptor) (Descriptor, error) {
+	if _, ok := registeredDigestAlgs[alg]; !ok {
+		return nil, ErrInvalidDigestAlg
+	}
+
+	if desc.Digest().Algorithm() == alg {
+		// Nothing to do.
+		return desc, nil
+	}
+
+	newDesc, err := r.rehash(desc, alg, rehashed)
+	if err != nil {
+		return nil, fmt.Errorf("unable to rehash object %s: %s", desc.Digest(), err)
+	}
+
+	return newDesc, nil
+}
+
+func (r *Repository) rehash(desc Descriptor, alg DigestAlg, rehashed map[string]Descriptor) (newDesc Descriptor, err error) {
+	if newDesc, ok := rehashed[desc.Digest().Hex()]; ok {
+		return newDesc, nil
+	}
+
+	switch desc.Type() {
+	case ObjectTypeApplication:
+		newDesc, err = r.rehashApplication(desc.Digest(), alg, rehashed)
+	case ObjectTypeDirectory:
+		newDesc, err = r.rehashDirectory(desc.Digest(), alg, rehashed)
+	default:
+		newDesc, err = r.rehashContent(desc, alg)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	rehashed[desc.Digest().Hex()] = newDesc
+
+	return newDesc, nil
+}
+
+// rehashContent rewrites an object which has no dependencies by copying its
+// content unchanged.
+func (r *Repository) rehashContent(desc Descriptor, alg DigestAlg) (Descriptor, error) {
+	object, err := r.getObjectFile(desc.Digest())
+	if err != nil {
+		return nil, fmt.Errorf("unable to get object %s: %s", desc.Digest(), err)
+	}
+	defer object.Close()
+
+	if err := EnsureObjectType(object, desc.Type()); err != nil {
+		return nil, err
+	}
+
+	objectWriter, err := r.newObjectWriterAlg(desc.Type(), alg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get new object writer: %s", err)
+	}
+
+	if _, err := io.Copy(objectWriter, object); err != nil {
+		objectWriter.Cancel()
+		return nil, fmt.Errorf("unable to copy object %s: %s", desc.Digest(), err)
+	}
+
+	return objectWriter.Commit()
+}
+
+// rehashDirectory rewrites the directory with the given digest after
+// rewriting each of its entries.
+func (r *Repository) rehashDirectory(digest Digest, alg DigestAlg, rehashed map[string]Descriptor) (Descriptor, error) {
+	dir, err := r.GetDirectory(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, entry := range dir {
+		headerDesc, err := r.rehash(entry.HeaderDescriptor(), alg, rehashed)
+		if err != nil {
+			return nil, err
+		}
+
+		dir[i].HeaderDigest = headerDesc.Digest()
+		dir[i].HeaderSize = headerDesc.Size()
+
+		if objDesc := entry.ObjectDescriptor(); objDesc != nil {
+			if objDesc, err = r.rehash(objDesc, alg, rehashed); err != nil {
+				return nil, err
+			}
+
+			// Sizes may differ as digests of different algorithms
+			// have different lengths.
+			dir[i].ObjectDigest = objDesc.Digest()
+			dir[i].ObjectSize = objDesc.Size()
+			dir[i].NumSubObjects = objDesc.NumSubObjects()
+			dir[i].SubObjectsSize = objDesc.SubObjectsSize()
+		}
+	}
+
+	objectWriter, err := r.newObjectWriterAlg(ObjectTypeDirectory, alg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get new object writer: %s", err)
+	}
+
+	if err := dir.Marshal(objectWriter); err != nil {
+		objectWriter.Cancel()
+		return nil, fmt.Errorf("unable to encode directory object: %s", err)
+	}
+
+	desc, err := objectWriter.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("unable to commit directory object: %s", err)
+	}
+
+	return &descriptor{
+		digest:         desc.Digest(),
+		size:           desc.Size(),
+		objectType:     desc.Type(),
+		numSubObjects:  dir.TotalNumSubOjbects(),
+		subObjectsSize: dir.TotalSubOjbectSize(),
+	}, nil
+}
+
+// rehashApplication rewrites the application with the given digest after
+// rewriting its rootfs.
+func (r *Repository) rehashApplication(digest Digest, alg DigestAlg, rehashed map[string]Descriptor) (Descriptor, error) {
+	a, err := r.GetApplication(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	headerDesc, err := r.rehash(a.Rootfs.Header.Descriptor(), alg, rehashed)
+	if err != nil {
+		return nil, err
+	}
+
+	dirDesc, err := r.rehash(a.Rootfs.Directory.Descriptor(), alg, rehashed)
+	if err != nil {
+		return nil, err
+	}
+
+	a.Rootfs = Rootfs{
+		Header: RootfsHeader{
+			Digest: headerDesc.Digest(),
+			Size:   headerDesc.Size(),
+		},
+		Directory: RootfsDirectory{
+			Digest:         dirDesc.Digest(),
+			Size:           dirDesc.Size(),
+			NumSubObjects:  dirDesc.NumSubObjects(),
+			SubObjectsSize: dirDesc.SubObjectsSize(),
+		},
+	}
+
+	objectWriter, err := r.newObjectWriterAlg(ObjectTypeApplication, alg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get new object writer: %s", err)
+	}
+
+	if err := a.Marshal(objectWriter); err != nil {
+		objectWriter.Cancel()
+		return nil, fmt.Errorf("unable to encode application object: %s", err)
+	}
+
+	desc, err := objectWriter.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("unable to commit application object: %s", err)
+	}
+
+	return &descriptor{
+		digest:         desc.Digest(),
+		size:           desc.Size(),
+		objectType:     desc.Type(),
+		numSubObjects:  2 + a.Rootfs.Directory.NumSubObjects,
+		subObjectsSize: a.Rootfs.Header.Size + a.Rootfs.Directory.Size + a.Rootfs.Directory.SubObjectsSize,
+	}, nil
+}
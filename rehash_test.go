@@ -0,0 +1,125 @@
+package stemma
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkRehashedDirectory fails the test unless the directory with the given
+// digest, and every object it refers to, uses the given digest algorithm
+// and has the expected contents. Expected files are keyed by their path
+// relative to the directory.
+func checkRehashedDirectory(t *testing.T, repo *Repository, digest Digest, alg DigestAlg, prefix string, expected map[string]string) {
+	if digest.Algorithm() != alg {
+		t.Errorf("directory %q has digest algorithm %s, expected %s", prefix, digest.Algorithm(), alg)
+	}
+
+	dir, err := repo.GetDirectory(digest)
+	if err != nil {
+		t.Fatalf("unable to decode directory %q: %s", prefix, err)
+	}
+
+	for _, entry := range dir {
+		name := filepath.Join(prefix, entry.Name)
+
+		if entry.HeaderDigest.Algorithm() != alg {
+			t.Errorf("header of %q has digest algorithm %s, expected %s", name, entry.HeaderDigest.Algorithm(), alg)
+		}
+
+		if _, err := repo.GetHeader(entry.HeaderDigest); err != nil {
+			t.Errorf("unable to decode header of %q: %s", name, err)
+		}
+
+		switch entry.Type {
+		case DirentTypeDirectory:
+			checkRehashedDirectory(t, repo, entry.ObjectDigest, alg, name, expected)
+		case DirentTypeRegular:
+			if entry.ObjectDigest.Algorithm() != alg {
+				t.Errorf("file %q has digest algorithm %s, expected %s", name, entry.ObjectDigest.Algorithm(), alg)
+			}
+
+			if got := readTestFile(t, repo, entry.ObjectDigest); got != expected[name] {
+				t.Errorf("file %q contains %q, expected %q", name, got, expected[name])
+			}
+
+			delete(expected, name)
+		}
+	}
+}
+
+func TestRehash(t *testing.T) {
+	repo, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	files := map[string]string{
+		"a":       "one",
+		"b":       "two",
+		"sub/c":   "three",
+		"sub/d/e": "four",
+	}
+
+	dir, err := ioutil.TempDir("", "stemma-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	original, err := repo.StoreDirectory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alg := DigestAlgBLAKE3
+	if original.Digest().Algorithm() == alg {
+		alg = DigestAlgSHA256
+	}
+
+	rehashed := map[string]Descriptor{}
+	desc, err := repo.Rehash(original, alg, rehashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{}
+	for name, contents := range files {
+		expected[name] = contents
+	}
+
+	checkRehashedDirectory(t, repo, desc.Digest(), alg, "", expected)
+
+	if len(expected) != 0 {
+		t.Errorf("files missing from the rehashed directory: %v", expected)
+	}
+
+	if desc.NumSubObjects() != original.NumSubObjects() || desc.SubObjectsSize() != original.SubObjectsSize() {
+		t.Errorf("rehashed directory has %d sub objects of %d bytes, expected %d of %d bytes",
+			desc.NumSubObjects(), desc.SubObjectsSize(), original.NumSubObjects(), original.SubObjectsSize())
+	}
+
+	// Objects which have already been rehashed are not rewritten.
+	again, err := repo.Rehash(original, alg, rehashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sameObject(again, desc) {
+		t.Errorf("rehashing again gave %s, expected %s", again.Digest(), desc.Digest())
+	}
+
+	if !repo.Contains(original.Digest()) {
+		t.Error("original directory was removed")
+	}
+}
@@ -0,0 +1,120 @@
+package stemma
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Common remote errors.
+var (
+	ErrNoSuchRemote      = errors.New("no such remote")
+	ErrRemoteExists      = errors.New("remote already exists")
+	ErrInvalidRemoteName = errors.New("invalid remote name")
+)
+
+// remoteRefPrefix begins references to remote-tracking tags, which are
+// written as "remotes/NAME/TAG".
+const remoteRefPrefix = "remotes/"
+
+// validRemoteNamePattern matches valid remote names. Unlike tags, remote
+// names have no namespaces.
+var validRemoteNamePattern = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+func (r *Repository) getRemoteTagsPath(name string) string {
+	return filepath.Join(r.root, "refs", "remotes", name)
+}
+
+// AddRemote adds a named remote with the given URL to the repository config.
+// Acquire an exclusive lock before adding a remote.
+func (r *Repository) AddRemote(name, remoteURL string) error {
+	if !validRemoteNamePattern.MatchString(name) {
+		return ErrInvalidRemoteName
+	}
+
+	if _, ok := r.config.Remotes[name]; ok {
+		return ErrRemoteExists
+	}
+
+	config := r.config
+	config.Remotes = make(map[string]string, len(r.config.Remotes)+1)
+	for existing, existingURL := range r.config.Remotes {
+		config.Remotes[existing] = existingURL
+	}
+
+	config.Remotes[name] = remoteURL
+
+	return r.SetConfig(config)
+}
+
+// RemoveRemote removes the named remote from the repository config along
+// with its remote-tracking tags. Acquire an exclusive lock before removing a
+// remote.
+func (r *Repository) RemoveRemote(name string) error {
+	if _, ok := r.config.Remotes[name]; !ok {
+		return ErrNoSuchRemote
+	}
+
+	config := r.config
+	config.Remotes = make(map[string]string, len(r.config.Remotes))
+	for existing, existingURL := range r.config.Remotes {
+		if existing != name {
+			config.Remotes[existing] = existingURL
+		}
+	}
+
+	if err := r.SetConfig(config); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(r.getRemoteTagsPath(name)); err != nil {
+		return fmt.Errorf("unable to remove remote-tracking tags: %s", err)
+	}
+
+	return nil
+}
+
+// RemoteTagStore returns the store of remote-tracking tags for the named
+// remote. These record the tags of the remote as of the last fetch from it,
+// and are kept separate from local tags so that fetching never replaces a
+// local tag.
+func (r *Repository) RemoteTagStore(name string) (TagStore, error) {
+	if _, ok := r.config.Remotes[name]; !ok {
+		return nil, ErrNoSuchRemote
+	}
+
+	tagsDirPath := r.getRemoteTagsPath(name)
+	if err := os.MkdirAll(tagsDirPath, os.FileMode(0755)); err != nil {
+		return nil, fmt.Errorf("unable to make remote tags directory: %s", err)
+	}
+
+	return NewTagStore(tagsDirPath)
+}
+
+// getRemoteRef returns the descriptor for a reference to a remote-tracking
+// tag of the form "remotes/NAME/TAG". It returns ErrNoSuchTag if the
+// reference is not of that form or there is no such tag.
+func (r *Repository) getRemoteRef(ref string) (Descriptor, error) {
+	if !strings.HasPrefix(ref, remoteRefPrefix) {
+		return nil, ErrNoSuchTag
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(ref, remoteRefPrefix), "/", 2)
+	if len(parts) != 2 {
+		return nil, ErrNoSuchTag
+	}
+
+	tags, err := r.RemoteTagStore(parts[0])
+	if err != nil {
+		if err == ErrNoSuchRemote {
+			return nil, ErrNoSuchTag
+		}
+
+		return nil, err
+	}
+
+	return tags.Get(parts[1])
+}
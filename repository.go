@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 
@@ -21,14 +22,23 @@ type Repository struct {
 	// due to the content-addressibility of the object store.
 	*sysutil.Lock
 
+	config Config
+
 	tags   TagStore
 	mounts MountSet
+	packs  *packSet
+
+	// If set, objects and tags which this repository does not have are
+	// fetched from this upstream when requested by clients.
+	upstream *upstream
 }
 
 var _ ObjectStore = &Repository{}
 
-// NewRepository returns a repository storing objects at the given root
-// directory.
+// NewRepository opens the repository at the given root directory, which
+// must have been created by InitRepository or by a version of this package
+// which predates config files. Repositories with a newer format than this
+// package supports are refused.
 func NewRepository(root string) (*Repository, error) {
 	rootDir, err := os.Open(root)
 	if err != nil {
@@ -41,6 +51,13 @@ func NewRepository(root string) (*Repository, error) {
 		return nil, fmt.Errorf("unable to use directory %q: not a directory", root)
 	}
 
+	config, err := readConfig(root)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open repository %q: %s", root, err)
+	}
+
+	// Directories added to the layout since the repository was created
+	// are made as needed.
 	objectsDirPath := filepath.Join(root, "objects")
 	if err := os.MkdirAll(objectsDirPath, os.FileMode(0755)); err != nil {
 		return nil, fmt.Errorf("unable to make objects directory: %s", err)
@@ -51,15 +68,72 @@ func NewRepository(root string) (*Repository, error) {
 		return nil, fmt.Errorf("unable to make tags directory: %s", err)
 	}
 
-	tagStore, err := NewTagStore(tagsDirPath)
+	logsDirPath := filepath.Join(root, "refs", "logs")
+	if err := os.MkdirAll(logsDirPath, os.FileMode(0755)); err != nil {
+		return nil, fmt.Errorf("unable to make tag logs directory: %s", err)
+	}
+
+	tagStore, err := NewLoggedTagStore(tagsDirPath, logsDirPath)
 	if err != nil {
 		return nil, fmt.Errorf("unable to initialize tag store: %s", err)
 	}
 
+	mountsDirPath := filepath.Join(root, "refs", "mounts")
+	if err := os.MkdirAll(mountsDirPath, os.FileMode(0755)); err != nil {
+		return nil, fmt.Errorf("unable to make mounts directory: %s", err)
+	}
+
+	mountSet, err := NewMountSet(mountsDirPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize mount set: %s", err)
+	}
+
 	return &Repository{
-		root: root,
-		Lock: sysutil.NewLock(rootDir),
-		tags: tagStore,
+		root:   root,
+		Lock:   sysutil.NewLock(rootDir),
+		config: config,
+		tags:   tagStore,
+		mounts: mountSet,
+		packs:  newPackSet(filepath.Join(objectsDirPath, "pack")),
+	}, nil
+}
+
+// sharedLock acquires a shared lock on the repository using a new file
+// descriptor so that concurrent requests do not interfere with each other's
+// locks or with a lock held through the Repository itself. It blocks until
+// the lock is acquired.
+func (r *Repository) sharedLock() (unlock func(), err error) {
+	return r.newLock(false)
+}
+
+// exclusiveLock acquires an exclusive lock on the repository in the same way
+// as sharedLock.
+func (r *Repository) exclusiveLock() (unlock func(), err error) {
+	return r.newLock(true)
+}
+
+func (r *Repository) newLock(exclusive bool) (unlock func(), err error) {
+	dir, err := os.Open(r.root)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open repository directory: %s", err)
+	}
+
+	lock := sysutil.NewLock(dir)
+	lock.SetBlocking(true)
+
+	kind, acquire := "shared", lock.SharedLock
+	if exclusive {
+		kind, acquire = "exclusive", lock.ExclusiveLock
+	}
+
+	if err := acquire(); err != nil {
+		dir.Close()
+		return nil, fmt.Errorf("unable to acquire %s repo lock: %s", kind, err)
+	}
+
+	return func() {
+		lock.Unlock()
+		dir.Close()
 	}, nil
 }
 
@@ -68,15 +142,41 @@ func (r *Repository) TagStore() TagStore {
 	return r.tags
 }
 
+// MountSet returns the set of applications mounted from this repository.
+func (r *Repository) MountSet() MountSet {
+	return r.mounts
+}
+
 func (r *Repository) getObjectPath(digest Digest) string {
 	digestHex := digest.Hex()
 	return filepath.Join(r.root, "objects", digestHex[:2], digestHex[2:4], digestHex[4:6], digestHex[6:])
 }
 
+// getObjectFile opens the object file with the given digest, whether it is
+// loose or in a pack. If there is no such object, the error satisfies
+// os.IsNotExist.
 func (r *Repository) getObjectFile(digest Digest) (ReadSeekCloser, error) {
 	objectPath := r.getObjectPath(digest)
 
-	return os.Open(objectPath)
+	object, err := os.Open(objectPath)
+	if err == nil {
+		return object, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	packed, ok, packErr := r.packs.open(digest)
+	if packErr != nil {
+		return nil, packErr
+	}
+
+	if !ok {
+		return nil, err
+	}
+
+	return packed, nil
 }
 
 func (r *Repository) tempFile() (*os.File, error) {
@@ -89,22 +189,144 @@ func (r *Repository) tempFile() (*os.File, error) {
 }
 
 // Contains returns whether an object with the given digest exists in this
-// repository.
+// repository. An error scanning the packs is logged and the object is
+// reported missing.
 func (r *Repository) Contains(digest Digest) bool {
 	objectPath := r.getObjectPath(digest)
 
-	_, err := os.Lstat(objectPath)
+	if _, err := os.Lstat(objectPath); err == nil {
+		return true
+	}
+
+	packed, err := r.packs.contains(digest)
+	if err != nil {
+		log.Printf("unable to check packs for object %s: %s", digest, err)
+	}
+
+	return packed
+}
+
+// GetDescriptor returns a descriptor for the object with the given digest in
+// this repository. If the object is an application or directory, the number
+// and total size of its subobjects are computed from its contents.
+func (r *Repository) GetDescriptor(digest Digest) (Descriptor, error) {
+	object, err := r.getObjectFile(digest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get object: %s", err)
+	}
+
+	defer object.Close()
+
+	objectSize, err := object.Seek(0, os.SEEK_END)
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine object size: %s", err)
+	}
+
+	if _, err := object.Seek(0, os.SEEK_SET); err != nil {
+		return nil, fmt.Errorf("unable to seek to beginning of object: %s", err)
+	}
+
+	objectType, err := UnmarshalObjectType(object)
+	if err != nil {
+		return nil, err
+	}
+
+	desc := &descriptor{
+		digest:     digest,
+		size:       uint64(objectSize - EncodedObjectTypeSize),
+		objectType: objectType,
+	}
+
+	switch objectType {
+	case ObjectTypeApplication:
+		a, err := UnmarshalApplication(object)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode application object: %s", err)
+		}
+
+		desc.numSubObjects = 2 + a.Rootfs.Directory.NumSubObjects
+		desc.subObjectsSize = a.Rootfs.Header.Size + a.Rootfs.Directory.Size + a.Rootfs.Directory.SubObjectsSize
+	case ObjectTypeDirectory:
+		d, err := UnmarshalDirectory(object)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode directory object: %s", err)
+		}
+
+		desc.numSubObjects = d.TotalNumSubOjbects()
+		desc.subObjectsSize = d.TotalSubOjbectSize()
+	}
+
+	return desc, nil
+}
+
+// objectDependencies returns descriptors for the objects which are directly
+// referenced by the object with the given descriptor.
+func (r *Repository) objectDependencies(desc Descriptor) ([]Descriptor, error) {
+	switch desc.Type() {
+	case ObjectTypeApplication:
+		app, err := r.GetApplication(desc.Digest())
+		if err != nil {
+			return nil, err
+		}
+
+		return app.Dependencies(), nil
+	case ObjectTypeDirectory:
+		dir, err := r.GetDirectory(desc.Digest())
+		if err != nil {
+			return nil, err
+		}
+
+		return dir.Dependencies(), nil
+	default:
+		return nil, nil
+	}
+}
+
+// walkObjects calls fn for the object with the given descriptor and each of
+// its dependencies, recursively, with parents before children. Objects which
+// are already in the visited set are skipped along with their dependencies.
+// Each walked object is added to the visited set.
+func (r *Repository) walkObjects(desc Descriptor, visited digestSet, fn func(Descriptor) error) error {
+	stack := NewDescriptorStack(0)
+	stack.PushFront(desc)
+
+	for !stack.Empty() {
+		desc := stack.Pop()
+		if visited.Contains(desc.Digest()) {
+			continue
+		}
+
+		visited.Add(desc.Digest())
+
+		if err := fn(desc); err != nil {
+			return err
+		}
+
+		dependencies, err := r.objectDependencies(desc)
+		if err != nil {
+			return fmt.Errorf("unable to get dependencies of object %s: %s", desc.Digest(), err)
+		}
+
+		for _, dep := range dependencies {
+			stack.PushFront(dep)
+		}
+	}
 
-	return err == nil
+	return nil
 }
 
 /*
 Repository Layout:
 
+	config
 	objects/
+		pack/
 	temp/
 	refs/
+		logs/
 		mounts/
+		remotes/
+			<name>/
 		tags/
 
 */
@@ -0,0 +1,354 @@
+package stemma
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrPushNotSupported is returned when pushing to a read-only remote.
+var ErrPushNotSupported = errors.New("push is not supported by this remote")
+
+// objectTypeHeader is set on object responses to indicate the type of the
+// object. The object type byte itself is not included in the response body.
+const objectTypeHeader = "Stemma-Object-Type"
+
+// HandleGetObject serves the contents of the object with the digest given
+// by the "digest" route variable, without its object type byte. Objects are
+// immutable, so the digest is used as the ETag and responses may be cached
+// forever. Range requests are supported if the object file supports
+// positional reads.
+func (r *Repository) HandleGetObject(rw http.ResponseWriter, req *http.Request) {
+	digest, err := ParseDigest(mux.Vars(req)["digest"])
+	if err != nil || digest.Algorithm() == DigestAlgUnknown {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	object, err := r.getObjectFile(digest)
+	if err != nil {
+		if os.IsNotExist(err) {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		log.Printf("unable to get object %s: %s", digest, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	defer object.Close()
+
+	serveObject(rw, req, digest, object)
+}
+
+// serveObject serves the contents of the given object file without its
+// object type byte.
+func serveObject(rw http.ResponseWriter, req *http.Request, digest Digest, object io.ReadSeeker) {
+	objectType, err := UnmarshalObjectType(object)
+	if err != nil {
+		log.Printf("unable to read type of object %s: %s", digest, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	objectSize, err := object.Seek(0, os.SEEK_END)
+	if err != nil {
+		log.Printf("unable to determine size of object %s: %s", digest, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	rw.Header().Set("ETag", fmt.Sprintf("%q", digest.Hex()))
+	rw.Header().Set(objectTypeHeader, objectType.String())
+
+	if readerAt, ok := object.(io.ReaderAt); ok {
+		content := io.NewSectionReader(readerAt, EncodedObjectTypeSize, objectSize-EncodedObjectTypeSize)
+		http.ServeContent(rw, req, "", time.Time{}, content)
+		return
+	}
+
+	// Without positional reads, copy the whole object after its type byte.
+	// Range requests are not supported in this case.
+	if _, err := object.Seek(EncodedObjectTypeSize, os.SEEK_SET); err != nil {
+		log.Printf("unable to seek object %s: %s", digest, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Length", strconv.FormatInt(objectSize-EncodedObjectTypeSize, 10))
+	rw.WriteHeader(http.StatusOK)
+
+	if req.Method == "HEAD" {
+		return
+	}
+
+	if _, err := io.Copy(rw, object); err != nil {
+		log.Printf("unable to send object %s: %s", digest, err)
+	}
+}
+
+// HandleGetTagJSON serves the JSON descriptor for the tag given by the "name"
+// route variable.
+func (r *Repository) HandleGetTagJSON(rw http.ResponseWriter, req *http.Request) {
+	tag := mux.Vars(req)["name"]
+
+	desc, err := r.getTag(tag)
+	if err != nil {
+		if err == ErrNoSuchTag {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		log.Printf("unable to get descriptor for tag %q: %s", tag, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(rw, NewDescriptorJSON(desc))
+}
+
+// HandleListTagsJSON serves a JSON object mapping every tag which begins with
+// the "prefix" query parameter to its JSON descriptor.
+func (r *Repository) HandleListTagsJSON(rw http.ResponseWriter, req *http.Request) {
+	tagDescriptors, err := r.tagDescriptors(req.URL.Query().Get("prefix"))
+	if err != nil {
+		log.Printf("unable to list tags: %s", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	tagDescriptorsJSON := make(map[string]DescriptorJSON, len(tagDescriptors))
+	for tag, desc := range tagDescriptors {
+		tagDescriptorsJSON[tag] = NewDescriptorJSON(desc)
+	}
+
+	writeJSON(rw, tagDescriptorsJSON)
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	// Tags may change at any time.
+	rw.Header().Set("Cache-Control", "no-cache")
+
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		log.Printf("unable to encode JSON response: %s", err)
+	}
+}
+
+// restObjectStore is a read-only remote object store which only uses plain
+// HTTP GET requests so that standard HTTP caches may be placed in front of
+// the remote.
+type restObjectStore struct {
+	r       *Repository
+	baseURL *url.URL
+}
+
+// newRESTObjectStore returns a read-only remote object store for the given
+// URL which must have a scheme of "rest+http" or "rest+https".
+func newRESTObjectStore(r *Repository, remoteURL *url.URL) *restObjectStore {
+	baseURL := new(url.URL)
+	*baseURL = *remoteURL
+	baseURL.Scheme = strings.TrimPrefix(baseURL.Scheme, "rest+")
+
+	return &restObjectStore{
+		r:       r,
+		baseURL: baseURL,
+	}
+}
+
+// get requests the resource at the given path relative to the base URL. If
+// the response status is not 200 OK, the response body is closed and an error
+// is returned. A 404 Not Found status results in a nil response and error.
+func (ros *restObjectStore) get(elem ...string) (*http.Response, error) {
+	return ros.getQuery(nil, elem...)
+}
+
+// getQuery is like get but also sends the given query parameters.
+func (ros *restObjectStore) getQuery(query url.Values, elem ...string) (*http.Response, error) {
+	reqURL := new(url.URL)
+	*reqURL = *ros.baseURL
+	reqURL.Path = path.Join(append([]string{reqURL.Path}, elem...)...)
+	reqURL.RawQuery = query.Encode()
+
+	resp, err := http.Get(reqURL.String())
+	if err != nil {
+		return nil, fmt.Errorf("unable to make request to remote: %s", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, nil
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected response status for %s: %s", reqURL, resp.Status)
+	}
+}
+
+func (ros *restObjectStore) GetTag(name string) (Descriptor, error) {
+	resp, err := ros.get("tags", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp == nil {
+		return nil, ErrNoSuchTag
+	}
+
+	defer resp.Body.Close()
+
+	var descJSON DescriptorJSON
+	if err := json.NewDecoder(resp.Body).Decode(&descJSON); err != nil {
+		return nil, fmt.Errorf("unable to decode descriptor from response: %s", err)
+	}
+
+	return descJSON.Descriptor()
+}
+
+func (ros *restObjectStore) ListTags(prefix string) (map[string]Descriptor, error) {
+	query := url.Values{}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+
+	resp, err := ros.getQuery(query, "tags")
+	if err != nil {
+		return nil, err
+	}
+
+	if resp == nil {
+		return nil, fmt.Errorf("remote does not support listing tags")
+	}
+
+	defer resp.Body.Close()
+
+	var tagDescriptorsJSON map[string]DescriptorJSON
+	if err := json.NewDecoder(resp.Body).Decode(&tagDescriptorsJSON); err != nil {
+		return nil, fmt.Errorf("unable to decode tag descriptors: %s", err)
+	}
+
+	tagDescriptors := make(map[string]Descriptor, len(tagDescriptorsJSON))
+	for tag, descJSON := range tagDescriptorsJSON {
+		desc, err := descJSON.Descriptor()
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode descriptor for tag %q: %s", tag, err)
+		}
+
+		tagDescriptors[tag] = desc
+	}
+
+	// Static servers list every tag.
+	return filterTagPrefix(tagDescriptors, prefix), nil
+}
+
+func (ros *restObjectStore) Fetch(desc Descriptor, progress *ProgressMeter) error {
+	fetcher, params, conn, err := ros.openFetchSession()
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	return ros.r.fetchObjects(fetcher, params, desc, progress)
+}
+
+// openFetchSession returns a fetcher which makes a separate request for each
+// object. There is no connection to close other than the body of the current
+// response, so the fetcher is its own closer.
+func (ros *restObjectStore) openFetchSession() (RemoteObjectFetcher, transferParams, io.Closer, error) {
+	params := transferParams{
+		window:     legacyTransferWindow,
+		digestAlgs: localDigestAlgs(),
+	}
+
+	fetcher := &restObjectFetcher{ros: ros}
+
+	return fetcher, params, fetcher, nil
+}
+
+func (ros *restObjectStore) Push(tag string, desc, expected Descriptor, force bool, progress *ProgressMeter) error {
+	return ErrPushNotSupported
+}
+
+// restObjectFetcher fetches each requested object with a separate GET
+// request, in the order in which the objects were requested.
+type restObjectFetcher struct {
+	ros       *restObjectStore
+	requested []Descriptor
+	current   io.Closer
+}
+
+func (rof *restObjectFetcher) RequestObject(desc Descriptor) error {
+	rof.requested = append(rof.requested, desc)
+	return nil
+}
+
+func (rof *restObjectFetcher) SkipObject(desc Descriptor) error {
+	return nil
+}
+
+func (rof *restObjectFetcher) NextObject(size uint64) io.Reader {
+	rof.closeCurrent()
+
+	if len(rof.requested) == 0 {
+		return &errReader{fmt.Errorf("no more objects requested")}
+	}
+
+	desc := rof.requested[0]
+	rof.requested = rof.requested[1:]
+
+	resp, err := rof.ros.get("objects", desc.Digest().Hex())
+	if err == nil && resp == nil {
+		err = fmt.Errorf("remote does not have object %s", desc.Digest())
+	}
+
+	if err != nil {
+		return &errReader{err}
+	}
+
+	rof.current = resp.Body
+
+	return io.LimitReader(resp.Body, int64(size))
+}
+
+func (rof *restObjectFetcher) SignalDone() error {
+	rof.closeCurrent()
+	return nil
+}
+
+func (rof *restObjectFetcher) Close() error {
+	rof.closeCurrent()
+	return nil
+}
+
+func (rof *restObjectFetcher) closeCurrent() {
+	if rof.current != nil {
+		rof.current.Close()
+		rof.current = nil
+	}
+}
+
+// errReader is a reader which always returns an error.
+type errReader struct {
+	err error
+}
+
+func (er *errReader) Read(p []byte) (n int, err error) {
+	return 0, er.err
+}
@@ -0,0 +1,246 @@
+package stemma
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestRESTServer serves the plain HTTP endpoints of the given repository
+// as stemma-httpserver does.
+func newTestRESTServer(repo *Repository) *httptest.Server {
+	r := mux.NewRouter()
+	r.Methods("GET", "HEAD").Path("/objects/{digest:[0-9a-fA-F]+}").HandlerFunc(repo.HandleGetObject)
+	r.Methods("GET", "HEAD").Path("/tags").HandlerFunc(repo.HandleListTagsJSON)
+	r.Methods("GET", "HEAD").Path("/tags/{name:.+}").HandlerFunc(repo.HandleGetTagJSON)
+
+	return httptest.NewServer(r)
+}
+
+// testGet makes a GET request with the given headers and returns the
+// response and its body.
+func testGet(t *testing.T, url string, header map[string]string) (*http.Response, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, string(body)
+}
+
+func TestHandleGetObject(t *testing.T) {
+	repo, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	srv := newTestRESTServer(repo)
+	defer srv.Close()
+
+	desc := storeTestFile(t, repo, "contents")
+	objectURL := srv.URL + "/objects/" + desc.Digest().Hex()
+	etag := fmt.Sprintf("%q", desc.Digest().Hex())
+
+	resp, body := testGet(t, objectURL, nil)
+	if resp.StatusCode != http.StatusOK || body != "contents" {
+		t.Fatalf("got %s with body %q, expected the file contents", resp.Status, body)
+	}
+
+	if got := resp.Header.Get("ETag"); got != etag {
+		t.Errorf("got ETag %s, expected %s", got, etag)
+	}
+
+	if got := resp.Header.Get(objectTypeHeader); got != ObjectTypeFile.String() {
+		t.Errorf("got object type %q, expected %q", got, ObjectTypeFile)
+	}
+
+	if resp, _ := testGet(t, objectURL, map[string]string{"If-None-Match": etag}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("conditional request: got %s, expected 304", resp.Status)
+	}
+
+	resp, body = testGet(t, objectURL, map[string]string{"Range": "bytes=3-5"})
+	if resp.StatusCode != http.StatusPartialContent || body != "ten" {
+		t.Errorf("range request: got %s with body %q, expected 206 with body %q", resp.Status, body, "ten")
+	}
+
+	other, cleanupOther := newTestRepository(t)
+	defer cleanupOther()
+
+	missing := storeTestFile(t, other, "missing")
+	if resp, _ := testGet(t, srv.URL+"/objects/"+missing.Digest().Hex(), nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing object: got %s, expected 404", resp.Status)
+	}
+}
+
+// readSeekOnly hides every method of the wrapped object other than Read and
+// Seek.
+type readSeekOnly struct {
+	io.ReadSeeker
+}
+
+func TestServeObjectWithoutReaderAt(t *testing.T) {
+	repo, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	desc := storeTestFile(t, repo, "contents")
+
+	object, err := repo.getObjectFile(desc.Digest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer object.Close()
+
+	req := httptest.NewRequest("GET", "/objects/"+desc.Digest().Hex(), nil)
+	rec := httptest.NewRecorder()
+
+	serveObject(rec, req, desc.Digest(), readSeekOnly{object})
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "contents" {
+		t.Errorf("got status %d with body %q, expected the file contents", rec.Code, rec.Body.String())
+	}
+
+	if got := rec.Header().Get("Content-Length"); got != "8" {
+		t.Errorf("got Content-Length %q, expected 8", got)
+	}
+}
+
+func TestHandleTagsJSON(t *testing.T) {
+	repo, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	srv := newTestRESTServer(repo)
+	defer srv.Close()
+
+	tags := map[string]Descriptor{
+		"app":   storeTestFile(t, repo, "app"),
+		"app2":  storeTestFile(t, repo, "app2"),
+		"other": storeTestFile(t, repo, "other"),
+	}
+
+	for tag, desc := range tags {
+		if err := repo.TagStore().Set(tag, desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, body := testGet(t, srv.URL+"/tags/app", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s, expected 200", resp.Status)
+	}
+
+	var descJSON DescriptorJSON
+	if err := json.Unmarshal([]byte(body), &descJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	if desc, err := descJSON.Descriptor(); err != nil || !sameObject(desc, tags["app"]) {
+		t.Errorf("got descriptor %v, %v, expected %s", desc, err, tags["app"].Digest())
+	}
+
+	if resp, _ := testGet(t, srv.URL+"/tags/missing", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing tag: got %s, expected 404", resp.Status)
+	}
+
+	resp, body = testGet(t, srv.URL+"/tags?prefix=app", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s, expected 200", resp.Status)
+	}
+
+	var listJSON map[string]DescriptorJSON
+	if err := json.Unmarshal([]byte(body), &listJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(listJSON) != 2 {
+		t.Errorf("got tags %v, expected app and app2", listJSON)
+	}
+
+	for _, tag := range []string{"app", "app2"} {
+		desc, err := listJSON[tag].Descriptor()
+		if err != nil || !sameObject(desc, tags[tag]) {
+			t.Errorf("tag %q is %v, %v, expected %s", tag, desc, err, tags[tag].Digest())
+		}
+	}
+}
+
+func TestRESTObjectStore(t *testing.T) {
+	remoteRepo, cleanupRemote := newTestRepository(t)
+	defer cleanupRemote()
+
+	local, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	srv := newTestRESTServer(remoteRepo)
+	defer srv.Close()
+
+	app := storeTestDirectory(t, remoteRepo, map[string]string{"a": "one", "b": "two"})
+	if err := remoteRepo.TagStore().Set("app", app); err != nil {
+		t.Fatal(err)
+	}
+
+	remote, err := local.RemoteObjectStore("rest+" + srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := remote.ListTags("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tags) != 1 || !sameObject(tags["app"], app) {
+		t.Fatalf("got remote tags %v, expected only app -> %s", tags, app.Digest())
+	}
+
+	desc, err := remote.GetTag("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := remote.GetTag("missing"); err != ErrNoSuchTag {
+		t.Errorf("missing tag: got error %v, expected %v", err, ErrNoSuchTag)
+	}
+
+	if err := remote.Fetch(desc, &ProgressMeter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := local.GetDirectory(desc.Digest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"a": "one", "b": "two"}
+	if len(dir) != len(expected) {
+		t.Fatalf("fetched directory has %d entries, expected %d", len(dir), len(expected))
+	}
+
+	for _, entry := range dir {
+		if got := readTestFile(t, local, entry.ObjectDigest); got != expected[entry.Name] {
+			t.Errorf("fetched file %q contains %q, expected %q", entry.Name, got, expected[entry.Name])
+		}
+	}
+
+	if err := remote.Push("app", desc, desc, false, &ProgressMeter{}); err != ErrPushNotSupported {
+		t.Errorf("push: got error %v, expected %v", err, ErrPushNotSupported)
+	}
+}
@@ -0,0 +1,114 @@
+package stemma
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// SSHCommandEnv is the name of the environment variable which may be set to
+// override the program used to connect to remotes with ssh:// URLs. As with
+// GIT_SSH, the program is invoked with the same arguments as ssh would be:
+// an optional "-p PORT", "--", the [user@]host, and the remote command to
+// run.
+const SSHCommandEnv = "STEMMA_SSH"
+
+// sshDialer returns a dialer which runs stemma-serve for the repository at
+// the path of the given URL on the URL's host using ssh.
+func sshDialer(remoteURL *url.URL) streamDialer {
+	return func() (io.ReadWriteCloser, error) {
+		sshCmd := os.Getenv(SSHCommandEnv)
+		if sshCmd == "" {
+			sshCmd = "ssh"
+		}
+
+		var args []string
+		if port := remoteURL.Port(); port != "" {
+			args = append(args, "-p", port)
+		}
+
+		// A user or host beginning with a dash would be taken by ssh as an
+		// option, which may be used to run arbitrary local commands.
+		host := remoteURL.Hostname()
+		if !validSSHArg(host) {
+			return nil, fmt.Errorf("invalid ssh host %q", host)
+		}
+
+		if remoteURL.User != nil {
+			user := remoteURL.User.Username()
+			if !validSSHArg(user) {
+				return nil, fmt.Errorf("invalid ssh user %q", user)
+			}
+
+			host = user + "@" + host
+		}
+
+		// The remote command is interpreted by the remote user's shell.
+		args = append(args, "--", host, "stemma-serve --path "+shellQuote(remoteURL.Path))
+
+		cmd := exec.Command(sshCmd, args...)
+		cmd.Stderr = os.Stderr
+
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get stdin pipe: %s", err)
+		}
+
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get stdout pipe: %s", err)
+		}
+
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("unable to start %s: %s", sshCmd, err)
+		}
+
+		return &commandConn{
+			cmd:    cmd,
+			stdin:  stdin,
+			stdout: stdout,
+		}, nil
+	}
+}
+
+// validSSHArg returns whether the given user or host may be safely passed to
+// ssh as part of the destination argument.
+func validSSHArg(s string) bool {
+	return s != "" && !strings.HasPrefix(s, "-")
+}
+
+// commandConn is a connection to the standard input and output of a running
+// command.
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+func (cc *commandConn) Read(p []byte) (n int, err error) {
+	return cc.stdout.Read(p)
+}
+
+func (cc *commandConn) Write(p []byte) (n int, err error) {
+	return cc.stdin.Write(p)
+}
+
+// Close closes the standard input of the command and waits for it to exit.
+func (cc *commandConn) Close() error {
+	cc.stdin.Close()
+
+	if err := cc.cmd.Wait(); err != nil {
+		return fmt.Errorf("remote command failed: %s", err)
+	}
+
+	return nil
+}
+
+// shellQuote quotes the given string for use as a single word in a POSIX
+// shell command.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,174 @@
+package stemma
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testServeEnv is set when the test binary is run as stemma-serve by the ssh
+// stub in TestSSHFetch.
+const testServeEnv = "STEMMA_TEST_SERVE"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testServeEnv) != "" {
+		os.Exit(testServe())
+	}
+
+	os.Exit(m.Run())
+}
+
+// testServe serves a single request for a repository over the standard input
+// and output, as stemma-serve does.
+func testServe() int {
+	flags := flag.NewFlagSet("stemma-serve", flag.ContinueOnError)
+	path := flags.String("path", "", "path to the repository to serve")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		return 2
+	}
+
+	repo, err := NewRepository(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to initialize repository: %s\n", err)
+		return 1
+	}
+
+	buf := bufio.NewReadWriter(bufio.NewReader(os.Stdin), bufio.NewWriter(os.Stdout))
+
+	if err := repo.ServeStream(buf); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to serve repository: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func TestSSHDialerRejectsOptions(t *testing.T) {
+	// The dialer must fail before running anything, so point it at a
+	// program which does not exist.
+	defer os.Setenv(SSHCommandEnv, os.Getenv(SSHCommandEnv))
+	os.Setenv(SSHCommandEnv, "/nonexistent/ssh")
+
+	for _, rawURL := range []string{
+		"ssh://-oProxyCommand=true/repo",
+		"ssh://-oProxyCommand=true@example.com/repo",
+		"ssh://@example.com/repo",
+		"ssh:///repo",
+	} {
+		remoteURL, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatalf("unable to parse %q: %s", rawURL, err)
+		}
+
+		conn, err := sshDialer(remoteURL)()
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: expected an error", rawURL)
+			continue
+		}
+
+		if !strings.HasPrefix(err.Error(), "invalid ssh") {
+			t.Errorf("%s: unexpected error: %s", rawURL, err)
+		}
+	}
+}
+
+// sshStub is run in place of ssh. It records its arguments and runs the
+// remote command locally with the test binary standing in for stemma-serve.
+const sshStub = `#!/bin/sh
+echo "$@" > "$STUB_DIR/args"
+while [ "$1" != "--" ]; do shift; done
+PATH="$STUB_DIR:$PATH" exec sh -c "$3"
+`
+
+func TestSSHFetch(t *testing.T) {
+	local, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	remoteRepo, cleanupRemote := newTestRepository(t)
+	defer cleanupRemote()
+
+	app := storeTestDirectory(t, remoteRepo, map[string]string{"a": "one", "b": "two"})
+	if err := remoteRepo.TagStore().Set("app", app); err != nil {
+		t.Fatal(err)
+	}
+
+	stubDir, err := ioutil.TempDir("", "stemma-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stubDir)
+
+	testBinary, err := filepath.Abs(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(testBinary, filepath.Join(stubDir, "stemma-serve")); err != nil {
+		t.Fatal(err)
+	}
+
+	stubPath := filepath.Join(stubDir, "ssh")
+	if err := ioutil.WriteFile(stubPath, []byte(sshStub), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range map[string]string{
+		SSHCommandEnv: stubPath,
+		"STUB_DIR":    stubDir,
+		testServeEnv:  "1",
+	} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+
+	remote, err := local.RemoteObjectStore("ssh://user@example.com:2222" + remoteRepo.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	desc, err := remote.GetTag("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sameObject(desc, app) {
+		t.Fatalf("got remote tag %s, expected %s", desc.Digest(), app.Digest())
+	}
+
+	if err := remote.Fetch(desc, &ProgressMeter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := local.GetDirectory(desc.Digest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedFiles := map[string]string{"a": "one", "b": "two"}
+	if len(dir) != len(expectedFiles) {
+		t.Fatalf("fetched directory has %d entries, expected %d", len(dir), len(expectedFiles))
+	}
+
+	for _, entry := range dir {
+		if got := readTestFile(t, local, entry.ObjectDigest); got != expectedFiles[entry.Name] {
+			t.Errorf("fetched file %q contains %q, expected %q", entry.Name, got, expectedFiles[entry.Name])
+		}
+	}
+
+	args, err := ioutil.ReadFile(filepath.Join(stubDir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := fmt.Sprintf("-p 2222 -- user@example.com stemma-serve --path %s\n", shellQuote(remoteRepo.root))
+	if string(args) != expected {
+		t.Errorf("ssh was run with %q, expected %q", args, expected)
+	}
+}
@@ -35,6 +35,17 @@ func (ot ObjectType) String() string {
 	}
 }
 
+// ParseObjectType parses an object type from its string representation.
+func ParseObjectType(s string) (ObjectType, error) {
+	for _, ot := range []ObjectType{ObjectTypeFile, ObjectTypeDirectory, ObjectTypeHeader, ObjectTypeApplication} {
+		if s == ot.String() {
+			return ot, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown object type: %q", s)
+}
+
 // Marshal writes this object type as a single byte header for objects using
 // the given writer.
 func (ot ObjectType) Marshal(w io.Writer) error {
@@ -119,14 +130,36 @@ type FileWriter interface {
 type TagStore interface {
 	Get(tag string) (Descriptor, error)
 	Set(tag string, desc Descriptor) error
-	List() (tags []string, err error)
+	// CompareAndSet atomically sets the tag to desc only if it currently
+	// refers to the expected descriptor (nil meaning the tag must not
+	// exist). Otherwise ErrTagConflict is returned.
+	CompareAndSet(tag string, expected, desc Descriptor) error
+	// List returns every tag which begins with the given prefix, including
+	// tags in namespaces, which are separated by '/'.
+	List(prefix string) (tags []string, err error)
 	Remove(tag string) error
+	// Log returns the recorded changes to the given tag, most recent
+	// first. Not every tag store keeps logs.
+	Log(tag string) ([]ReflogEntry, error)
+}
+
+// Mount is a record of an application container rootfs which is mounted from
+// a repository by a running process.
+type Mount struct {
+	// Absolute path of the directory on which the rootfs is mounted.
+	Mountpoint string
+	// Process ID of the process serving the mount.
+	PID int
+	// Digest of the mounted application, or nil if every application in
+	// the repository is mounted.
+	Digest Digest
 }
 
 // MountSet is the interface for managing mounts of application container
-// rootfs directories.
+// rootfs directories. There is at most one mount per mountpoint.
 type MountSet interface {
-	List() (digests []Digest, err error)
-	Add(digest Digest) error
-	Remove(digest Digest) error
+	List() (mounts []Mount, err error)
+	Get(mountpoint string) (Mount, error)
+	Add(mount Mount) error
+	Remove(mountpoint string) error
 }
@@ -0,0 +1,388 @@
+package stemma
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// Services which may be requested at the beginning of a stream. These match
+// the services provided over HTTP.
+const (
+	serviceGetTag         = "get-tag"
+	serviceListTags       = "list-tags"
+	serviceServeObjects   = "serve-objects"
+	serviceReceiveObjects = "receive-objects"
+)
+
+// serviceStatus is sent in response to a get-tag or list-tags request.
+type serviceStatus byte
+
+const (
+	serviceStatusOK serviceStatus = iota
+	serviceStatusNotFound
+	serviceStatusError
+)
+
+func writeServiceStatus(wf WriteFlusher, status serviceStatus, msg string) error {
+	if _, err := wf.Write([]byte{byte(status)}); err != nil {
+		return fmt.Errorf("unable to encode service status: %s", err)
+	}
+
+	if err := marshalBytes(wf, []byte(msg)); err != nil {
+		return fmt.Errorf("unable to encode service status message: %s", err)
+	}
+
+	return nil
+}
+
+// readServiceStatus reads a status from the serving end of a stream. A nil
+// error is returned only if the status is OK. A not found status results in
+// ErrNoSuchTag.
+func readServiceStatus(r io.Reader) error {
+	statusBuf := []byte{0}
+	if _, err := io.ReadFull(r, statusBuf); err != nil {
+		return fmt.Errorf("unable to decode service status: %s", err)
+	}
+
+	msg, err := unmarshalBytes(r)
+	if err != nil {
+		return fmt.Errorf("unable to decode service status message: %s", err)
+	}
+
+	switch serviceStatus(statusBuf[0]) {
+	case serviceStatusOK:
+		return nil
+	case serviceStatusNotFound:
+		return ErrNoSuchTag
+	default:
+		return fmt.Errorf("remote error: %s", msg)
+	}
+}
+
+// ServeStream serves a single service request read from the given stream. A
+// request begins with the name of the service followed by any arguments for
+// that service. This allows a repository to be served over any reliable byte
+// stream, such as a pipe or the standard input and output of a process.
+func (r *Repository) ServeStream(rwf ReadWriteFlusher) error {
+	serviceBuf, err := unmarshalBytes(rwf)
+	if err != nil {
+		return fmt.Errorf("unable to read service request: %s", err)
+	}
+
+	switch service := string(serviceBuf); service {
+	case serviceGetTag:
+		return r.serveGetTag(rwf)
+	case serviceListTags:
+		return r.serveListTags(rwf)
+	case serviceServeObjects, serviceReceiveObjects:
+		params, err := negotiateTransfer(rwf, false, r.transferCompressions())
+		if err != nil {
+			return fmt.Errorf("unable to negotiate transfer protocol: %s", err)
+		}
+
+		stream, err := newTransferStream(rwf, params)
+		if err != nil {
+			return err
+		}
+
+		if service == serviceServeObjects {
+			return r.serveLockedObjects(stream, params, &ProgressMeter{})
+		}
+
+		return r.receivePush(stream, params, &ProgressMeter{})
+	default:
+		return fmt.Errorf("unknown service: %q", service)
+	}
+}
+
+// serveLockedObjects serves objects while holding a shared lock on this
+// repository so that they are not removed while being sent.
+func (r *Repository) serveLockedObjects(rwf ReadWriteFlusher, params transferParams, progress *ProgressMeter) error {
+	unlock, err := r.sharedLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return r.serveObjects(rwf, params, progress)
+}
+
+func (r *Repository) serveGetTag(rwf ReadWriteFlusher) error {
+	tagBuf, err := unmarshalBytes(rwf)
+	if err != nil {
+		return fmt.Errorf("unable to read tag: %s", err)
+	}
+
+	tag := string(tagBuf)
+
+	desc, err := r.getTag(tag)
+	if err != nil {
+		status, msg := serviceStatusNotFound, ""
+		if err != ErrNoSuchTag {
+			log.Printf("unable to get descriptor for tag %q: %s", tag, err)
+			status, msg = serviceStatusError, "unable to get tag"
+		}
+
+		if err := writeServiceStatus(rwf, status, msg); err != nil {
+			return err
+		}
+
+		return rwf.Flush()
+	}
+
+	if err := writeServiceStatus(rwf, serviceStatusOK, ""); err != nil {
+		return err
+	}
+
+	if err := MarshalDescriptor(rwf, desc); err != nil {
+		return fmt.Errorf("unable to encode descriptor for tag %q: %s", tag, err)
+	}
+
+	return rwf.Flush()
+}
+
+func (r *Repository) serveListTags(rwf ReadWriteFlusher) error {
+	tagDescriptors, err := r.tagDescriptors("")
+	if err != nil {
+		log.Printf("unable to list tags: %s", err)
+		if err := writeServiceStatus(rwf, serviceStatusError, "unable to list tags"); err != nil {
+			return err
+		}
+
+		return rwf.Flush()
+	}
+
+	if err := writeServiceStatus(rwf, serviceStatusOK, ""); err != nil {
+		return err
+	}
+
+	if err := MarshalTagDescriptors(rwf, tagDescriptors, ""); err != nil {
+		return fmt.Errorf("unable to encode tag descriptors: %s", err)
+	}
+
+	return rwf.Flush()
+}
+
+// tagDescriptors returns the descriptors for all tags in this repository
+// which begin with the given prefix.
+func (r *Repository) tagDescriptors(prefix string) (map[string]Descriptor, error) {
+	tags, err := r.TagStore().List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	tagDescriptors := make(map[string]Descriptor, len(tags))
+
+	for _, tag := range tags {
+		desc, err := r.TagStore().Get(tag)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get descriptor for tag %q: %s", tag, err)
+		}
+
+		tagDescriptors[tag] = desc
+	}
+
+	return tagDescriptors, nil
+}
+
+// streamDialer opens a new stream to a remote which is serving a single
+// service request with ServeStream.
+type streamDialer func() (io.ReadWriteCloser, error)
+
+// streamObjectStore is a remote object store which is accessed by sending
+// service requests over streams opened with a dialer.
+type streamObjectStore struct {
+	r    *Repository
+	dial streamDialer
+}
+
+// request opens a new stream to the remote and sends a request for the given
+// service. The caller is responsible for closing the returned stream.
+func (sos *streamObjectStore) request(service string) (io.Closer, *bufio.ReadWriter, error) {
+	conn, err := sos.dial()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to connect to remote: %s", err)
+	}
+
+	buf := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	if err := marshalBytes(buf, []byte(service)); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("unable to send %s request: %s", service, err)
+	}
+
+	return conn, buf, nil
+}
+
+// requestTransfer requests the given transfer service from the remote and
+// negotiates the transfer parameters.
+func (sos *streamObjectStore) requestTransfer(service string) (io.Closer, ReadWriteFlusher, transferParams, error) {
+	conn, buf, err := sos.request(service)
+	if err != nil {
+		return nil, nil, transferParams{}, err
+	}
+
+	params, err := negotiateTransfer(buf, true, sos.r.transferCompressions())
+	if err != nil {
+		conn.Close()
+		return nil, nil, params, fmt.Errorf("unable to negotiate transfer protocol: %s", err)
+	}
+
+	stream, err := newTransferStream(buf, params)
+	if err != nil {
+		conn.Close()
+		return nil, nil, params, err
+	}
+
+	return conn, stream, params, nil
+}
+
+func (sos *streamObjectStore) GetTag(name string) (Descriptor, error) {
+	conn, buf, err := sos.request(serviceGetTag)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	if err := marshalBytes(buf, []byte(name)); err != nil {
+		return nil, fmt.Errorf("unable to send tag: %s", err)
+	}
+
+	if err := buf.Flush(); err != nil {
+		return nil, fmt.Errorf("unable to flush get-tag request: %s", err)
+	}
+
+	if err := readServiceStatus(buf); err != nil {
+		return nil, err
+	}
+
+	desc, err := UnmarshalDescriptor(buf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode descriptor from response: %s", err)
+	}
+
+	return desc, nil
+}
+
+// ListTags lists the tags of the remote which begin with the given prefix.
+// The list-tags service has no prefix parameter so every tag is listed and
+// then filtered.
+func (sos *streamObjectStore) ListTags(prefix string) (map[string]Descriptor, error) {
+	conn, buf, err := sos.request(serviceListTags)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	if err := buf.Flush(); err != nil {
+		return nil, fmt.Errorf("unable to flush list-tags request: %s", err)
+	}
+
+	if err := readServiceStatus(buf); err != nil {
+		return nil, err
+	}
+
+	tagDescriptors, err := UnmarshalTagDescriptors(buf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode tag descriptors: %s", err)
+	}
+
+	return filterTagPrefix(tagDescriptors, prefix), nil
+}
+
+func (sos *streamObjectStore) Fetch(desc Descriptor, progress *ProgressMeter) error {
+	fetcher, params, conn, err := sos.openFetchSession()
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	return sos.r.fetchObjects(fetcher, params, desc, progress)
+}
+
+func (sos *streamObjectStore) openFetchSession() (RemoteObjectFetcher, transferParams, io.Closer, error) {
+	conn, stream, params, err := sos.requestTransfer(serviceServeObjects)
+	if err != nil {
+		return nil, params, nil, err
+	}
+
+	return newRemoteObjectFetcher(stream), params, conn, nil
+}
+
+func (sos *streamObjectStore) Push(tag string, desc, expected Descriptor, force bool, progress *ProgressMeter) error {
+	conn, stream, params, err := sos.requestTransfer(serviceReceiveObjects)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	return sos.r.sendPush(stream, params, tag, desc, expected, force, progress)
+}
+
+// pipeConn is one end of an in-process, bidirectional pipe. Unlike net.Pipe,
+// writes are buffered by the operating system so that both ends may write
+// before reading without deadlocking.
+type pipeConn struct {
+	*os.File // Read end.
+	w        *os.File
+}
+
+func (pc *pipeConn) Write(p []byte) (n int, err error) {
+	return pc.w.Write(p)
+}
+
+func (pc *pipeConn) Close() error {
+	err := pc.w.Close()
+	if rerr := pc.File.Close(); err == nil {
+		err = rerr
+	}
+
+	return err
+}
+
+// newPipeConns returns two connected ends of an in-process, bidirectional
+// pipe.
+func newPipeConns() (*pipeConn, *pipeConn, error) {
+	r1, w1, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r2, w2, err := os.Pipe()
+	if err != nil {
+		r1.Close()
+		w1.Close()
+		return nil, nil, err
+	}
+
+	return &pipeConn{File: r1, w: w2}, &pipeConn{File: r2, w: w1}, nil
+}
+
+// localDialer returns a dialer for the given local repository. Each stream
+// is served by the local repository in a new goroutine.
+func localDialer(remote *Repository) streamDialer {
+	return func() (io.ReadWriteCloser, error) {
+		client, server, err := newPipeConns()
+		if err != nil {
+			return nil, fmt.Errorf("unable to create pipe: %s", err)
+		}
+
+		go func() {
+			defer server.Close()
+
+			buf := bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server))
+			if err := remote.ServeStream(buf); err != nil {
+				log.Printf("unable to serve local repository: %s", err)
+			}
+		}()
+
+		return client, nil
+	}
+}
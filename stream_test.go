@@ -0,0 +1,78 @@
+package stemma
+
+import (
+	"testing"
+)
+
+func TestLocalRemoteRoundTrip(t *testing.T) {
+	src, cleanupSrc := newTestRepository(t)
+	defer cleanupSrc()
+
+	remoteRepo, cleanupRemote := newTestRepository(t)
+	defer cleanupRemote()
+
+	dst, cleanupDst := newTestRepository(t)
+	defer cleanupDst()
+
+	app := storeTestDirectory(t, src, map[string]string{"a": "one", "b": "two"})
+
+	pushRemote, err := src.RemoteObjectStore("file://" + remoteRepo.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pushRemote.Push("app", app, nil, false, &ProgressMeter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	fetchRemote, err := dst.RemoteObjectStore("file://" + remoteRepo.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := fetchRemote.ListTags("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tags) != 1 || !sameObject(tags["app"], app) {
+		t.Fatalf("got remote tags %v, expected only app -> %s", tags, app.Digest())
+	}
+
+	desc, err := fetchRemote.GetTag("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fetchRemote.Fetch(desc, &ProgressMeter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := dst.GetDirectory(desc.Digest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"a": "one", "b": "two"}
+	if len(dir) != len(expected) {
+		t.Fatalf("fetched directory has %d entries, expected %d", len(dir), len(expected))
+	}
+
+	for _, entry := range dir {
+		if got := readTestFile(t, dst, entry.ObjectDigest); got != expected[entry.Name] {
+			t.Errorf("fetched file %q contains %q, expected %q", entry.Name, got, expected[entry.Name])
+		}
+	}
+
+	// Fetching again only transfers the requested object itself and skips
+	// every object it refers to.
+	progress := &ProgressMeter{}
+	if err := fetchRemote.Fetch(desc, progress); err != nil {
+		t.Fatal(err)
+	}
+
+	if progress.TransferredObjects != 1 || progress.SkippedObjects != app.NumSubObjects() {
+		t.Errorf("refetch transferred %d and skipped %d objects, expected 1 and %d",
+			progress.TransferredObjects, progress.SkippedObjects, app.NumSubObjects())
+	}
+}
@@ -10,13 +10,15 @@ import (
 
 // Lock represents a file lock.
 type Lock struct {
-	fd       int
+	// The file is kept rather than its descriptor so that it is not
+	// closed when it would otherwise be garbage collected.
+	file     *os.File
 	blocking bool
 }
 
 // NewLock creates a new file lock using the given file.
 func NewLock(f *os.File) *Lock {
-	return &Lock{fd: int(f.Fd())}
+	return &Lock{file: f}
 }
 
 // SetBlocking sets whether or not to wait when an incompatible lock is held
@@ -51,5 +53,5 @@ func (l *Lock) lock(opt int) error {
 		opt |= unix.LOCK_NB
 	}
 
-	return unix.Flock(l.fd, opt)
+	return unix.Flock(int(l.file.Fd()), opt)
 }
@@ -0,0 +1,20 @@
+// +build !windows
+
+package sysutil
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// ProcessExists returns whether a process with the given process ID exists.
+func ProcessExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	// Signal 0 performs error checking only. EPERM means that the process
+	// exists but belongs to another user.
+	err := unix.Kill(pid, 0)
+
+	return err == nil || err == unix.EPERM
+}
@@ -8,18 +8,58 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/jlhawn/stemma/sysutil"
 )
 
 // Common errors.
 var (
-	ErrNoSuchTag  = errors.New("no such tag")
-	ErrinvalidTag = errors.New("invalid tag")
+	ErrNoSuchTag   = errors.New("no such tag")
+	ErrInvalidTag  = errors.New("invalid tag")
+	ErrTagConflict = errors.New("tag does not match expected descriptor")
+	// ErrTagNamespace is returned when setting a tag which is already a
+	// namespace of other tags, or which is within a namespace that is
+	// already a tag.
+	ErrTagNamespace = errors.New("tag conflicts with a tag namespace")
+
+	// ErrinvalidTag is the old name of ErrInvalidTag.
+	ErrinvalidTag = ErrInvalidTag
 )
 
-var validTagPatern = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+// Tags may be organized into namespaces by separating the components of a
+// tag with '/', as in "team/service:1.2". Each namespace is a subdirectory of
+// the tags directory. Components may not begin with '.' so that no tag may
+// refer outside of the tags directory and so that temporary files are never
+// mistaken for tags.
+var validTagComponentPattern = regexp.MustCompile(`^[\w][\w.:-]{0,127}$`)
+
+// maxTagLength is the maximum length of a tag including all namespaces.
+const maxTagLength = 255
+
+// validTag returns whether the given tag is well formed. Tags beginning with
+// "remotes/" are reserved for references to remote-tracking tags.
+func validTag(tag string) bool {
+	if len(tag) > maxTagLength || strings.HasPrefix(tag, remoteRefPrefix) {
+		return false
+	}
+
+	for _, component := range strings.Split(tag, "/") {
+		if !validTagComponentPattern.MatchString(component) {
+			return false
+		}
+	}
+
+	return true
+}
 
 type tagStore struct {
 	root string
+	// Directory of tag logs, or empty if changes to tags are not logged.
+	logRoot string
+	// File system through which tag files are written and removed.
+	fs fileSystem
 }
 
 // NewTagStore creates a new tag store using the given root directory.
@@ -30,17 +70,66 @@ func NewTagStore(root string) (TagStore, error) {
 		return nil, fmt.Errorf("unable to use directory %q: not a directory", root)
 	}
 
-	return &tagStore{root: root}, nil
+	return &tagStore{root: root, fs: osFS{}}, nil
+}
+
+// NewLoggedTagStore creates a new tag store using the given root directory
+// which records every change to a tag in a log in the given log directory.
+func NewLoggedTagStore(root, logRoot string) (TagStore, error) {
+	if fi, err := os.Stat(logRoot); err != nil {
+		return nil, fmt.Errorf("unable to stat directory %q: %s", logRoot, err)
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("unable to use directory %q: not a directory", logRoot)
+	}
+
+	tags, err := NewTagStore(root)
+	if err != nil {
+		return nil, err
+	}
+
+	tags.(*tagStore).logRoot = logRoot
+
+	return tags, nil
 }
 
 func (s *tagStore) getPath(tag string) string {
 	return filepath.Join(s.root, tag)
 }
 
+// lock acquires an exclusive lock on the tags directory, blocking until it is
+// available. Each call opens its own handle on the directory so that the lock
+// excludes other goroutines in this process as well as other processes. The
+// returned function releases the lock.
+func (s *tagStore) lock() (unlock func(), err error) {
+	dir, err := os.Open(s.root)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open tags directory: %s", err)
+	}
+
+	lock := sysutil.NewLock(dir)
+	lock.SetBlocking(true)
+
+	if err := lock.ExclusiveLock(); err != nil {
+		dir.Close()
+		return nil, fmt.Errorf("unable to lock tags directory: %s", err)
+	}
+
+	return func() {
+		lock.Unlock()
+		dir.Close()
+	}, nil
+}
+
 func (s *tagStore) Get(tag string) (Descriptor, error) {
+	if !validTag(tag) {
+		return nil, ErrNoSuchTag
+	}
+
 	descObj, err := os.Open(s.getPath(tag))
 	if err != nil {
-		if os.IsNotExist(err) {
+		// A component of the tag may be an existing tag rather than a
+		// namespace.
+		if os.IsNotExist(err) || isNotDir(err) {
 			return nil, ErrNoSuchTag
 		}
 
@@ -48,40 +137,249 @@ func (s *tagStore) Get(tag string) (Descriptor, error) {
 	}
 	defer descObj.Close()
 
-	return UnmarshalDescriptor(descObj)
+	// The tag may name a namespace rather than a tag.
+	if fi, err := descObj.Stat(); err != nil {
+		return nil, fmt.Errorf("unable to stat tag file: %s", err)
+	} else if fi.IsDir() {
+		return nil, ErrNoSuchTag
+	}
+
+	desc, err := UnmarshalDescriptor(descObj)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode tag file: %s", err)
+	}
+
+	return desc, nil
 }
 
 func (s *tagStore) Set(tag string, desc Descriptor) error {
-	if !validTagPatern.MatchString(tag) {
-		return ErrinvalidTag
+	if !validTag(tag) {
+		return ErrInvalidTag
 	}
 
-	descObj, err := os.OpenFile(s.getPath(tag), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0600))
+	unlock, err := s.lock()
 	if err != nil {
-		return fmt.Errorf("unable to open tag file: %s", err)
+		return err
+	}
+	defer unlock()
+
+	current, err := s.Get(tag)
+	if err != nil && err != ErrNoSuchTag {
+		return err
+	}
+
+	if err := s.set(tag, desc); err != nil {
+		return err
 	}
-	defer descObj.Close()
 
-	return MarshalDescriptor(descObj, desc)
+	return s.appendLog(tag, ReflogOpSet, current, desc)
 }
 
-func (s *tagStore) List() (tags []string, err error) {
-	refsDir, err := os.Open(s.root)
+// CompareAndSet sets the given tag to desc only if the tag currently refers
+// to the same object as the expected descriptor. A nil expected descriptor
+// requires that the tag does not yet exist. If the current value of the tag
+// does not match, ErrTagConflict is returned.
+func (s *tagStore) CompareAndSet(tag string, expected, desc Descriptor) error {
+	if !validTag(tag) {
+		return ErrInvalidTag
+	}
+
+	unlock, err := s.lock()
 	if err != nil {
-		return nil, fmt.Errorf("unable to open tags directory: %s", err)
+		return err
+	}
+	defer unlock()
+
+	current, err := s.Get(tag)
+	if err != nil && err != ErrNoSuchTag {
+		return err
+	}
+
+	if !sameObject(current, expected) {
+		return ErrTagConflict
+	}
+
+	if err := s.set(tag, desc); err != nil {
+		return err
+	}
+
+	return s.appendLog(tag, ReflogOpCompareAndSet, current, desc)
+}
+
+// set writes the tag file for the given tag. The descriptor is written to a
+// temporary file which is synced and renamed into place, so that readers and
+// a crash at any point see either the old or the new descriptor, never a
+// partially written one. It must be called with the tags directory locked.
+func (s *tagStore) set(tag string, desc Descriptor) error {
+	tagPath := s.getPath(tag)
+
+	if err := os.MkdirAll(filepath.Dir(tagPath), os.FileMode(0755)); err != nil {
+		if isNotDir(err) {
+			return ErrTagNamespace
+		}
+
+		return fmt.Errorf("unable to make tag namespace directory: %s", err)
+	}
+
+	if fi, err := os.Lstat(tagPath); err == nil && fi.IsDir() {
+		return ErrTagNamespace
+	}
+
+	err := writeFileAtomic(s.fs, tagPath, os.FileMode(0600), func(w io.Writer) error {
+		return MarshalDescriptor(w, desc)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write tag file: %s", err)
+	}
+
+	return s.syncNamespaces(filepath.Dir(tag))
+}
+
+// syncNamespaces syncs the directory of the given namespace, those of the
+// namespaces containing it, and the tags directory itself, so that a new,
+// renamed or removed tag file or namespace directory survives a crash. The
+// namespace of a tag which is not in one is ".".
+func (s *tagStore) syncNamespaces(namespace string) error {
+	for dir := namespace; ; dir = filepath.Dir(dir) {
+		if err := syncDir(s.getPath(dir)); err != nil {
+			return fmt.Errorf("unable to sync tags directory: %s", err)
+		}
+
+		if dir == "." {
+			return nil
+		}
+	}
+}
+
+// List returns every tag which begins with the given prefix, including the
+// tags in all namespaces below the prefix. Tags in namespaces are named by
+// their '/' separated path from the tags directory.
+func (s *tagStore) List(prefix string) (tags []string, err error) {
+	// Only the namespace which contains the prefix needs to be searched.
+	walkRoot := s.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		if !validTag(prefix[:i]) {
+			return nil, nil
+		}
+
+		walkRoot = s.getPath(prefix[:i])
+	}
+
+	err = filepath.Walk(walkRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == walkRoot && path != s.root && (os.IsNotExist(err) || isNotDir(err)) {
+				// There is no such namespace.
+				return nil
+			}
+
+			return err
+		}
+
+		if path == s.root {
+			return nil
+		}
+
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		tag, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+
+		if tag = filepath.ToSlash(tag); strings.HasPrefix(tag, prefix) {
+			tags = append(tags, tag)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tags directory: %s", err)
 	}
 
-	return refsDir.Readdirnames(0)
+	return tags, nil
 }
 
+// Remove removes the given tag along with any namespaces which are left
+// empty. The log of the tag is kept.
 func (s *tagStore) Remove(tag string) error {
-	return os.Remove(s.getPath(tag))
+	if !validTag(tag) {
+		return ErrInvalidTag
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := s.Get(tag)
+	if err != nil {
+		return err
+	}
+
+	if err := s.fs.Remove(s.getPath(tag)); err != nil {
+		return fmt.Errorf("unable to remove tag file: %s", err)
+	}
+
+	// Removing a namespace directory fails once one is not empty. The
+	// innermost namespace which is left must be synced.
+	namespace := filepath.Dir(tag)
+	for ; namespace != "."; namespace = filepath.Dir(namespace) {
+		if s.fs.Remove(s.getPath(namespace)) != nil {
+			break
+		}
+	}
+
+	if err := s.syncNamespaces(namespace); err != nil {
+		return err
+	}
+
+	return s.appendLog(tag, ReflogOpRemove, current, nil)
+}
+
+// isNotDir returns whether the given error is the result of using a file
+// which is not a directory as a directory.
+func isNotDir(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+
+	return err == syscall.ENOTDIR
+}
+
+// sameObject returns whether the given descriptors refer to the same object.
+// Two nil descriptors are considered to be the same.
+func sameObject(d1, d2 Descriptor) bool {
+	if d1 == nil || d2 == nil {
+		return d1 == nil && d2 == nil
+	}
+
+	return d1.Digest().Equals(d2.Digest())
 }
 
-// ResolveRef resolves the given reference string (either a tag or a hex-
-// encoded digest) to a valid digest.
+// ResolveRef resolves the given reference string (either a tag, a previous
+// value of a tag of the form "TAG@{n}", a remote-tracking tag of the form
+// "remotes/NAME/TAG" or a hex-encoded digest) to a valid digest.
 func (r *Repository) ResolveRef(ref string) (Digest, error) {
+	if digest, ok, err := r.resolveReflogRef(ref); ok {
+		return digest, err
+	}
+
 	desc, err := r.TagStore().Get(ref)
+	if err == ErrNoSuchTag {
+		desc, err = r.getRemoteRef(ref)
+	}
+
 	if err != nil {
 		if err != ErrNoSuchTag {
 			return nil, fmt.Errorf("unable to lookup tag: %s", err)
@@ -94,7 +392,28 @@ func (r *Repository) ResolveRef(ref string) (Digest, error) {
 	return desc.Digest(), nil
 }
 
-func MarshalTagDescriptors(w io.Writer, tagDescriptors map[string]Descriptor) error {
+// filterTagPrefix returns the tag descriptors whose tags begin with the
+// given prefix.
+func filterTagPrefix(tagDescriptors map[string]Descriptor, prefix string) map[string]Descriptor {
+	if prefix == "" {
+		return tagDescriptors
+	}
+
+	filtered := make(map[string]Descriptor, len(tagDescriptors))
+	for tag, desc := range tagDescriptors {
+		if strings.HasPrefix(tag, prefix) {
+			filtered[tag] = desc
+		}
+	}
+
+	return filtered
+}
+
+// MarshalTagDescriptors encodes the given tag descriptors whose tags begin
+// with the given prefix. An empty prefix encodes every tag descriptor.
+func MarshalTagDescriptors(w io.Writer, tagDescriptors map[string]Descriptor, prefix string) error {
+	tagDescriptors = filterTagPrefix(tagDescriptors, prefix)
+
 	if err := binary.Write(w, binary.LittleEndian, uint32(len(tagDescriptors))); err != nil {
 		return fmt.Errorf("unable to encode length of tag descriptors: %s", err)
 	}
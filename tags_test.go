@@ -0,0 +1,365 @@
+package stemma
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// errInjected is returned by the failing steps of a faultyFS.
+var errInjected = errors.New("injected failure")
+
+// faultyFS is a file system which fails one step of writing or removing a
+// file.
+type faultyFS struct {
+	failStep string
+}
+
+func (fs faultyFS) OpenFile(name string, flag int, perm os.FileMode) (writableFile, error) {
+	if fs.failStep == "open" {
+		return nil, errInjected
+	}
+
+	file, err := osFS{}.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return faultyFile{file, fs.failStep}, nil
+}
+
+func (fs faultyFS) Rename(oldpath, newpath string) error {
+	if fs.failStep == "rename" {
+		return errInjected
+	}
+
+	return osFS{}.Rename(oldpath, newpath)
+}
+
+func (fs faultyFS) Remove(name string) error {
+	if fs.failStep == "remove" {
+		return errInjected
+	}
+
+	return osFS{}.Remove(name)
+}
+
+type faultyFile struct {
+	writableFile
+	failStep string
+}
+
+func (f faultyFile) Write(p []byte) (int, error) {
+	switch f.failStep {
+	case "write":
+		return 0, errInjected
+	case "short write":
+		// Write part of the contents before failing.
+		n, _ := f.writableFile.Write(p[:len(p)/2])
+		return n, errInjected
+	}
+
+	return f.writableFile.Write(p)
+}
+
+func (f faultyFile) Sync() error {
+	if f.failStep == "sync" {
+		return errInjected
+	}
+
+	return f.writableFile.Sync()
+}
+
+func (f faultyFile) Close() error {
+	err := f.writableFile.Close()
+	if f.failStep == "close" {
+		return errInjected
+	}
+
+	return err
+}
+
+// newTestTagStore returns a tag store in a new temporary directory.
+func newTestTagStore(t *testing.T) (*tagStore, func()) {
+	root, err := ioutil.TempDir("", "stemma-tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := NewTagStore(root)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+
+	return tags.(*tagStore), func() { os.RemoveAll(root) }
+}
+
+// testDescriptor returns a descriptor of a file object whose digest is
+// derived from the given string.
+func testDescriptor(t *testing.T, s string) Descriptor {
+	digester, err := NewDigester(DigestAlgSHA512_256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	io.WriteString(digester, s)
+
+	return &descriptor{
+		digest:     digester.Digest(),
+		size:       uint64(len(s)),
+		objectType: ObjectTypeFile,
+	}
+}
+
+func TestTagSetFailureKeepsOldDescriptor(t *testing.T) {
+	oldDesc := testDescriptor(t, "old")
+	newDesc := testDescriptor(t, "new")
+
+	for _, step := range []string{"open", "write", "short write", "sync", "close", "rename"} {
+		for _, compareAndSet := range []bool{false, true} {
+			tags, cleanup := newTestTagStore(t)
+			defer cleanup()
+
+			if err := tags.Set("team/app", oldDesc); err != nil {
+				t.Fatal(err)
+			}
+
+			tags.fs = faultyFS{failStep: step}
+
+			var err error
+			if compareAndSet {
+				err = tags.CompareAndSet("team/app", oldDesc, newDesc)
+			} else {
+				err = tags.Set("team/app", newDesc)
+			}
+
+			if err == nil {
+				t.Fatalf("%s: expected an error", step)
+			}
+
+			desc, err := tags.Get("team/app")
+			if err != nil {
+				t.Fatalf("%s: unable to get tag: %s", step, err)
+			}
+
+			if !sameObject(desc, oldDesc) {
+				t.Errorf("%s: tag refers to %s, expected %s", step, desc.Digest(), oldDesc.Digest())
+			}
+
+			// The temporary file is removed.
+			infos, err := ioutil.ReadDir(tags.getPath("team"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(infos) != 1 {
+				t.Errorf("%s: namespace has %d entries, expected 1", step, len(infos))
+			}
+		}
+	}
+}
+
+func TestTagSetFailureOfNewTag(t *testing.T) {
+	tags, cleanup := newTestTagStore(t)
+	defer cleanup()
+
+	tags.fs = faultyFS{failStep: "rename"}
+
+	if err := tags.Set("app", testDescriptor(t, "new")); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if _, err := tags.Get("app"); err != ErrNoSuchTag {
+		t.Errorf("got error %v, expected %v", err, ErrNoSuchTag)
+	}
+}
+
+func TestTagRemoveFailureKeepsTag(t *testing.T) {
+	tags, cleanup := newTestTagStore(t)
+	defer cleanup()
+
+	desc := testDescriptor(t, "old")
+	if err := tags.Set("app", desc); err != nil {
+		t.Fatal(err)
+	}
+
+	tags.fs = faultyFS{failStep: "remove"}
+
+	if err := tags.Remove("app"); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if current, err := tags.Get("app"); err != nil || !sameObject(current, desc) {
+		t.Errorf("got %v, %v, expected the old descriptor", current, err)
+	}
+}
+
+func TestTagRemoveMissing(t *testing.T) {
+	tags, cleanup := newTestTagStore(t)
+	defer cleanup()
+
+	if err := tags.Set("team/app", testDescriptor(t, "app")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither a missing tag, a tag within a missing namespace, a tag
+	// within a tag nor a namespace may be removed.
+	for _, tag := range []string{"other", "missing/app", "team/app/more", "team"} {
+		if err := tags.Remove(tag); err != ErrNoSuchTag {
+			t.Errorf("%s: got error %v, expected %v", tag, err, ErrNoSuchTag)
+		}
+	}
+
+	if err := tags.Remove("team/app"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tags.Remove("team/app"); err != ErrNoSuchTag {
+		t.Errorf("got error %v, expected %v", err, ErrNoSuchTag)
+	}
+}
+
+func TestTagCompareAndSet(t *testing.T) {
+	tags, cleanup := newTestTagStore(t)
+	defer cleanup()
+
+	first := testDescriptor(t, "first")
+	second := testDescriptor(t, "second")
+
+	// A tag which does not exist may only be created by expecting nil.
+	if err := tags.CompareAndSet("app", first, second); err != ErrTagConflict {
+		t.Errorf("got error %v creating tag with an expected descriptor, expected %v", err, ErrTagConflict)
+	}
+
+	if err := tags.CompareAndSet("app", nil, first); err != nil {
+		t.Fatalf("unable to create tag: %s", err)
+	}
+
+	// Once it exists, expecting nil or another descriptor conflicts and
+	// leaves the tag unchanged.
+	for _, expected := range []Descriptor{nil, second} {
+		if err := tags.CompareAndSet("app", expected, second); err != ErrTagConflict {
+			t.Errorf("got error %v, expected %v", err, ErrTagConflict)
+		}
+
+		if current, err := tags.Get("app"); err != nil || !sameObject(current, first) {
+			t.Errorf("got %v, %v after a conflict, expected the first descriptor", current, err)
+		}
+	}
+
+	if err := tags.CompareAndSet("app", first, second); err != nil {
+		t.Fatalf("unable to update tag: %s", err)
+	}
+
+	if current, err := tags.Get("app"); err != nil || !sameObject(current, second) {
+		t.Errorf("got %v, %v, expected the second descriptor", current, err)
+	}
+}
+
+func TestValidTag(t *testing.T) {
+	for _, test := range []struct {
+		tag   string
+		valid bool
+	}{
+		{"app", true},
+		{"app:v1.0", true},
+		{"team/app", true},
+		{"team/app/v1", true},
+		{"remotes", true},
+		{"", false},
+		{"..", false},
+		{".app", false},
+		{"team/../app", false},
+		{"team/./app", false},
+		{"team//app", false},
+		{"/app", false},
+		{"app/", false},
+		{"remotes/origin/app", false},
+		{strings.Repeat("a", 128), true},
+		{strings.Repeat("a", 129), false},
+		{strings.Repeat("a/", maxTagLength/2) + "a", true},
+		{strings.Repeat("a/", maxTagLength/2+1) + "a", false},
+	} {
+		if valid := validTag(test.tag); valid != test.valid {
+			t.Errorf("validTag(%q) = %t, expected %t", test.tag, valid, test.valid)
+		}
+	}
+}
+
+func TestTagList(t *testing.T) {
+	tags, cleanup := newTestTagStore(t)
+	defer cleanup()
+
+	desc := testDescriptor(t, "app")
+	for _, tag := range []string{"app", "app2", "apple/v1", "team/app", "team/app2", "team/lib"} {
+		if err := tags.Set(tag, desc); err != nil {
+			t.Fatalf("unable to set tag %q: %s", tag, err)
+		}
+	}
+
+	for _, test := range []struct {
+		prefix   string
+		expected []string
+	}{
+		{"", []string{"app", "app2", "apple/v1", "team/app", "team/app2", "team/lib"}},
+		{"app", []string{"app", "app2", "apple/v1"}},
+		{"apple/", []string{"apple/v1"}},
+		{"team/", []string{"team/app", "team/app2", "team/lib"}},
+		{"team/app", []string{"team/app", "team/app2"}},
+		{"missing/", nil},
+		{"app2/", nil},
+		{"../", nil},
+	} {
+		list, err := tags.List(test.prefix)
+		if err != nil {
+			t.Fatalf("prefix %q: %s", test.prefix, err)
+		}
+
+		sort.Strings(list)
+		if !reflect.DeepEqual(list, test.expected) {
+			t.Errorf("prefix %q: got tags %v, expected %v", test.prefix, list, test.expected)
+		}
+	}
+}
+
+func TestTagNamespaceConflicts(t *testing.T) {
+	tags, cleanup := newTestTagStore(t)
+	defer cleanup()
+
+	desc := testDescriptor(t, "app")
+
+	if err := tags.Set("app", desc); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tags.Set("team/app", desc); err != nil {
+		t.Fatal(err)
+	}
+
+	// A tag may not be used as a namespace, nor a namespace as a tag.
+	for _, tag := range []string{"app/v1", "team"} {
+		if err := tags.Set(tag, desc); err != ErrTagNamespace {
+			t.Errorf("set %q: got error %v, expected %v", tag, err, ErrTagNamespace)
+		}
+
+		if err := tags.CompareAndSet(tag, nil, desc); err != ErrTagNamespace {
+			t.Errorf("compare and set %q: got error %v, expected %v", tag, err, ErrTagNamespace)
+		}
+	}
+
+	// Removing the last tag in a namespace removes the namespace so that
+	// its name may be used as a tag.
+	if err := tags.Remove("team/app"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tags.Set("team", desc); err != nil {
+		t.Errorf("unable to set tag with the name of a removed namespace: %s", err)
+	}
+}
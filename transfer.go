@@ -103,12 +103,15 @@ type remoteObjectFetcher struct {
 	rwf         ReadWriteFlusher
 	err         error
 	descriptors chan descriptorStreamItem
+	// Closed by the descriptor stream goroutine once it has exited.
+	streamDone chan struct{}
 }
 
 func newRemoteObjectFetcher(rwf ReadWriteFlusher) RemoteObjectFetcher {
 	rof := &remoteObjectFetcher{
 		rwf:         rwf,
 		descriptors: make(chan descriptorStreamItem, 256),
+		streamDone:  make(chan struct{}),
 	}
 
 	// This goroutine waits for new descriptors from the descriptor stream
@@ -119,6 +122,8 @@ func newRemoteObjectFetcher(rwf ReadWriteFlusher) RemoteObjectFetcher {
 	// descriptor channel, it's important to close the channel and close
 	// the underlying writer in case of any external error.
 	go func() {
+		defer close(rof.streamDone)
+
 		for {
 			next, ok := <-rof.descriptors
 			if !ok {
@@ -172,6 +177,13 @@ func (rof *remoteObjectFetcher) NextObject(size uint64) io.Reader {
 func (rof *remoteObjectFetcher) SignalDone() error {
 	close(rof.descriptors)
 
+	// Wait for any buffered descriptors to be written before writing the
+	// final header so that the two do not interleave.
+	<-rof.streamDone
+	if rof.err != nil {
+		return rof.err
+	}
+
 	if _, err := rof.rwf.Write([]byte{byte(descriptorStreamHeaderDone)}); err != nil {
 		rof.err = fmt.Errorf("unable to write descriptor stream header: %s", err)
 	} else if err := rof.rwf.Flush(); err != nil {
@@ -220,9 +232,25 @@ func (ds dependencySet) Remove(key Digest) error {
 	return nil
 }
 
-func (r *Repository) fetchObjects(fetcher RemoteObjectFetcher, desc Descriptor, progress *ProgressMeter) error {
+// fetchObjects fetches the object with the given descriptor and all of its
+// missing dependencies using the given fetcher. No more than the negotiated
+// window of objects are requested from the remote at a time. Received
+// objects are synced in batches of the configured size. All of them have been
+// synced by the time this returns, even if the fetch fails part way.
+func (r *Repository) fetchObjects(fetcher RemoteObjectFetcher, params transferParams, desc Descriptor, progress *ProgressMeter) (err error) {
+	if !params.supportsDigestAlg(desc.Digest().Algorithm()) {
+		return fmt.Errorf("unable to fetch object %s: unsupported digest algorithm %s", desc.Digest(), desc.Digest().Algorithm())
+	}
+
+	batch := r.newSyncBatch(r.config.FetchSyncBatch)
+	defer func() {
+		if flushErr := batch.Flush(); err == nil && flushErr != nil {
+			err = fmt.Errorf("unable to commit objects to local store: %s", flushErr)
+		}
+	}()
+
 	waitStack := NewDescriptorStack(0)
-	inFlightQueue := NewDescriptorQueue(256)
+	inFlightQueue := NewDescriptorQueue(params.window)
 	requestedDigestSet := make(digestSet, 1024)
 	objectDeps := make(dependencySet, 1024)
 
@@ -235,7 +263,7 @@ func (r *Repository) fetchObjects(fetcher RemoteObjectFetcher, desc Descriptor,
 
 		remoteObject := newByteCountReader(fetcher.NextObject(desc.Size()), &progress.TransferredSize)
 
-		tempRef, dependencies, err := r.receiveObject(remoteObject, desc)
+		tempRef, dependencies, err := r.receiveObject(remoteObject, desc, batch)
 		if err != nil {
 			return fmt.Errorf("unable to copy remote object %s to local store: %s", desc.Digest().Hex(), err)
 		}
@@ -253,7 +281,7 @@ func (r *Repository) fetchObjects(fetcher RemoteObjectFetcher, desc Descriptor,
 
 		for _, desc := range dependencies {
 			queued := requestedDigestSet.Contains(desc.Digest())
-			have := !queued && r.Contains(desc.Digest())
+			have := !queued && (batch.Contains(desc.Digest()) || r.Contains(desc.Digest()))
 
 			if !have {
 				depTracker.numMissingDeps++
@@ -268,6 +296,10 @@ func (r *Repository) fetchObjects(fetcher RemoteObjectFetcher, desc Descriptor,
 				continue
 			}
 
+			if !params.supportsDigestAlg(desc.Digest().Algorithm()) {
+				return fmt.Errorf("unable to fetch object %s: unsupported digest algorithm %s", desc.Digest(), desc.Digest().Algorithm())
+			}
+
 			waitStack.PushFront(desc)
 			requestedDigestSet.Add(desc.Digest())
 		}
@@ -296,12 +328,18 @@ func (r *Repository) fetchObjects(fetcher RemoteObjectFetcher, desc Descriptor,
 	return fetcher.SignalDone()
 }
 
-func (r *Repository) receiveObject(remoteObject io.Reader, desc Descriptor) (tempRef TempRef, deps []Descriptor, err error) {
-	objWriter, err := r.newObjectWriter(desc.Type())
+// receiveObject copies the object with the given descriptor from the given
+// reader into temporary storage, verifying it using the digest algorithm of
+// the descriptor's digest, and returns its dependencies. If a sync batch is
+// given, the object is synced as part of it when committed.
+func (r *Repository) receiveObject(remoteObject io.Reader, desc Descriptor, batch *syncBatch) (tempRef TempRef, deps []Descriptor, err error) {
+	objWriter, err := r.newObjectWriterAlg(desc.Type(), desc.Digest().Algorithm())
 	if err != nil {
 		return nil, nil, fmt.Errorf("unable to get new object writer: %s", err)
 	}
 
+	objWriter.batch = batch
+
 	defer func() {
 		if err != nil {
 			objWriter.Cancel()
@@ -358,6 +396,7 @@ func (r *Repository) receiveObject(remoteObject io.Reader, desc Descriptor) (tem
 
 	// Do not commit this object into the repository yet as all of its
 	// dependencies may not yet be in the repository.
+	objWriter.deps = deps
 	tempRef, err = objWriter.Hold()
 	if err != nil {
 		return nil, nil, fmt.Errorf("unable to hold object in temp storage: %s", err)
@@ -366,8 +405,11 @@ func (r *Repository) receiveObject(remoteObject io.Reader, desc Descriptor) (tem
 	return tempRef, deps, nil
 }
 
-func (r *Repository) serveObjects(rwf ReadWriteFlusher, progress *ProgressMeter) error {
-	digests := make(chan Digest, 256)
+// serveObjects sends objects requested by the remote end of the given stream
+// until the remote signals that it is done. The remote may not have more than
+// the negotiated window of requested objects outstanding.
+func (r *Repository) serveObjects(rwf ReadWriteFlusher, params transferParams, progress *ProgressMeter) error {
+	descriptors := make(chan Descriptor, params.window)
 
 	// We can't explicitly cancel the goroutines if they are blocked on a
 	// read or write operation. Once the connection is closed, these
@@ -377,8 +419,8 @@ func (r *Repository) serveObjects(rwf ReadWriteFlusher, progress *ProgressMeter)
 	readDone := make(chan error, 1)
 	sendDone := make(chan error, 1)
 
-	go r.sendObjects(rwf, progress, digests, sendDone)
-	go readDigests(rwf, progress, digests, readDone)
+	go r.sendObjects(rwf, progress, descriptors, sendDone)
+	go readDigests(rwf, progress, descriptors, readDone)
 
 	select {
 	case err := <-readDone:
@@ -387,9 +429,9 @@ func (r *Repository) serveObjects(rwf ReadWriteFlusher, progress *ProgressMeter)
 		}
 
 		// The remote is done requesting objects. The reading goroutine
-		// will have closed the digests channel, so the sending
-		// goroutine will get a nil digest once it drains the channel
-		// buffer. Now we wait for the sendObjects goroutine to
+		// will have closed the descriptors channel, so the sending
+		// goroutine will get a nil descriptor once it drains the
+		// channel buffer. Now we wait for the sendObjects goroutine to
 		// complete.
 		return <-sendDone
 
@@ -404,17 +446,17 @@ func (r *Repository) serveObjects(rwf ReadWriteFlusher, progress *ProgressMeter)
 	}
 }
 
-// readDigests reads digests from the given reader until the remote signals
-// that they are done sending digests at which point the digests channel is
-// closed and nil is sent on the done channel. If an error occurs, a non-nil
-// error is sent on the done channel. If the digests channel is at capacity,
-// rather than block on adding another digest, an error will be sent on the
-// done channel. To cancel this goroutine, close the given reader which will
-// result in a non-nil error being sent on the done channel, so the done
-// channel should either be read from after that or buffered so that this
-// goroutine does not block forever.
-func readDigests(r io.Reader, progress *ProgressMeter, digests chan<- Digest, done chan<- error) {
-	maxDigests := cap(digests)
+// readDigests reads requested descriptors from the given reader until the
+// remote signals that they are done sending them at which point the
+// descriptors channel is closed and nil is sent on the done channel. If an
+// error occurs, a non-nil error is sent on the done channel. If the
+// descriptors channel is at capacity, rather than block on adding another
+// descriptor, an error will be sent on the done channel. To cancel this
+// goroutine, close the given reader which will result in a non-nil error being
+// sent on the done channel, so the done channel should either be read from
+// after that or buffered so that this goroutine does not block forever.
+func readDigests(r io.Reader, progress *ProgressMeter, descriptors chan<- Descriptor, done chan<- error) {
+	maxDigests := cap(descriptors)
 
 	for {
 		hdrBuf := make([]byte, 1)
@@ -427,7 +469,7 @@ func readDigests(r io.Reader, progress *ProgressMeter, digests chan<- Digest, do
 
 		if hdr == descriptorStreamHeaderDone {
 			// Signals that the remote is done sending digests.
-			close(digests)
+			close(descriptors)
 			done <- nil
 			return
 		}
@@ -450,34 +492,43 @@ func readDigests(r io.Reader, progress *ProgressMeter, digests chan<- Digest, do
 			return
 		}
 
-		if len(digests) >= maxDigests {
+		if len(descriptors) >= maxDigests {
 			done <- fmt.Errorf("too many digests requested: %d - remote must wait", maxDigests)
 			return
 		}
 
-		digests <- desc.Digest()
+		descriptors <- desc
 	}
 }
 
-// sendObjects waits to receive digests from the given digest channel. The
-// object for the digest is then copied from this repository to the given
-// connection. If a nil digest is read from the digests channel (such as when
-// the channel has been closed and drained), a nil error will be sent on the
-// done channel and the function will return. If any error occurs, a non-nil
-// error will be sent on the done channel. To cancel this goroutine, close the
-// given writer which will result in a non-nil error being sent on the done
-// channel, so the done channel should either be read from after that or
-// buffered so that this goroutine does not block forever.
-func (r *Repository) sendObjects(wf WriteFlusher, progress *ProgressMeter, digests <-chan Digest, done chan<- error) {
+// sendObjects waits to receive descriptors from the given descriptors channel.
+// The object for the descriptor is then copied from this repository to the
+// given connection. If this repository has an upstream and does not have the
+// object, it is fetched from the upstream first. If a nil descriptor is read
+// from the descriptors channel (such as when the channel has been closed and
+// drained), a nil error will be sent on the done channel and the function will
+// return. If any error occurs, a non-nil error will be sent on the done
+// channel. To cancel this goroutine, close the given writer which will result
+// in a non-nil error being sent on the done channel, so the done channel
+// should either be read from after that or buffered so that this goroutine
+// does not block forever.
+func (r *Repository) sendObjects(wf WriteFlusher, progress *ProgressMeter, descriptors <-chan Descriptor, done chan<- error) {
 	for {
-		digest := <-digests
-		if digest == nil {
-			// No more digests to process.
+		desc := <-descriptors
+		if desc == nil {
+			// No more descriptors to process.
 			done <- nil
 			return
 		}
 
-		if err := r.sendObject(wf, progress, digest); err != nil {
+		if r.upstream != nil && !r.Contains(desc.Digest()) {
+			if err := r.upstream.fetch(r, desc); err != nil {
+				done <- err
+				return
+			}
+		}
+
+		if err := r.sendObject(wf, progress, desc.Digest()); err != nil {
 			done <- err
 			return
 		}
@@ -4,6 +4,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 )
 
 func marshalBytes(w io.Writer, buf []byte) error {
@@ -32,3 +34,103 @@ func unmarshalBytes(r io.Reader) (buf []byte, err error) {
 
 	return buf, nil
 }
+
+// fileSystem is the set of file system operations used to replace files
+// atomically. It lets tests fail any of the steps.
+type fileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (writableFile, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+}
+
+// writableFile is a file open for writing which may be synced to stable
+// storage.
+type writableFile interface {
+	io.WriteCloser
+	Sync() error
+}
+
+// osFS is the file system of the operating system.
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (writableFile, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// writeFileAtomic replaces the file at the given path in the given file
+// system with the contents written by the given function. The contents are
+// written to a temporary file in the same directory, named with a leading
+// '.', which is synced before it is renamed into place. Sync the directory
+// afterwards for the rename itself to survive a crash.
+func writeFileAtomic(fs fileSystem, path string, perm os.FileMode, write func(io.Writer) error) error {
+	tempPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path))
+
+	file, err := fs.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = fs.Rename(tempPath, path)
+	}
+
+	if err != nil {
+		fs.Remove(tempPath)
+		return err
+	}
+
+	return nil
+}
+
+// syncDir flushes the entries of the directory at the given path to stable
+// storage.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+const (
+	kilobyte = 1024
+	megabyte = kilobyte * kilobyte
+	gigabyte = megabyte * kilobyte
+	terabyte = gigabyte * kilobyte
+)
+
+// HumanSize formats the given number of bytes using the largest binary unit
+// it exceeds, e.g. "1.500MB".
+func HumanSize(numBytes uint64) string {
+	switch {
+	case numBytes > terabyte:
+		return fmt.Sprintf("%.3fTB", float64(numBytes)/terabyte)
+	case numBytes > gigabyte:
+		return fmt.Sprintf("%.3fGB", float64(numBytes)/gigabyte)
+	case numBytes > megabyte:
+		return fmt.Sprintf("%.3fMB", float64(numBytes)/megabyte)
+	case numBytes > kilobyte:
+		return fmt.Sprintf("%.3fKB", float64(numBytes)/kilobyte)
+	default:
+		return fmt.Sprintf("%dB", numBytes)
+	}
+}